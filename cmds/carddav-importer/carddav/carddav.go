@@ -1,19 +1,64 @@
 package carddav
 
+import "time"
+
 type CardDAVConfig struct {
 	// Server holds the URL of the CardDAV server.
 	Server string
 	// AllowInsecure can be set to true to disable
 	// TLS certificate checks.
 	AllowInsecure bool
+	// CAFile is the path to a PEM encoded CA bundle used
+	// to verify the server certificate in addition to the
+	// system roots.
+	CAFile string
+	// ClientCert and ClientKey are paths to a PEM encoded
+	// client certificate and key used for TLS client
+	// authentication.
+	ClientCert string
+	ClientKey  string
 	// User is the username required for HTTP Basic
 	// authentication.
 	User string
 	// Password is the password required for HTTP Basic
 	// authentication.
 	Password string
-	// AddressBook is the name of the adressbook to use.
-	// If left empty CIS tries to discover the default
+	// PasswordFile is the path to a file that holds the
+	// password. It is used if Password is empty. If both
+	// are empty, $CARDDAV_PASSWORD is used.
+	PasswordFile string
+	// BearerToken is sent as a bearer token in the
+	// Authorization header instead of using HTTP Basic
+	// authentication.
+	BearerToken string
+	// BearerTokenFile is the path to a file that holds the
+	// bearer token. It is used if BearerToken is empty. If
+	// both are empty, $CARDDAV_TOKEN is used.
+	BearerTokenFile string
+	// Timeout is the timeout for a single request to the
+	// CardDAV server. Zero means no timeout.
+	Timeout time.Duration
+	// AddressBooks holds the paths of the adressbooks to
+	// use. If left empty CIS tries to discover the default
 	// address book of the authenticated user.
-	AddressBook string
+	AddressBooks []string
+	// AllAddressBooks can be set to true to use all address
+	// books of the authenticated user.
+	AllAddressBooks bool
+}
+
+// AddressBook describes how a single address book is imported.
+type AddressBook struct {
+	// Path is the path of the address book on the CardDAV
+	// server.
+	Path string
+	// Name is the display name of the address book.
+	Name string
+	// Importer is the name of the importer that owns the
+	// customers of the address book.
+	Importer string
+	// RefPrefix is prepended to the internal reference of
+	// all customers of the address book. It is required if
+	// multiple address books share the same importer.
+	RefPrefix string
 }
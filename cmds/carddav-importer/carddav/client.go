@@ -2,8 +2,12 @@ package carddav
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/emersion/go-webdav"
 	"github.com/emersion/go-webdav/carddav"
@@ -19,10 +23,9 @@ type Client struct {
 
 // NewClient returns a new CardDAV client.
 func NewClient(ctx context.Context, cfg *CardDAVConfig) (*Client, error) {
-	var cli webdav.HTTPClient = http.DefaultClient
-
-	if cfg.User != "" {
-		cli = webdav.HTTPClientWithBasicAuth(cli, cfg.User, cfg.Password)
+	cli, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	davcli, err := carddav.NewClient(cli, cfg.Server)
@@ -40,6 +43,102 @@ func NewClient(ctx context.Context, cfg *CardDAVConfig) (*Client, error) {
 	}, nil
 }
 
+// newHTTPClient builds the HTTP client for the CardDAV server from the TLS
+// and authentication settings in cfg.
+func newHTTPClient(cfg *CardDAVConfig) (webdav.HTTPClient, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.AllowInsecure,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	var cli webdav.HTTPClient = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+	}
+
+	token, err := readSecret(cfg.BearerToken, cfg.BearerTokenFile, "CARDDAV_TOKEN")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bearer token: %w", err)
+	}
+
+	password, err := readSecret(cfg.Password, cfg.PasswordFile, "CARDDAV_PASSWORD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+
+	switch {
+	case token != "" && cfg.User != "":
+		return nil, fmt.Errorf("a bearer token cannot be combined with HTTP Basic authentication for user %q", cfg.User)
+
+	case token != "":
+		cli = &bearerAuthClient{cli: cli, token: token}
+
+	case cfg.User != "":
+		cli = webdav.HTTPClientWithBasicAuth(cli, cfg.User, password)
+	}
+
+	return cli, nil
+}
+
+// readSecret returns value or, if value is empty, the content of file with
+// surrounding whitespace removed or the environment variable env.
+func readSecret(value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+type bearerAuthClient struct {
+	cli   webdav.HTTPClient
+	token string
+}
+
+func (c *bearerAuthClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	return c.cli.Do(req)
+}
+
 func (cli *Client) Sync(ctx context.Context, col, syncToken string) (<-chan string, <-chan *carddav.AddressObject, string, error) {
 	syncResponse, err := cli.cli.SyncCollection(ctx, col, &carddav.SyncQuery{
 		SyncToken: syncToken,
@@ -0,0 +1,178 @@
+package carddav
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func get(t *testing.T, cfg *CardDAVConfig, url string) error {
+	t.Helper()
+
+	cli, err := newHTTPClient(cfg)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// writeClientCert creates a self-signed client certificate and returns the
+// paths of the PEM encoded certificate and key.
+func writeClientCert(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "importer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := writeFile(t, "client.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeFile(t, "client.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+
+	return certFile, keyFile
+}
+
+func TestHTTPClientCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// the test certificate is not trusted by default
+	require.Error(t, get(t, &CardDAVConfig{}, srv.URL))
+
+	bundle := writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	require.NoError(t, get(t, &CardDAVConfig{CAFile: bundle}, srv.URL))
+
+	_, err := newHTTPClient(&CardDAVConfig{CAFile: writeFile(t, "empty.pem", "no certificates")})
+	require.ErrorContains(t, err, "no certificates found")
+
+	_, err = newHTTPClient(&CardDAVConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	require.ErrorContains(t, err, "failed to read CA bundle")
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	var subjects []string
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cert := range r.TLS.PeerCertificates {
+			subjects = append(subjects, cert.Subject.CommonName)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	certFile, keyFile := writeClientCert(t)
+
+	// the server requires a client certificate
+	require.Error(t, get(t, &CardDAVConfig{AllowInsecure: true}, srv.URL))
+
+	require.NoError(t, get(t, &CardDAVConfig{AllowInsecure: true, ClientCert: certFile, ClientKey: keyFile}, srv.URL))
+	require.Equal(t, []string{"importer"}, subjects)
+
+	_, err := newHTTPClient(&CardDAVConfig{ClientCert: certFile})
+	require.ErrorContains(t, err, "failed to load client certificate")
+}
+
+func TestHTTPClientAuth(t *testing.T) {
+	var header string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	t.Setenv("CARDDAV_TOKEN", "")
+	t.Setenv("CARDDAV_PASSWORD", "")
+
+	require.NoError(t, get(t, &CardDAVConfig{BearerToken: "secret"}, srv.URL))
+	require.Equal(t, "Bearer secret", header)
+
+	require.NoError(t, get(t, &CardDAVConfig{BearerTokenFile: writeFile(t, "token", " from-file\n")}, srv.URL))
+	require.Equal(t, "Bearer from-file", header)
+
+	require.NoError(t, get(t, &CardDAVConfig{User: "alice", PasswordFile: writeFile(t, "password", "wonderland\n")}, srv.URL))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.SetBasicAuth("alice", "wonderland")
+	require.Equal(t, req.Header.Get("Authorization"), header)
+
+	require.NoError(t, get(t, &CardDAVConfig{}, srv.URL))
+	require.Empty(t, header)
+
+	// a token must not be combined with a user
+	_, err := newHTTPClient(&CardDAVConfig{User: "alice", BearerToken: "secret"})
+	require.ErrorContains(t, err, "cannot be combined")
+
+	t.Setenv("CARDDAV_TOKEN", "from-env")
+	_, err = newHTTPClient(&CardDAVConfig{User: "alice"})
+	require.ErrorContains(t, err, "cannot be combined")
+
+	_, err = newHTTPClient(&CardDAVConfig{BearerTokenFile: filepath.Join(t.TempDir(), "missing")})
+	require.ErrorContains(t, err, "failed to read bearer token")
+}
+
+func TestReadSecret(t *testing.T) {
+	t.Setenv("TEST_SECRET", "from-env")
+
+	file := writeFile(t, "secret", "  from-file\n")
+
+	cases := []struct {
+		value string
+		file  string
+		want  string
+	}{
+		{"value", file, "value"},
+		{"", file, "from-file"},
+		{"", "", "from-env"},
+	}
+
+	for _, c := range cases {
+		got, err := readSecret(c.value, c.file, "TEST_SECRET")
+		require.NoError(t, err)
+		require.Equal(t, c.want, got)
+	}
+
+	_, err := readSecret("", filepath.Join(t.TempDir(), "missing"), "TEST_SECRET")
+	require.Error(t, err)
+}
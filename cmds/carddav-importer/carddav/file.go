@@ -0,0 +1,43 @@
+package carddav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-vcard"
+	"github.com/sirupsen/logrus"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+// ImportFile decodes all cards from r, for example a .vcf export of a phone
+// or a mail client, and upserts them. It returns the number of cards read.
+// Phone numbers are parsed using the default country.
+func ImportFile(ctx context.Context, stream *importer.Manager, r io.Reader, country string) (int, error) {
+	dec := vcard.NewDecoder(r)
+
+	var count int
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		card, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+
+		if err != nil {
+			return count, fmt.Errorf("failed to decode card %d: %w", count+1, err)
+		}
+
+		count++
+
+		cus, ref, extra := ConvertCard(card, country)
+
+		if err := stream.UpsertCustomerByRef(ref, cus, extra); err != nil {
+			logrus.Errorf("failed to upsert customer: %s: %s", ref, err)
+		}
+	}
+}
@@ -2,113 +2,371 @@ package carddav
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/emersion/go-vcard"
 	"github.com/emersion/go-webdav/carddav"
-	"github.com/nyaruka/phonenumbers"
 	"github.com/sirupsen/logrus"
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
 	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
 )
 
-func FindAddressBook(ctx context.Context, cli *Client, cfg *CardDAVConfig) error {
-	if cfg.AddressBook != "" {
-		return nil
-	}
+// FindAddressBooks returns the address books configured in cfg. If none
+// are configured it returns all address books if cfg.AllAddressBooks is
+// set or tries to detect the default address book otherwise.
+func FindAddressBooks(ctx context.Context, cli *Client, cfg *CardDAVConfig) ([]carddav.AddressBook, error) {
+	if len(cfg.AddressBooks) > 0 && !cfg.AllAddressBooks {
+		books := make([]carddav.AddressBook, len(cfg.AddressBooks))
+		for idx, p := range cfg.AddressBooks {
+			books[idx] = carddav.AddressBook{
+				Path: p,
+				Name: path.Base(strings.TrimSuffix(p, "/")),
+			}
+		}
 
-	logrus.Errorf("no address book configured. Trying to auto-detect the default addressbook")
+		return books, nil
+	}
 
 	books, err := cli.ListAddressBooks(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to enumerate address books: %w", err)
+		return nil, fmt.Errorf("failed to enumerate address books: %w", err)
 	}
 	if len(books) == 0 {
-		return fmt.Errorf("no address books available")
+		return nil, fmt.Errorf("no address books available")
+	}
+
+	if cfg.AllAddressBooks {
+		for _, b := range books {
+			logrus.Infof("using address book %s (%s)", b.Name, b.Path)
+		}
+
+		return books, nil
 	}
+
+	logrus.Errorf("no address book configured. Trying to auto-detect the default addressbook")
+
 	// try to find an address book with the name "default"
 	for _, b := range books {
 		if strings.ToLower(b.Name) == "default" {
 			logrus.Infof("using address book %s (%s)", b.Name, b.Path)
-			cfg.AddressBook = b.Path
 
-			break
+			return []carddav.AddressBook{b}, nil
 		}
 	}
-	if cfg.AddressBook == "" {
-		b := books[0]
-		logrus.Infof("using address book %s (%s)", b.Name, b.Path)
 
-		cfg.AddressBook = b.Path
-	}
+	b := books[0]
+	logrus.Infof("using address book %s (%s)", b.Name, b.Path)
 
-	return nil
+	return []carddav.AddressBook{b}, nil
 }
 
-func ProcessUpdates(ctx context.Context, stream *importer.Manager, cfg *CardDAVConfig, deleted <-chan string, updated <-chan *carddav.AddressObject) error {
+// ProcessUpdates upserts all updated address objects of book. It returns
+// the number of deleted objects, which are not yet supported and are only
+// removed when pruning orphans of a full snapshot. Phone numbers are parsed
+// using the default country.
+func ProcessUpdates(ctx context.Context, stream *importer.Manager, book *AddressBook, country string, deleted <-chan string, updated <-chan *carddav.AddressObject) (int, error) {
+	var deletes int
+
 L:
 	for {
 		select {
-		case <-deleted:
+		case _, ok := <-deleted:
 			// TODO(ppacher): not yet supported
+			if !ok {
+				deleted = nil
+
+				continue
+			}
+
+			deletes++
 
 		case upd, ok := <-updated:
 			if !ok {
 				break L
 			}
 
-			cus, ref, err := convertToCustomer(upd)
+			cus, ref, extra, err := convertToCustomer(upd, country)
 			if err != nil {
 				logrus.Errorf("failed to convert address object to customer: %s: %s", upd.Path, err)
 
 				continue
 			}
 
-			if err := stream.UpsertCustomerByRef(ref, cus, nil); err != nil {
+			ref = book.RefPrefix + ref
+
+			if err := stream.UpsertCustomerByRef(ref, cus, extra); err != nil {
 				logrus.Errorf("failed to upsert customer: %s: %s", ref, err)
 			}
 
 		case <-ctx.Done():
-			return ctx.Err()
+			return deletes, ctx.Err()
+		}
+	}
+
+	if deleted != nil {
+		for range deleted {
+			deletes++
 		}
 	}
 
-	return nil
+	return deletes, nil
 }
 
-func convertToCustomer(ao *carddav.AddressObject) (*customerv1.Customer, string, error) {
+func convertToCustomer(ao *carddav.AddressObject, country string) (*customerv1.Customer, string, map[string]interface{}, error) {
 	if ao.Card == nil {
-		return nil, "", fmt.Errorf("no VCARD data available")
+		return nil, "", nil, fmt.Errorf("no VCARD data available")
 	}
 
+	cus, ref, extra := ConvertCard(ao.Card, country)
+
+	return cus, ref, extra, nil
+}
+
+// mappedFields are vCard properties that are either converted to customer
+// attributes, stored explicitly in the extra data or are meaningless for
+// customers.
+var mappedFields = map[string]struct{}{
+	vcard.FieldVersion:       {},
+	vcard.FieldProductID:     {},
+	vcard.FieldUID:           {},
+	vcard.FieldRevision:      {},
+	vcard.FieldName:          {},
+	vcard.FieldFormattedName: {},
+	vcard.FieldAddress:       {},
+	vcard.FieldTelephone:     {},
+	vcard.FieldEmail:         {},
+	vcard.FieldOrganization:  {},
+	vcard.FieldNote:          {},
+
+	// binary data is too large to be stored in the import state.
+	vcard.FieldPhoto: {},
+	vcard.FieldLogo:  {},
+	vcard.FieldSound: {},
+	vcard.FieldKey:   {},
+}
+
+// ConvertCard converts card to a customer. It returns the customer, the
+// internal reference, which is the UID of the card or a hash of its content
+// if the card does not have a UID, and the extra data for the import state.
+// Phone numbers without a country code are parsed for the given default
+// country.
+//
+// The extra data holds the organization, note, name prefix and suffix, the
+// types of all phone numbers, email addresses and postal addresses as well
+// as all remaining non-binary fields of the card.
+func ConvertCard(card vcard.Card, country string) (*customerv1.Customer, string, map[string]interface{}) {
 	cus := new(customerv1.Customer)
-	if n := ao.Card.Name(); n != nil {
+	extra := make(map[string]interface{})
+
+	if n := card.Name(); n != nil {
 		cus.FirstName = strings.TrimSpace(n.GivenName)
 		cus.LastName = strings.TrimSpace(n.FamilyName)
+
+		setExtra(extra, "namePrefix", n.HonorificPrefix)
+		setExtra(extra, "nameSuffix", n.HonorificSuffix)
+		setExtra(extra, "additionalName", n.AdditionalName)
+	}
+
+	if cus.FirstName == "" && cus.LastName == "" {
+		cus.FirstName, cus.LastName = splitFormattedName(card.PreferredValue(vcard.FieldFormattedName))
 	}
 
-	if addr := ao.Card.Address(); addr != nil {
-		cus.Addresses = append(cus.Addresses, &customerv1.Address{
+	var addresses []interface{}
+	for _, addr := range card.Addresses() {
+		address := &customerv1.Address{
 			City:       strings.TrimSpace(addr.Locality),
 			Street:     strings.TrimSpace(addr.StreetAddress),
 			PostalCode: strings.TrimSpace(addr.PostalCode),
+			Extra:      joinNonEmpty(", ", addr.ExtendedAddress, addr.PostOfficeBox),
+		}
+
+		if address.City == "" && address.Street == "" && address.PostalCode == "" && address.Extra == "" {
+			continue
+		}
+
+		cus.Addresses = append(cus.Addresses, address)
+
+		addresses = append(addresses, map[string]interface{}{
+			"street":     address.Street,
+			"postalCode": address.PostalCode,
+			"city":       address.City,
+			"region":     strings.TrimSpace(addr.Region),
+			"country":    strings.TrimSpace(addr.Country),
+			"types":      fieldTypes(addr.Field),
 		})
 	}
 
-	cus.EmailAddresses = ao.Card.Values(vcard.FieldEmail)
-	for _, phone := range ao.Card.Values(vcard.FieldTelephone) {
-		number, err := phonenumbers.Parse(phone, "AT")
+	if len(addresses) > 0 {
+		extra["addresses"] = addresses
+	}
+
+	emailTypes := make(map[string]interface{})
+	for _, f := range card[vcard.FieldEmail] {
+		email := strings.TrimSpace(f.Value)
+		if email == "" {
+			continue
+		}
+
+		cus.EmailAddresses = append(cus.EmailAddresses, email)
+
+		if types := fieldTypes(f); len(types) > 0 {
+			emailTypes[email] = types
+		}
+	}
+
+	if len(emailTypes) > 0 {
+		extra["emailTypes"] = emailTypes
+	}
+
+	phoneTypes := make(map[string]interface{})
+	for _, f := range card[vcard.FieldTelephone] {
+		// vCard 4.0 may encode phone numbers as tel: URIs
+		phone := strings.TrimPrefix(strings.TrimSpace(f.Value), "tel:")
+		if phone == "" {
+			continue
+		}
+
+		formatted, err := importer.NormalizePhoneNumber(phone, country, "")
 		if err != nil {
 			logrus.Errorf("failed to parse phone number %q: %s", phone, err)
 
 			continue
 		}
 
-		cus.PhoneNumbers = append(cus.PhoneNumbers,
-			phonenumbers.Format(number, phonenumbers.INTERNATIONAL),
-		)
+		cus.PhoneNumbers = append(cus.PhoneNumbers, formatted)
+
+		if types := fieldTypes(f); len(types) > 0 {
+			phoneTypes[formatted] = types
+		}
+	}
+
+	if len(phoneTypes) > 0 {
+		extra["phoneTypes"] = phoneTypes
+	}
+
+	// ORG is a structured value of the organization name followed by its
+	// units.
+	setExtra(extra, "organization", joinNonEmpty(", ", strings.Split(card.PreferredValue(vcard.FieldOrganization), ";")...))
+	setExtra(extra, "note", strings.Join(card.Values(vcard.FieldNote), "\n"))
+
+	fields := make(map[string]interface{})
+	for key, values := range card {
+		if _, ok := mappedFields[key]; ok {
+			continue
+		}
+
+		var list []interface{}
+		for _, f := range values {
+			if v := strings.TrimSpace(f.Value); v != "" {
+				list = append(list, v)
+			}
+		}
+
+		if len(list) > 0 {
+			fields[key] = list
+		}
 	}
 
-	return cus, ao.Card.Value(vcard.FieldUID), nil
+	if len(fields) > 0 {
+		extra["fields"] = fields
+	}
+
+	ref := card.Value(vcard.FieldUID)
+	if ref == "" {
+		ref = cardHash(card)
+	}
+
+	return cus, ref, extra
+}
+
+// splitFormattedName splits a formatted name into first and last name. The
+// last word is used as the last name, unless the name is written as
+// "Last, First".
+func splitFormattedName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+
+	if last, first, ok := strings.Cut(name, ","); ok {
+		return strings.TrimSpace(first), strings.TrimSpace(last)
+	}
+
+	words := strings.Fields(name)
+	switch len(words) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", words[0]
+	}
+
+	return strings.Join(words[:len(words)-1], " "), words[len(words)-1]
+}
+
+// fieldTypes returns the lower-cased TYPE parameters of f.
+func fieldTypes(f *vcard.Field) []interface{} {
+	if f == nil {
+		return nil
+	}
+
+	var types []interface{}
+	for _, t := range f.Params.Types() {
+		// vCard 2.1 and 3.0 allow comma separated type lists
+		for _, v := range strings.Split(t, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				types = append(types, v)
+			}
+		}
+	}
+
+	return types
+}
+
+func setExtra(extra map[string]interface{}, key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		extra[key] = value
+	}
+}
+
+func joinNonEmpty(sep string, values ...string) string {
+	var result []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+
+	return strings.Join(result, sep)
+}
+
+// cardHash returns a hash of all fields of card. Fields and parameters are
+// sorted so the hash does not depend on their order in the file. Fields that
+// servers and clients rewrite without changing the contact are skipped.
+func cardHash(card vcard.Card) string {
+	var lines []string
+
+	for key, fields := range card {
+		switch key {
+		case vcard.FieldRevision, vcard.FieldProductID, vcard.FieldVersion:
+			continue
+		}
+
+		for _, f := range fields {
+			var params []string
+			for name, values := range f.Params {
+				params = append(params, name+"="+strings.Join(values, ","))
+			}
+			sort.Strings(params)
+
+			lines = append(lines, strings.Join([]string{f.Group, key, strings.Join(params, ";"), f.Value}, "\x00"))
+		}
+	}
+
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+
+	return "sha256:" + hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,246 @@
+package carddav
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func decodeCard(t *testing.T, lines ...string) vcard.Card {
+	t.Helper()
+
+	card, err := vcard.NewDecoder(strings.NewReader(strings.Join(lines, "\r\n") + "\r\n")).Decode()
+	require.NoError(t, err)
+
+	return card
+}
+
+func TestConvertCard(t *testing.T) {
+	cases := []struct {
+		name     string
+		lines    []string
+		country  string
+		ref      string
+		customer *customerv1.Customer
+		extra    map[string]interface{}
+	}{
+		{
+			name: "structured name with multiple addresses and phone numbers",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:3.0",
+				"UID:jane",
+				"N:Doe;Jane;Maria;Dr.;MSc",
+				"FN:Dr. Jane Maria Doe MSc",
+				"TEL;TYPE=HOME,VOICE:01 234567",
+				"TEL;TYPE=CELL:tel:+43 664 1234567",
+				"TEL:invalid",
+				"EMAIL;TYPE=WORK:jane@example.com",
+				"ADR;TYPE=HOME:;Top 3;Hauptstraße 1;Wien;;1010;Austria",
+				"ADR;TYPE=WORK:;;Ringstraße 2;Linz;OÖ;4020;",
+				"ADR:;;;;;;",
+				"ORG:Example;Vet",
+				"NOTE:likes cats",
+				"X-PET:Tom",
+				"END:VCARD",
+			},
+			country: "AT",
+			ref:     "jane",
+			customer: &customerv1.Customer{
+				FirstName:      "Jane",
+				LastName:       "Doe",
+				PhoneNumbers:   []string{"+43 1 234567", "+43 664 1234567"},
+				EmailAddresses: []string{"jane@example.com"},
+				Addresses: []*customerv1.Address{
+					{Street: "Hauptstraße 1", PostalCode: "1010", City: "Wien", Extra: "Top 3"},
+					{Street: "Ringstraße 2", PostalCode: "4020", City: "Linz"},
+				},
+			},
+			extra: map[string]interface{}{
+				"namePrefix":     "Dr.",
+				"nameSuffix":     "MSc",
+				"additionalName": "Maria",
+				"addresses": []interface{}{
+					map[string]interface{}{"street": "Hauptstraße 1", "postalCode": "1010", "city": "Wien", "region": "", "country": "Austria", "types": []interface{}{"home"}},
+					map[string]interface{}{"street": "Ringstraße 2", "postalCode": "4020", "city": "Linz", "region": "OÖ", "country": "", "types": []interface{}{"work"}},
+				},
+				"emailTypes": map[string]interface{}{"jane@example.com": []interface{}{"work"}},
+				"phoneTypes": map[string]interface{}{
+					"+43 1 234567":    []interface{}{"home", "voice"},
+					"+43 664 1234567": []interface{}{"cell"},
+				},
+				"organization": "Example, Vet",
+				"note":         "likes cats",
+				"fields":       map[string]interface{}{"X-PET": []interface{}{"Tom"}},
+			},
+		},
+		{
+			name: "formatted name only",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:3.0",
+				"UID:john",
+				"FN:John Peter Doe",
+				"TEL:030 123456",
+				"END:VCARD",
+			},
+			country: "DE",
+			ref:     "john",
+			customer: &customerv1.Customer{
+				FirstName:    "John Peter",
+				LastName:     "Doe",
+				PhoneNumbers: []string{"+49 30 123456"},
+			},
+			extra: map[string]interface{}{},
+		},
+		{
+			name: "empty structured name",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:3.0",
+				"UID:max",
+				"N:;;;;",
+				"FN:Mustermann, Max",
+				"END:VCARD",
+			},
+			country:  "AT",
+			ref:      "max",
+			customer: &customerv1.Customer{FirstName: "Max", LastName: "Mustermann"},
+			extra:    map[string]interface{}{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			customer, ref, extra := ConvertCard(decodeCard(t, c.lines...), c.country)
+
+			require.Equal(t, c.ref, ref)
+			require.True(t, proto.Equal(c.customer, customer), "got %v", customer)
+			require.Equal(t, c.extra, extra)
+		})
+	}
+}
+
+func TestConvertCardWithoutUID(t *testing.T) {
+	card := decodeCard(t,
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"FN:Jane Doe",
+		"TEL;TYPE=HOME:01 234567",
+		"EMAIL:jane@example.com",
+		"END:VCARD",
+	)
+
+	customer, ref, _ := ConvertCard(card, "AT")
+	require.Equal(t, "Doe", customer.LastName)
+	require.Equal(t, cardHash(card), ref)
+	require.True(t, strings.HasPrefix(ref, "sha256:"))
+}
+
+func TestSplitFormattedName(t *testing.T) {
+	cases := []struct {
+		name  string
+		first string
+		last  string
+	}{
+		{"", "", ""},
+		{"   ", "", ""},
+		{"Doe", "", "Doe"},
+		{"Jane Doe", "Jane", "Doe"},
+		{" Jane  Maria   Doe ", "Jane Maria", "Doe"},
+		{"Doe, Jane", "Jane", "Doe"},
+		{"Doe,Jane Maria", "Jane Maria", "Doe"},
+	}
+
+	for _, c := range cases {
+		first, last := splitFormattedName(c.name)
+		require.Equal(t, c.first, first, c.name)
+		require.Equal(t, c.last, last, c.name)
+	}
+}
+
+func TestCardHash(t *testing.T) {
+	base := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"PRODID:-//Example//Contacts 1.0//EN",
+		"REV:2024-01-01T10:00:00Z",
+		"FN:Jane Doe",
+		"TEL;TYPE=HOME,VOICE:01 234567",
+		"TEL;TYPE=CELL:0664 1234567",
+		"END:VCARD",
+	}
+
+	cases := []struct {
+		name  string
+		lines []string
+		equal bool
+	}{
+		{
+			name: "reordered fields",
+			lines: []string{
+				"BEGIN:VCARD",
+				"TEL;TYPE=CELL:0664 1234567",
+				"FN:Jane Doe",
+				"TEL;TYPE=HOME,VOICE:01 234567",
+				"VERSION:3.0",
+				"END:VCARD",
+			},
+			equal: true,
+		},
+		{
+			name: "changed revision",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:4.0",
+				"PRODID:-//Example//Contacts 2.0//EN",
+				"REV:2024-06-01T12:30:00Z",
+				"FN:Jane Doe",
+				"TEL;TYPE=HOME,VOICE:01 234567",
+				"TEL;TYPE=CELL:0664 1234567",
+				"END:VCARD",
+			},
+			equal: true,
+		},
+		{
+			name: "changed value",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:3.0",
+				"FN:Jane Roe",
+				"TEL;TYPE=HOME,VOICE:01 234567",
+				"TEL;TYPE=CELL:0664 1234567",
+				"END:VCARD",
+			},
+		},
+		{
+			name: "changed parameter",
+			lines: []string{
+				"BEGIN:VCARD",
+				"VERSION:3.0",
+				"FN:Jane Doe",
+				"TEL;TYPE=WORK,VOICE:01 234567",
+				"TEL;TYPE=CELL:0664 1234567",
+				"END:VCARD",
+			},
+		},
+	}
+
+	hash := cardHash(decodeCard(t, base...))
+	require.Equal(t, hash, cardHash(decodeCard(t, base...)))
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			other := cardHash(decodeCard(t, c.lines...))
+			if c.equal {
+				require.Equal(t, hash, other)
+			} else {
+				require.NotEqual(t, hash, other)
+			}
+		})
+	}
+}
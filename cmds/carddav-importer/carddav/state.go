@@ -0,0 +1,58 @@
+package carddav
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SyncState holds the sync tokens of all address books, keyed by the
+// address book path, so subsequent runs only fetch changed cards.
+type SyncState struct {
+	Tokens map[string]string `json:"tokens"`
+}
+
+// LoadSyncState reads the sync state from path. A missing file results in
+// an empty state.
+func LoadSyncState(path string) (*SyncState, error) {
+	state := &SyncState{
+		Tokens: make(map[string]string),
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("failed to decode sync state: %w", err)
+	}
+
+	if state.Tokens == nil {
+		state.Tokens = make(map[string]string)
+	}
+
+	return state, nil
+}
+
+// Save writes the sync state to path.
+func (state *SyncState) Save(path string) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so an interrupted write does not
+	// corrupt the existing state.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -2,7 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
 
+	webdavcarddav "github.com/emersion/go-webdav/carddav"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/tierklinik-dobersberg/apis/pkg/cli"
@@ -17,46 +25,357 @@ func main() {
 }
 
 func getRootCmd() *cli.Root {
-	cfg := carddav.CardDAVConfig{}
+	var (
+		cfg           = carddav.CardDAVConfig{}
+		dryRun        bool
+		file          string
+		importerName  string
+		bookImporters []string
+		refPrefix     bool
+		stateFile     string
+		fullSync      bool
+		country       string
+	)
 
 	cmd := cli.New("carddav-importer")
 
 	cmd.Run = func(_ *cobra.Command, args []string) {
-		carddavCli, err := carddav.NewClient(context.Background(), &cfg)
-		if err != nil {
-			logrus.Fatal(err.Error())
+		customerCli := cmd.CustomerImport()
+
+		newStream := func(ctx context.Context) importer.ImportStream {
+			return importer.StreamOptions{DryRun: dryRun}.Apply(customerCli.ImportSession(ctx))
 		}
 
-		customerCli := cmd.CustomerImport()
+		// a full sync contains all cards of an address book so the session
+		// can remove customers whose cards have been deleted.
+		newSnapshotStream := func(ctx context.Context) importer.ImportStream {
+			return importer.StreamOptions{DryRun: dryRun, Snapshot: true}.Apply(customerCli.ImportSession(ctx))
+		}
+
+		if file != "" {
+			var input io.Reader = os.Stdin
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					logrus.Fatal(err.Error())
+				}
+				defer f.Close()
+
+				input = f
+			}
+
+			manager, err := importer.NewManager(context.Background(), importerName, newStream, importer.Options{})
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			count, err := carddav.ImportFile(context.Background(), manager, input, country)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			logrus.Infof("imported %d cards from %s", count, file)
+
+			if !finish(cmd, manager) {
+				os.Exit(1)
+			}
 
-		stream := customerCli.ImportSession(context.Background())
-		manager, err := importer.NewManager(context.Background(), "carddav", stream)
+			return
+		}
+
+		for _, value := range bookImporters {
+			p, _, _ := strings.Cut(value, "=")
+			cfg.AddressBooks = append(cfg.AddressBooks, p)
+		}
+
+		carddavCli, err := carddav.NewClient(context.Background(), &cfg)
 		if err != nil {
 			logrus.Fatal(err.Error())
 		}
 
-		if err := carddav.FindAddressBook(context.Background(), carddavCli, &cfg); err != nil {
+		found, err := carddav.FindAddressBooks(context.Background(), carddavCli, &cfg)
+		if err != nil {
 			logrus.Fatal(err.Error())
 		}
 
-		deleted, updated, _, err := carddavCli.Sync(context.Background(), cfg.AddressBook, "")
+		books, err := addressBooks(found, bookImporters, importerName, refPrefix)
 		if err != nil {
 			logrus.Fatal(err.Error())
 		}
 
-		if err := carddav.ProcessUpdates(context.Background(), manager, &cfg, deleted, updated); err != nil {
-			logrus.Fatal(err.Error())
+		var complete map[string]bool
+		if fullSync {
+			all, err := carddavCli.ListAddressBooks(context.Background())
+			if err != nil {
+				logrus.Fatalf("failed to enumerate address books: %s", err)
+			}
+
+			complete, err = completeImporters(books, all, bookImporters, importerName, refPrefix)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+		}
+
+		state := &carddav.SyncState{Tokens: make(map[string]string)}
+		if stateFile != "" {
+			state, err = carddav.LoadSyncState(stateFile)
+			if err != nil {
+				logrus.Fatalf("failed to load sync state: %s", err)
+			}
+		}
+
+		// books that share an importer are imported in the same session.
+		managers := make(map[string]*importer.Manager)
+		tokens := make(map[string]string)
+
+		for idx := range books {
+			book := &books[idx]
+
+			manager, ok := managers[book.Importer]
+			if !ok {
+				streamFn := newStream
+				if complete[book.Importer] {
+					streamFn = newSnapshotStream
+				} else if fullSync {
+					logrus.Warnf("not all address books of importer %q are synced, deleted cards are not removed", book.Importer)
+				}
+
+				manager, err = importer.NewManager(context.Background(), book.Importer, streamFn, importer.Options{})
+				if err != nil {
+					logrus.Fatal(err.Error())
+				}
+
+				managers[book.Importer] = manager
+			}
+
+			var token string
+			if !fullSync {
+				token = state.Tokens[book.Path]
+			}
+
+			logrus.Infof("syncing address book %s (%s) as importer %q", book.Name, book.Path, book.Importer)
+
+			deleted, updated, newToken, err := carddavCli.Sync(context.Background(), book.Path, token)
+			if err != nil {
+				logrus.Fatalf("failed to sync address book %s: %s", book.Path, err)
+			}
+
+			deletes, err := carddav.ProcessUpdates(context.Background(), manager, book, country, deleted, updated)
+			if err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			if deletes > 0 {
+				logrus.Warnf("address book %s: %d cards have been deleted, use --full-sync to remove them", book.Path, deletes)
+			}
+
+			tokens[book.Path] = newToken
+		}
+
+		failed := false
+		for _, manager := range managers {
+			if !finish(cmd, manager) {
+				failed = true
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+
+		// only remember the sync tokens once all changes have been stored.
+		if stateFile != "" && !dryRun {
+			for p, token := range tokens {
+				state.Tokens[p] = token
+			}
+
+			if err := state.Save(stateFile); err != nil {
+				logrus.Fatalf("failed to save sync state: %s", err)
+			}
 		}
 	}
 
 	f := cmd.Flags()
 	{
-		f.StringVar(&cfg.Server, "carddav-server", "", "")
-		f.StringVar(&cfg.User, "user", "", "")
-		f.StringVar(&cfg.Password, "password", "", "")
-		f.StringVar(&cfg.AddressBook, "address-book", "", "")
-		f.BoolVar(&cfg.AllowInsecure, "insecure", false, "")
+		f.StringVar(&cfg.Server, "carddav-server", "", "The URL of the CardDAV server")
+		f.StringVar(&cfg.User, "user", "", "The username for HTTP Basic authentication")
+		f.StringVar(&cfg.Password, "password", "", "The password for HTTP Basic authentication, defaults to $CARDDAV_PASSWORD")
+		f.StringVar(&cfg.PasswordFile, "password-file", "", "Read the password for HTTP Basic authentication from a file")
+		f.StringVar(&cfg.BearerToken, "token", "", "A bearer token used instead of HTTP Basic authentication, defaults to $CARDDAV_TOKEN")
+		f.StringVar(&cfg.BearerTokenFile, "token-file", "", "Read the bearer token from a file")
+		f.StringArrayVar(&bookImporters, "address-book", nil, "The path of an address book to sync, optionally followed by =IMPORTER to set the importer name instead of --importer suffixed with the address book. A single address book uses --importer as is and needs =IMPORTER to keep its records once more address books are synced. May be repeated, auto-detected if empty")
+		f.BoolVar(&cfg.AllAddressBooks, "all-address-books", false, "Sync all address books of the user")
+		f.BoolVar(&refPrefix, "ref-prefix", false, "Import all address books with --importer and prefix references with the address book name instead of using one importer per address book")
+		f.StringVar(&stateFile, "state-file", "", "A file to store the sync tokens of all address books so subsequent runs only import changes")
+		f.BoolVar(&fullSync, "full-sync", false, "Ignore stored sync tokens and remove customers whose cards have been deleted if all address books of the importer are synced")
+		f.StringVar(&country, "country", "AT", "The default country used to parse phone numbers")
+		f.BoolVar(&cfg.AllowInsecure, "insecure", false, "Skip verification of the server certificate")
+		f.StringVar(&cfg.CAFile, "ca-file", "", "A PEM encoded CA bundle used to verify the server certificate")
+		f.StringVar(&cfg.ClientCert, "client-cert", "", "A PEM encoded client certificate for TLS client authentication")
+		f.StringVar(&cfg.ClientKey, "client-key", "", "The PEM encoded key of the client certificate")
+		f.DurationVar(&cfg.Timeout, "timeout", time.Minute, "The timeout for a single request to the CardDAV server, 0 disables the timeout")
+		f.BoolVar(&dryRun, "dry-run", false, "Report what would change without storing anything")
+		f.StringVar(&file, "file", "", "Import the cards of a .vcf file, or - for stdin, instead of syncing with a CardDAV server")
+		f.StringVar(&importerName, "importer", "carddav", "The name of the importer that owns the imported records")
 	}
 
 	return cmd
 }
+
+// finish completes the import session and prints the summary and the
+// changes of a dry-run. It reports whether all customers have been
+// imported successfully.
+func finish(root *cli.Root, manager *importer.Manager) bool {
+	summary, err := manager.Stop()
+	if err != nil {
+		logrus.Errorf("failed to complete import session %s: %s", manager.SessionID(), err)
+
+		return false
+	}
+
+	if summary != nil {
+		summary.Print(os.Stdout)
+
+		if summary.DryRun && summary.RunID != "" {
+			if err := importer.PrintRunDiffs(context.Background(), os.Stdout, root.HttpClient, root.Config().BaseURLS.CustomerService, summary.RunID); err != nil {
+				logrus.Warnf("failed to load the dry-run changes: %s, use \"customercli imports show --changes %s\" to see them", err, summary.RunID)
+			}
+		}
+
+		if summary.Failed > 0 || summary.SnapshotAborted {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addressBooks returns the import settings for the given address books.
+// Importer names can be set per address book using PATH=IMPORTER in
+// bookImporters. Otherwise the importer name is importerName suffixed with
+// the address book, or importerName with a reference prefix if refPrefix
+// is set. The suffix and prefix are derived from the last path element of
+// the address book since display names may change. A single address book
+// keeps importerName, as all runs did before multiple address books were
+// supported. Once more address books are synced it must be pinned with
+// PATH=IMPORTER to keep its records.
+func addressBooks(found []webdavcarddav.AddressBook, bookImporters []string, importerName string, refPrefix bool) ([]carddav.AddressBook, error) {
+	explicit := make(map[string]string)
+	for _, value := range bookImporters {
+		if p, name, ok := strings.Cut(value, "="); ok {
+			explicit[p] = name
+		}
+	}
+
+	var (
+		books = make([]carddav.AddressBook, 0, len(found))
+		seen  = make(map[string]string)
+	)
+
+	for _, b := range found {
+		base := path.Base(strings.TrimSuffix(b.Path, "/"))
+
+		name := b.Name
+		if name == "" {
+			name = base
+		}
+
+		book := carddav.AddressBook{
+			Path:     b.Path,
+			Name:     name,
+			Importer: importerName,
+		}
+
+		switch {
+		case explicit[b.Path] != "":
+			book.Importer = explicit[b.Path]
+
+		case refPrefix:
+			book.RefPrefix = slug(base) + "/"
+
+		case len(found) == 1:
+			// keep importerName
+
+		default:
+			book.Importer = importerName + "-" + slug(base)
+		}
+
+		// books that share an importer need distinct prefixes, otherwise
+		// cards with the same UID overwrite each other.
+		key := book.Importer + "\x00" + book.RefPrefix
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("address books %s and %s use the same importer %q, use distinct importer names or --ref-prefix", other, b.Path, book.Importer)
+		}
+		seen[key] = b.Path
+
+		books = append(books, book)
+	}
+
+	return books, nil
+}
+
+// completeImporters reports for each importer of books whether all address
+// books in all that use the importer are part of the run. Only those
+// importers may send a full snapshot since the states of the other address
+// books would be removed otherwise.
+func completeImporters(books []carddav.AddressBook, all []webdavcarddav.AddressBook, bookImporters []string, importerName string, refPrefix bool) (map[string]bool, error) {
+	included := make(map[string]bool, len(books))
+	complete := make(map[string]bool)
+
+	for _, b := range books {
+		included[strings.TrimSuffix(b.Path, "/")] = true
+		complete[b.Importer] = true
+	}
+
+	// address books that are not synced get the same importer they would
+	// get if they were part of the run.
+	var missing []webdavcarddav.AddressBook
+	for _, b := range all {
+		if !included[strings.TrimSuffix(b.Path, "/")] {
+			missing = append(missing, b)
+		}
+	}
+
+	others, err := addressBooks(missing, bookImporters, importerName, refPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range others {
+		if complete[b.Importer] {
+			complete[b.Importer] = false
+		}
+	}
+
+	// a book synced on its own keeps importerName and so does any other
+	// book synced on its own.
+	for _, b := range missing {
+		alone, err := addressBooks([]webdavcarddav.AddressBook{b}, bookImporters, importerName, refPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		if complete[alone[0].Importer] {
+			complete[alone[0].Importer] = false
+		}
+	}
+
+	return complete, nil
+}
+
+// slug returns a lower-case version of name that only contains letters,
+// digits and dashes.
+func slug(name string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteRune('-')
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "-")
+}
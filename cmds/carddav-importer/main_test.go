@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	webdavcarddav "github.com/emersion/go-webdav/carddav"
+	"github.com/stretchr/testify/require"
+	"github.com/tierklinik-dobersberg/customer-service/cmds/carddav-importer/carddav"
+)
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"Default":          "default",
+		"  Kunden Wien  ":  "kunden-wien",
+		"Praxis / Privat":  "praxis-privat",
+		"Ärzte_2024":       "ärzte-2024",
+		"--contacts--":     "contacts",
+		"":                 "",
+		"!!!":              "",
+		"a  b":             "a-b",
+		"Tierärzte (alt)!": "tierärzte-alt",
+	}
+
+	for name, expected := range cases {
+		require.Equal(t, expected, slug(name), name)
+	}
+}
+
+func TestAddressBooks(t *testing.T) {
+	work := webdavcarddav.AddressBook{Path: "/dav/jane/work/", Name: "Work Contacts"}
+	private := webdavcarddav.AddressBook{Path: "/dav/jane/private/", Name: "Private"}
+	unnamed := webdavcarddav.AddressBook{Path: "/dav/jane/default/"}
+
+	cases := []struct {
+		name          string
+		found         []webdavcarddav.AddressBook
+		bookImporters []string
+		refPrefix     bool
+		expected      []carddav.AddressBook
+		err           bool
+	}{
+		{
+			name:  "single book keeps the importer",
+			found: []webdavcarddav.AddressBook{work},
+			expected: []carddav.AddressBook{
+				{Path: work.Path, Name: "Work Contacts", Importer: "carddav"},
+			},
+		},
+		{
+			name:          "single book with explicit importer",
+			found:         []webdavcarddav.AddressBook{work},
+			bookImporters: []string{work.Path + "=contacts"},
+			expected: []carddav.AddressBook{
+				{Path: work.Path, Name: "Work Contacts", Importer: "contacts"},
+			},
+		},
+		{
+			name:  "multiple books are suffixed",
+			found: []webdavcarddav.AddressBook{work, unnamed},
+			expected: []carddav.AddressBook{
+				{Path: work.Path, Name: "Work Contacts", Importer: "carddav-work"},
+				{Path: unnamed.Path, Name: "default", Importer: "carddav-default"},
+			},
+		},
+		{
+			name:      "reference prefix",
+			found:     []webdavcarddav.AddressBook{work, private},
+			refPrefix: true,
+			expected: []carddav.AddressBook{
+				{Path: work.Path, Name: "Work Contacts", Importer: "carddav", RefPrefix: "work/"},
+				{Path: private.Path, Name: "Private", Importer: "carddav", RefPrefix: "private/"},
+			},
+		},
+		{
+			name:          "explicit importer",
+			found:         []webdavcarddav.AddressBook{work, private},
+			bookImporters: []string{work.Path + "=carddav", private.Path},
+			expected: []carddav.AddressBook{
+				{Path: work.Path, Name: "Work Contacts", Importer: "carddav"},
+				{Path: private.Path, Name: "Private", Importer: "carddav-private"},
+			},
+		},
+		{
+			name:          "shared explicit importer",
+			found:         []webdavcarddav.AddressBook{work, private},
+			bookImporters: []string{work.Path + "=contacts", private.Path + "=contacts"},
+			err:           true,
+		},
+		{
+			name:  "same suffix",
+			found: []webdavcarddav.AddressBook{work, {Path: "/dav/john/work/"}},
+			err:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			books, err := addressBooks(c.found, c.bookImporters, "carddav", c.refPrefix)
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, c.expected, books)
+		})
+	}
+}
+
+func TestCompleteImporters(t *testing.T) {
+	work := webdavcarddav.AddressBook{Path: "/dav/jane/work/", Name: "Work"}
+	private := webdavcarddav.AddressBook{Path: "/dav/jane/private/", Name: "Private"}
+	all := []webdavcarddav.AddressBook{work, private}
+
+	complete := func(found []webdavcarddav.AddressBook, bookImporters []string, refPrefix bool) map[string]bool {
+		books, err := addressBooks(found, bookImporters, "carddav", refPrefix)
+		require.NoError(t, err)
+
+		result, err := completeImporters(books, all, bookImporters, "carddav", refPrefix)
+		require.NoError(t, err)
+
+		return result
+	}
+
+	// every book has its own importer
+	require.Equal(t, map[string]bool{"carddav-work": true, "carddav-private": true}, complete(all, nil, false))
+	require.Equal(t, map[string]bool{"carddav-work": true}, complete([]webdavcarddav.AddressBook{work}, []string{work.Path + "=carddav-work"}, false))
+
+	// a single book keeps the importer the private address book gets when
+	// synced on its own
+	require.Equal(t, map[string]bool{"carddav": false}, complete([]webdavcarddav.AddressBook{work}, nil, false))
+
+	// the importer is shared with the private address book
+	require.Equal(t, map[string]bool{"carddav": false}, complete([]webdavcarddav.AddressBook{work}, nil, true))
+	require.Equal(t, map[string]bool{"carddav": true}, complete(all, nil, true))
+
+	// paths may be given without the trailing slash
+	require.Equal(t, map[string]bool{"carddav": true}, complete([]webdavcarddav.AddressBook{
+		{Path: "/dav/jane/work"},
+		{Path: "/dav/jane/private"},
+	}, nil, true))
+
+	// explicit importers only cover the books of the run
+	require.Equal(t, map[string]bool{"contacts": true}, complete([]webdavcarddav.AddressBook{work}, []string{work.Path + "=contacts"}, false))
+}
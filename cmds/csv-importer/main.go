@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+func main() {
+	if err := getRootCmd().Execute(); err != nil {
+		logrus.Fatalf(err.Error())
+	}
+}
+
+// openInput opens path, or stdin if path is empty or "-", and decodes it
+// using the given character encoding.
+func openInput(path, encoding string) (io.Reader, error) {
+	var input io.Reader = os.Stdin
+
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		input = f
+	}
+
+	enc, err := ianaindex.IANA.Encoding(encoding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding %q: %w", encoding, err)
+	}
+
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
+
+func parseDelimiter(value string) (rune, error) {
+	switch value {
+	case "tab", `\t`:
+		return '\t', nil
+	}
+
+	runes := []rune(value)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("delimiter must be a single character")
+	}
+
+	return runes[0], nil
+}
+
+func getRootCmd() *cli.Root {
+	var (
+		importerName string
+		mappingFile  string
+		delimiter    string
+		encoding     string
+		noHeader     bool
+		country      string
+		phonePrefix  string
+		dryRun       bool
+		fullSnapshot bool
+		maxRemove    float64
+		resume       string
+	)
+
+	cmd := cli.New("csv-importer [path/to/file.csv]")
+	cmd.Long = `Imports customers from a CSV file or from stdin.
+
+The mapping file is a JSON object that maps column headers, or 1-based
+column numbers when using --no-header, to customer attributes:
+
+  {
+    "Kundennummer": "ref",
+    "Vorname": "firstName",
+    "Nachname": "lastName",
+    "Telefon": "phone",
+    "Mobil": "phone",
+    "E-Mail": "email",
+    "Straße": "street",
+    "PLZ": "postalCode",
+    "Ort": "city"
+  }
+
+Supported attributes are ref (required), firstName, lastName, phone, email,
+street, postalCode, city and extra. Phone and email may be mapped from
+multiple columns.`
+
+	cmd.Args = cobra.MaximumNArgs(1)
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		mapping, err := LoadMapping(mappingFile)
+		if err != nil {
+			logrus.Fatalf("failed to load mapping: %s", err)
+		}
+
+		comma, err := parseDelimiter(delimiter)
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+
+		var path string
+		if len(args) == 1 {
+			path = args[0]
+		}
+
+		input, err := openInput(path, encoding)
+		if err != nil {
+			logrus.Fatalf("failed to open input: %s", err)
+		}
+
+		reader := csv.NewReader(input)
+		reader.Comma = comma
+		reader.FieldsPerRecord = -1
+
+		first, err := reader.Read()
+		if err != nil {
+			logrus.Fatalf("failed to read first row: %s", err)
+		}
+
+		var header []string
+		if !noHeader {
+			header = first
+
+			// Excel prefixes UTF-8 exports with a byte order mark.
+			header[0] = strings.TrimPrefix(header[0], "\ufeff")
+		}
+
+		converter, err := NewConverter(mapping, header, len(first))
+		if err != nil {
+			logrus.Fatalf("invalid mapping: %s", err)
+		}
+
+		converter.Country = country
+		converter.PhonePrefix = phonePrefix
+
+		customerCli := cmd.CustomerImport()
+
+		opts := importer.StreamOptions{
+			DryRun:    dryRun,
+			Snapshot:  fullSnapshot,
+			MaxRemove: maxRemove,
+			Resume:    resume,
+		}
+
+		newStream := func(ctx context.Context) importer.ImportStream {
+			return opts.Apply(customerCli.ImportSession(ctx))
+		}
+
+		manager, err := importer.NewManager(context.Background(), importerName, newStream, importer.Options{})
+		if err != nil {
+			logrus.Fatalf("failed to create import manager: %s", err)
+		}
+
+		logrus.Infof("started import session %s", manager.SessionID())
+
+		var invalid int
+
+		collector := &importer.Collector{
+			OnError: func(ref string, err error) {
+				logrus.Errorf("failed to upsert customer %s: %s", ref, err)
+			},
+		}
+
+		row := first
+		if header != nil {
+			row, err = reader.Read()
+		}
+
+		for ; err == nil && collector.Err() == nil; row, err = reader.Read() {
+			line, _ := reader.FieldPos(0)
+
+			ref, customer, extra, invalidPhones := converter.Convert(row)
+			if ref == "" {
+				logrus.Errorf("line %d: missing ref", line)
+				invalid++
+
+				continue
+			}
+
+			for _, phone := range invalidPhones {
+				logrus.Warnf("line %d: customer %s has an invalid phone number %q", line, ref, phone)
+			}
+
+			collector.Add(ref, manager.UpsertAsync(ref, customer, extra))
+		}
+
+		if err := collector.Wait(); err != nil {
+			logrus.Fatalf("import session failed: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		// never complete a snapshot session with partial input since that
+		// would remove all records that have not been read.
+		if !errors.Is(err, io.EOF) {
+			logrus.Fatalf("failed to read input: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		if fullSnapshot && invalid > 0 {
+			logrus.Fatalf("refusing to complete the full snapshot since %d invalid rows have been skipped", invalid)
+		}
+
+		summary, err := manager.Stop()
+		if err != nil {
+			logrus.Fatalf("failed to complete import session: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		if summary != nil {
+			summary.Print(os.Stdout)
+
+			if summary.DryRun && summary.RunID != "" {
+				if err := importer.PrintRunDiffs(context.Background(), os.Stdout, cmd.HttpClient, cmd.Config().BaseURLS.CustomerService, summary.RunID); err != nil {
+					logrus.Warnf("failed to load the dry-run changes: %s, use \"customercli imports show --changes %s\" to see them", err, summary.RunID)
+				}
+			}
+		}
+
+		if invalid > 0 {
+			logrus.Errorf("%d invalid rows have been skipped", invalid)
+		}
+
+		if invalid > 0 || (summary != nil && (summary.Failed > 0 || summary.SnapshotAborted)) {
+			os.Exit(1)
+		}
+	}
+
+	f := cmd.Flags()
+	{
+		f.StringVar(&importerName, "importer", "", "The name of the importer that owns the imported records")
+		f.StringVar(&mappingFile, "mapping", "", "Path to the JSON column mapping file")
+		f.StringVar(&delimiter, "delimiter", ",", "The field delimiter, use \"tab\" for tab separated files")
+		f.StringVar(&encoding, "encoding", "UTF-8", "The character encoding of the input, for example windows-1252 or ISO-8859-1")
+		f.BoolVar(&noHeader, "no-header", false, "The input has no header row, columns are mapped by their 1-based number")
+		f.StringVar(&country, "country", "AT", "The default country used to parse phone numbers")
+		f.StringVar(&phonePrefix, "phone-prefix", "", "The prefix for phone numbers that neither start with + nor 0")
+		f.BoolVar(&dryRun, "dry-run", false, "Report what would change without storing anything")
+		f.BoolVar(&fullSnapshot, "full-snapshot", false, "Remove customers that are not part of the input anymore")
+		f.Float64Var(&maxRemove, "max-remove", 0, "The maximum fraction of customers that may be removed in full-snapshot mode (defaults to the server setting)")
+		f.StringVar(&resume, "resume", "", "The id of an interrupted import session to resume")
+	}
+
+	cmd.MarkFlagRequired("importer")
+	cmd.MarkFlagRequired("mapping")
+
+	return cmd
+}
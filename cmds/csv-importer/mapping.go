@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+// Supported mapping targets. Phone and e-mail may be used for multiple
+// columns.
+const (
+	TargetRef        = "ref"
+	TargetFirstName  = "firstName"
+	TargetLastName   = "lastName"
+	TargetPhone      = "phone"
+	TargetEmail      = "email"
+	TargetStreet     = "street"
+	TargetPostalCode = "postalCode"
+	TargetCity       = "city"
+
+	// TargetExtra stores the column value in the extra data of the upsert
+	// using the column name as the key.
+	TargetExtra = "extra"
+)
+
+var validTargets = map[string]struct{}{
+	TargetRef:        {},
+	TargetFirstName:  {},
+	TargetLastName:   {},
+	TargetPhone:      {},
+	TargetEmail:      {},
+	TargetStreet:     {},
+	TargetPostalCode: {},
+	TargetCity:       {},
+	TargetExtra:      {},
+}
+
+// Mapping maps CSV columns, identified by their header or by their 1-based
+// index if the file has no header row, to customer attributes.
+type Mapping map[string]string
+
+// LoadMapping reads a JSON encoded mapping file.
+func LoadMapping(path string) (Mapping, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Mapping
+	if err := json.Unmarshal(blob, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode mapping: %w", err)
+	}
+
+	var hasRef bool
+	for column, target := range m {
+		if _, ok := validTargets[target]; !ok {
+			return nil, fmt.Errorf("column %q: unsupported target %q", column, target)
+		}
+
+		if target == TargetRef {
+			if hasRef {
+				return nil, fmt.Errorf("ref must only be mapped once")
+			}
+
+			hasRef = true
+		}
+	}
+
+	if !hasRef {
+		return nil, fmt.Errorf("no column is mapped to ref")
+	}
+
+	return m, nil
+}
+
+// Converter converts CSV rows to customers.
+type Converter struct {
+	// names and targets hold the name and the mapping target of each
+	// column. Unmapped columns have an empty target.
+	names   []string
+	targets []string
+
+	Country     string
+	PhonePrefix string
+}
+
+// NewConverter returns a converter for the given header row. If header is
+// nil columns are identified by their index.
+func NewConverter(m Mapping, header []string, columns int) (*Converter, error) {
+	c := &Converter{
+		names:   make([]string, columns),
+		targets: make([]string, columns),
+	}
+
+	found := make(map[string]struct{}, len(m))
+
+	for idx := range c.targets {
+		key := strconv.Itoa(idx + 1)
+		if header != nil {
+			key = strings.TrimSpace(header[idx])
+		}
+
+		c.names[idx] = key
+
+		if target, ok := m[key]; ok {
+			c.targets[idx] = target
+			found[key] = struct{}{}
+		}
+	}
+
+	for column := range m {
+		if _, ok := found[column]; !ok {
+			return nil, fmt.Errorf("mapped column %q does not exist", column)
+		}
+	}
+
+	return c, nil
+}
+
+// Convert converts row to a customer. It returns the internal reference, the
+// customer, any extra data and all phone numbers that could not be parsed.
+func (c *Converter) Convert(row []string) (string, *customerv1.Customer, map[string]any, []string) {
+	var (
+		ref      string
+		customer = new(customerv1.Customer)
+		address  = new(customerv1.Address)
+		extra    map[string]any
+		invalid  []string
+	)
+
+	for idx, value := range row {
+		if idx >= len(c.targets) {
+			break
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		switch c.targets[idx] {
+		case TargetRef:
+			ref = value
+		case TargetFirstName:
+			customer.FirstName = value
+		case TargetLastName:
+			customer.LastName = value
+		case TargetPhone:
+			number, err := importer.NormalizePhoneNumber(value, c.Country, c.PhonePrefix)
+			if err != nil {
+				invalid = append(invalid, value)
+				continue
+			}
+
+			customer.PhoneNumbers = append(customer.PhoneNumbers, number)
+		case TargetEmail:
+			customer.EmailAddresses = append(customer.EmailAddresses, value)
+		case TargetStreet:
+			address.Street = value
+		case TargetPostalCode:
+			address.PostalCode = value
+		case TargetCity:
+			address.City = value
+		case TargetExtra:
+			if extra == nil {
+				extra = make(map[string]any)
+			}
+
+			extra[c.names[idx]] = value
+		}
+	}
+
+	if address.Street != "" || address.PostalCode != "" || address.City != "" {
+		customer.Addresses = append(customer.Addresses, address)
+	}
+
+	return ref, customer, extra, invalid
+}
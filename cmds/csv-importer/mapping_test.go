@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func writeMapping(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestLoadMapping(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name:    "valid",
+			content: `{"Nr": "ref", "Name": "lastName", "Tel": "phone"}`,
+		},
+		{
+			name:    "invalid json",
+			content: `{"Nr": `,
+			err:     "failed to decode mapping",
+		},
+		{
+			name:    "unsupported target",
+			content: `{"Nr": "ref", "Name": "surname"}`,
+			err:     `column "Name": unsupported target "surname"`,
+		},
+		{
+			name:    "missing ref",
+			content: `{"Name": "lastName"}`,
+			err:     "no column is mapped to ref",
+		},
+		{
+			name:    "duplicate ref",
+			content: `{"Nr": "ref", "Id": "ref"}`,
+			err:     "ref must only be mapped once",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := LoadMapping(writeMapping(t, c.content))
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, Mapping{"Nr": TargetRef, "Name": TargetLastName, "Tel": TargetPhone}, m)
+		})
+	}
+
+	_, err := LoadMapping(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
+
+func TestNewConverter(t *testing.T) {
+	m := Mapping{"Nr": TargetRef, "Name": TargetLastName}
+
+	c, err := NewConverter(m, []string{" Nr ", "Name", "Notes"}, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Nr", "Name", "Notes"}, c.names)
+	require.Equal(t, []string{TargetRef, TargetLastName, ""}, c.targets)
+
+	// without a header columns are identified by their index
+	c, err = NewConverter(Mapping{"1": TargetRef, "3": TargetExtra}, nil, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, c.names)
+	require.Equal(t, []string{TargetRef, "", TargetExtra}, c.targets)
+
+	_, err = NewConverter(m, []string{"Nr"}, 1)
+	require.ErrorContains(t, err, `mapped column "Name" does not exist`)
+}
+
+func TestConvert(t *testing.T) {
+	m := Mapping{
+		"Nr":     TargetRef,
+		"First":  TargetFirstName,
+		"Last":   TargetLastName,
+		"Tel":    TargetPhone,
+		"Mobile": TargetPhone,
+		"Mail":   TargetEmail,
+		"Street": TargetStreet,
+		"Zip":    TargetPostalCode,
+		"City":   TargetCity,
+		"Notes":  TargetExtra,
+	}
+
+	header := []string{"Nr", "First", "Last", "Tel", "Mobile", "Mail", "Street", "Zip", "City", "Notes", "Ignored"}
+
+	c, err := NewConverter(m, header, len(header))
+	require.NoError(t, err)
+	c.Country = "AT"
+
+	cases := []struct {
+		name     string
+		row      []string
+		ref      string
+		customer *customerv1.Customer
+		extra    map[string]any
+		invalid  []string
+	}{
+		{
+			name: "all columns",
+			row:  []string{" 10 ", "Jane", "Doe", "01 234567", "0664 1234567", "jane@example.com", "Hauptstraße 1", "1010", "Wien", "vip", "x"},
+			ref:  "10",
+			customer: &customerv1.Customer{
+				FirstName:      "Jane",
+				LastName:       "Doe",
+				PhoneNumbers:   []string{"+43 1 234567", "+43 664 1234567"},
+				EmailAddresses: []string{"jane@example.com"},
+				Addresses: []*customerv1.Address{
+					{Street: "Hauptstraße 1", PostalCode: "1010", City: "Wien"},
+				},
+			},
+			extra: map[string]any{"Notes": "vip"},
+		},
+		{
+			name:     "empty values and short rows",
+			row:      []string{"11", "", "Doe"},
+			ref:      "11",
+			customer: &customerv1.Customer{LastName: "Doe"},
+		},
+		{
+			name:     "invalid phone number",
+			row:      []string{"12", "", "Doe", "abc"},
+			ref:      "12",
+			customer: &customerv1.Customer{LastName: "Doe"},
+			invalid:  []string{"abc"},
+		},
+		{
+			name:     "missing ref",
+			row:      []string{"", "Jane"},
+			customer: &customerv1.Customer{FirstName: "Jane"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, customer, extra, invalid := c.Convert(tc.row)
+
+			require.Equal(t, tc.ref, ref)
+			require.True(t, proto.Equal(tc.customer, customer), "got %v", customer)
+			require.Equal(t, tc.extra, extra)
+			require.Equal(t, tc.invalid, invalid)
+		})
+	}
+}
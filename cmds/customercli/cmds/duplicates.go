@@ -0,0 +1,62 @@
+package cmds
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/customerservice"
+)
+
+func GetDuplicatesCommand(root *cli.Root) *cobra.Command {
+	var state string
+
+	cmd := &cobra.Command{
+		Use:     "duplicates",
+		Aliases: []string{"dups"},
+		Short:   "Review likely duplicate customers",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var res customerservice.ListDuplicatesResponse
+
+			if err := doJSON(root, http.MethodGet, "/duplicates?state="+url.QueryEscape(state), nil, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	cmd.Flags().StringVar(&state, "state", string(repo.DuplicatePending), "Only list candidates with the given state (pending, accepted or rejected)")
+
+	cmd.AddCommand(
+		getDuplicateDecisionCommand(root, "accept", "Merge the second customer of a candidate into the first one", "/duplicates/accept"),
+		getDuplicateDecisionCommand(root, "reject", "Reject a candidate so it is never suggested again", "/duplicates/reject"),
+	)
+
+	return cmd
+}
+
+func getDuplicateDecisionCommand(root *cli.Root, use, short, path string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " id [id...]",
+		Short: short,
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, id := range args {
+				var res repo.DuplicateCandidate
+
+				if err := doJSON(root, http.MethodPost, path, customerservice.DuplicateDecisionRequest{
+					ID: id,
+				}, &res); err != nil {
+					logrus.Fatal(err.Error())
+				}
+
+				root.Print(res)
+			}
+		},
+	}
+}
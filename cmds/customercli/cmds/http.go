@@ -0,0 +1,60 @@
+package cmds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+)
+
+// doJSON performs a JSON request against one of the plain HTTP endpoints
+// of customerd and decodes the response into result.
+func doJSON(root *cli.Root, method, path string, body any, result any) error {
+	var reader io.Reader
+
+	if body != nil {
+		blob, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+
+		reader = bytes.NewReader(blob)
+	}
+
+	url := strings.TrimSuffix(root.Config().BaseURLS.CustomerService, "/") + path
+
+	req, err := http.NewRequestWithContext(root.Context(), method, url, reader)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := root.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
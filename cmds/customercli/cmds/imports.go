@@ -0,0 +1,134 @@
+package cmds
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/importservice"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+func GetImportsCommand(root *cli.Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "imports",
+		Short: "Manage customer import sessions",
+	}
+
+	cmd.AddCommand(
+		getImportReviewCommand(root),
+		getImportRunsCommand(root),
+		getImportRunCommand(root),
+	)
+
+	return cmd
+}
+
+func getImportReviewCommand(root *cli.Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "review",
+		Short: "List imported customers that matched multiple existing customers",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var res importservice.ListPendingUpsertsResponse
+
+			if err := doJSON(root, http.MethodGet, "/imports/review", nil, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	resolveCmd := &cobra.Command{
+		Use:   "resolve id [customer-id]",
+		Short: "Apply a pending import to the given customer or create a new one",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			req := importservice.ResolvePendingUpsertRequest{
+				ID: args[0],
+			}
+
+			if len(args) == 2 {
+				req.CustomerID = args[1]
+			}
+
+			var res importservice.ResolvePendingUpsertResponse
+			if err := doJSON(root, http.MethodPost, "/imports/review/resolve", req, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	cmd.AddCommand(resolveCmd)
+
+	return cmd
+}
+
+func getImportRunsCommand(root *cli.Root) *cobra.Command {
+	var (
+		importer string
+		limit    int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List past import runs, newest first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			query := url.Values{}
+			query.Set("limit", fmt.Sprint(limit))
+
+			if importer != "" {
+				query.Set("importer", importer)
+			}
+
+			var res importservice.ListImportRunsResponse
+			if err := doJSON(root, http.MethodGet, "/imports/runs?"+query.Encode(), nil, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	cmd.Flags().StringVar(&importer, "importer", "", "Only list runs of the given importer")
+	cmd.Flags().IntVar(&limit, "limit", 20, "The maximum number of runs to list (0 lists all)")
+
+	return cmd
+}
+
+func getImportRunCommand(root *cli.Root) *cobra.Command {
+	var changes bool
+
+	cmd := &cobra.Command{
+		Use:   "show id",
+		Short: "Show a single import run including error messages and dry-run changes",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var res repo.ImportRun
+
+			if err := doJSON(root, http.MethodGet, "/imports/runs/show?id="+url.QueryEscape(args[0]), nil, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			if changes {
+				importer.PrintDiffs(os.Stdout, res.Diffs, res.DiffsTruncated)
+				return
+			}
+
+			root.Print(res)
+		},
+	}
+
+	cmd.Flags().BoolVar(&changes, "changes", false, "Only print the changes of a dry-run in a human readable format")
+
+	return cmd
+}
@@ -0,0 +1,67 @@
+package cmds
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/customerservice"
+)
+
+func GetLocksCommand(root *cli.Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "locks",
+		Short: "List customer locks",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var res customerservice.ListLocksResponse
+
+			if err := doJSON(root, http.MethodGet, "/locks", nil, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	var stale bool
+
+	breakCmd := &cobra.Command{
+		Use:   "break [customer-id...]",
+		Short: "Forcefully release customer locks",
+		Run: func(cmd *cobra.Command, args []string) {
+			ids := args
+
+			if stale {
+				var res customerservice.ListLocksResponse
+
+				if err := doJSON(root, http.MethodGet, "/locks", nil, &res); err != nil {
+					logrus.Fatal(err.Error())
+				}
+
+				for _, l := range res.Locks {
+					if l.Stale {
+						ids = append(ids, l.CustomerID)
+					}
+				}
+			}
+
+			for _, id := range ids {
+				if err := doJSON(root, http.MethodPost, "/locks/break", customerservice.BreakLockRequest{
+					CustomerID: id,
+				}, nil); err != nil {
+					logrus.Fatal(err.Error())
+				}
+
+				logrus.Infof("released lock for customer %s", id)
+			}
+		},
+	}
+
+	breakCmd.Flags().BoolVar(&stale, "stale", false, "Release all expired locks")
+
+	cmd.AddCommand(breakCmd)
+
+	return cmd
+}
@@ -0,0 +1,33 @@
+package cmds
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/customerservice"
+)
+
+func GetSplitCustomerCommand(root *cli.Root) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "split customer-id importer ref",
+		Short: "Detach an import state from a customer into a new customer record",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			var res customerservice.SplitCustomerResponse
+
+			if err := doJSON(root, http.MethodPost, "/customers/split", customerservice.SplitCustomerRequest{
+				CustomerID: args[0],
+				Importer:   args[1],
+				Ref:        args[2],
+			}, &res); err != nil {
+				logrus.Fatal(err.Error())
+			}
+
+			root.Print(res)
+		},
+	}
+
+	return cmd
+}
@@ -12,6 +12,10 @@ func main() {
 	cmd.AddCommand(
 		cmds.GetSearchCommand(cmd),
 		cmds.GetUpdateCustomerCommand(cmd),
+		cmds.GetSplitCustomerCommand(cmd),
+		cmds.GetDuplicatesCommand(cmd),
+		cmds.GetImportsCommand(cmd),
+		cmds.GetLocksCommand(cmd),
 	)
 
 	if err := cmd.Execute(); err != nil {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	idmv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/idm/v1/idmv1connect"
+)
+
+// adminRoles mirrors the admin_roles of the customer service definitions.
+var adminRoles = []string{"idm_superuser", "customer_manager"}
+
+// newAdminMiddleware returns a middleware for plain HTTP handlers that are not
+// covered by the auth annotation interceptor. Requests to the admin server
+// are always permitted, all other requests must carry at least one of the
+// adminRoles in the X-Remote-Role headers.
+func newAdminMiddleware(cli idmv1connect.RoleServiceClient) func(http.Handler) http.Handler {
+	var roleNames sync.Map
+
+	resolve := func(r *http.Request, id string) string {
+		if name, ok := roleNames.Load(id); ok {
+			return name.(string)
+		}
+
+		res, err := cli.GetRole(r.Context(), connect.NewRequest(&idmv1.GetRoleRequest{
+			Search: &idmv1.GetRoleRequest_Id{
+				Id: id,
+			},
+		}))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to resolve role", slog.Any("id", id), slog.Any("error", err.Error()))
+			return ""
+		}
+
+		roleNames.Store(id, res.Msg.Role.Name)
+
+		return res.Msg.Role.Name
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serverKey, _ := r.Context().Value(serverContextKey).(string); serverKey == "admin" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, id := range r.Header.Values("X-Remote-Role") {
+				if slices.Contains(adminRoles, resolve(r, id)) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			http.Error(w, "permission denied", http.StatusForbidden)
+		})
+	}
+}
+
+// newUserMiddleware returns a middleware for plain HTTP handlers that are
+// available to all authenticated users. Requests to the admin server are
+// always permitted, all other requests must have been authenticated by IDM
+// which sets the X-Remote-User-ID header.
+func newUserMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serverKey, _ := r.Context().Value(serverContextKey).(string); serverKey == "admin" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("X-Remote-User-ID") == "" {
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
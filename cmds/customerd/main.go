@@ -16,12 +16,15 @@ import (
 	"github.com/tierklinik-dobersberg/apis/pkg/log"
 	"github.com/tierklinik-dobersberg/apis/pkg/server"
 	"github.com/tierklinik-dobersberg/apis/pkg/validator"
+	"github.com/tierklinik-dobersberg/customer-service/internal/addressbook"
 	"github.com/tierklinik-dobersberg/customer-service/internal/config"
+	"github.com/tierklinik-dobersberg/customer-service/internal/duplicates"
 	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
 	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
 	"github.com/tierklinik-dobersberg/customer-service/internal/repo/mongo"
 	"github.com/tierklinik-dobersberg/customer-service/internal/services/customerservice"
 	"github.com/tierklinik-dobersberg/customer-service/internal/services/importservice"
+	"github.com/tierklinik-dobersberg/customer-service/internal/session"
 	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
@@ -82,8 +85,13 @@ func main() {
 
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
+	requireAdmin := func(next http.Handler) http.Handler { return next }
+	requireUser := func(next http.Handler) http.Handler { return next }
+
 	if os.Getenv("DEBUG") == "" {
 		interceptors = append(interceptors, authInterceptor)
+		requireAdmin = newAdminMiddleware(roleServiceClient)
+		requireUser = newUserMiddleware()
 	}
 
 	corsConfig := cors.Config{
@@ -98,7 +106,10 @@ func main() {
 
 	if cfg.MongoDBURL != "" {
 		var err error
-		backend, err = mongo.New(ctx, cfg.MongoDBURL, cfg.MongoDatabaseName)
+		backend, err = mongo.New(ctx, cfg.MongoDBURL, cfg.MongoDatabaseName, repo.LockOptions{
+			TTL:         cfg.LockTTL,
+			WaitTimeout: cfg.LockWaitTimeout,
+		})
 
 		if err != nil {
 			logrus.Fatalf("failed to create repository: %s", err)
@@ -117,8 +128,19 @@ func main() {
 		"carddav": 0,
 	}
 
+	strategy, err := session.ParseMatchStrategy(cfg.ImportMatchStrategy)
+	if err != nil {
+		logrus.Fatalf("invalid import match strategy: %s", err)
+	}
+
 	// create a new CallService and add it to the mux.
-	importService := importservice.NewImportService(store, resolver)
+	importService := importservice.NewImportService(store, resolver, session.Options{
+		Strategy:          strategy,
+		Workers:           cfg.ImportSessionWorkers,
+		Limiter:           session.NewLimiter(cfg.ImportMaxConcurrency),
+		Batcher:           session.NewWriteBatcher(store, cfg.ImportBatchSize, cfg.ImportBatchLatency),
+		SnapshotMaxRemove: cfg.ImportSnapshotMaxRemove,
+	})
 	customerService := customerservice.New(store, resolver)
 
 	path, handler := customerv1connect.NewCustomerImportServiceHandler(importService, connect.WithInterceptors(interceptors...))
@@ -128,6 +150,31 @@ func main() {
 	serveMux.Handle(path, handler)
 
 	serveMux.Handle("/crm/lookup", http.HandlerFunc(customerService.CRMLookupHandler))
+	serveMux.Handle("/customers/split", requireAdmin(http.HandlerFunc(customerService.SplitCustomerHandler)))
+	serveMux.Handle("/duplicates", requireAdmin(http.HandlerFunc(customerService.ListDuplicatesHandler)))
+	serveMux.Handle("/duplicates/accept", requireAdmin(http.HandlerFunc(customerService.AcceptDuplicateHandler)))
+	serveMux.Handle("/duplicates/reject", requireAdmin(http.HandlerFunc(customerService.RejectDuplicateHandler)))
+	serveMux.Handle("/imports/review", requireAdmin(http.HandlerFunc(importService.ListPendingUpsertsHandler)))
+	serveMux.Handle("/imports/review/resolve", requireAdmin(http.HandlerFunc(importService.ResolvePendingUpsertHandler)))
+	serveMux.Handle("/imports/runs", requireAdmin(http.HandlerFunc(importService.ListImportRunsHandler)))
+	serveMux.Handle("/imports/runs/show", requireAdmin(http.HandlerFunc(importService.GetImportRunHandler)))
+	serveMux.Handle("/imports/states/remove", requireAdmin(http.HandlerFunc(importService.RemoveImportStateHandler)))
+	serveMux.Handle("/locks", requireAdmin(http.HandlerFunc(customerService.ListLocksHandler)))
+	serveMux.Handle("/locks/break", requireAdmin(http.HandlerFunc(customerService.BreakLockHandler)))
+
+	// read-only CardDAV address book of all customers
+	addressBook := requireUser(addressbook.NewHandler(store, "/carddav"))
+	serveMux.Handle("/carddav/", addressBook)
+	serveMux.Handle("/.well-known/carddav", addressBook)
+
+	if cfg.DuplicateScanInterval > 0 {
+		job := duplicates.NewJob(store, &duplicates.Detector{
+			MinScore: cfg.DuplicateMinScore,
+			Region:   "AT",
+		}, cfg.DuplicateScanInterval)
+
+		go job.Run(ctx)
+	}
 
 	loggingHandler := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/tierklinik-dobersberg/apis/pkg/cli"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+// maxLineSize is the maximum size of a single JSON-lines record.
+const maxLineSize = 1024 * 1024
+
+func main() {
+	if err := getRootCmd().Execute(); err != nil {
+		logrus.Fatalf(err.Error())
+	}
+}
+
+func getRootCmd() *cli.Root {
+	var (
+		importerName string
+		dryRun       bool
+		fullSnapshot bool
+		maxRemove    float64
+		resume       string
+	)
+
+	cmd := cli.New("jsonl-importer [path/to/file.jsonl]")
+	cmd.Long = `Imports customers from a JSON-lines file or from stdin.
+
+Each line holds a single protojson encoded customer with the additional
+fields "ref" (required), "extra" and "deleted":
+
+  {"ref": "1234", "firstName": "Jane", "lastName": "Doe", "phoneNumbers": ["+43 1 234567"]}
+  {"ref": "5678", "deleted": true}
+
+The import states of records marked as deleted are removed once the import
+session has been completed, which requires admin permissions. Use
+--full-snapshot if the input contains all records so customers that are not
+part of the input anymore are removed as well.`
+
+	cmd.Args = cobra.MaximumNArgs(1)
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		var input io.Reader = os.Stdin
+
+		if len(args) == 1 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				logrus.Fatalf("failed to open input: %s", err)
+			}
+			defer f.Close()
+
+			input = f
+		}
+
+		customerCli := cmd.CustomerImport()
+
+		opts := importer.StreamOptions{
+			DryRun:    dryRun,
+			Snapshot:  fullSnapshot,
+			MaxRemove: maxRemove,
+			Resume:    resume,
+		}
+
+		newStream := func(ctx context.Context) importer.ImportStream {
+			return opts.Apply(customerCli.ImportSession(ctx))
+		}
+
+		manager, err := importer.NewManager(context.Background(), importerName, newStream, importer.Options{})
+		if err != nil {
+			logrus.Fatalf("failed to create import manager: %s", err)
+		}
+
+		logrus.Infof("started import session %s", manager.SessionID())
+
+		collector := &importer.Collector{
+			OnError: func(ref string, err error) {
+				logrus.Errorf("failed to upsert customer %s: %s", ref, err)
+			},
+		}
+
+		var (
+			invalid int
+			lineNo  int
+
+			// deletes holds the line of all records whose last occurrence
+			// marks them as deleted.
+			deletes = make(map[string]int)
+		)
+
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+		for collector.Err() == nil && scanner.Scan() {
+			lineNo++
+
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			record, err := ParseRecord(line)
+			if err != nil {
+				logrus.Errorf("line %d: %s", lineNo, err)
+				invalid++
+
+				continue
+			}
+
+			// deleted records are not part of a snapshot and are removed
+			// with all other orphaned records.
+			if record.Deleted {
+				if !fullSnapshot {
+					deletes[record.Ref] = lineNo
+				}
+
+				continue
+			}
+
+			delete(deletes, record.Ref)
+
+			collector.Add(record.Ref, manager.UpsertAsync(record.Ref, record.Customer, record.Extra))
+		}
+
+		if err := collector.Wait(); err != nil {
+			logrus.Fatalf("import session failed: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		// never complete a snapshot session with partial input since that
+		// would remove all records that have not been read.
+		if err := scanner.Err(); err != nil {
+			logrus.Fatalf("failed to read input: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		if fullSnapshot && invalid > 0 {
+			logrus.Fatalf("refusing to complete the full snapshot since %d invalid records have been skipped", invalid)
+		}
+
+		summary, err := manager.Stop()
+		if err != nil {
+			logrus.Fatalf("failed to complete import session: %s, use --resume %s to continue", err, manager.SessionID())
+		}
+
+		if summary != nil {
+			summary.Print(os.Stdout)
+
+			if summary.DryRun && summary.RunID != "" {
+				if err := importer.PrintRunDiffs(context.Background(), os.Stdout, cmd.HttpClient, cmd.Config().BaseURLS.CustomerService, summary.RunID); err != nil {
+					logrus.Warnf("failed to load the dry-run changes: %s, use \"customercli imports show --changes %s\" to see them", err, summary.RunID)
+				}
+			}
+		}
+
+		if invalid > 0 {
+			logrus.Errorf("%d invalid records have been skipped", invalid)
+		}
+
+		removeFailed := removeDeleted(cmd, importerName, deletes, dryRun)
+
+		if invalid > 0 || removeFailed > 0 || (summary != nil && (summary.Failed > 0 || summary.SnapshotAborted)) {
+			os.Exit(1)
+		}
+	}
+
+	f := cmd.Flags()
+	{
+		f.StringVar(&importerName, "importer", "", "The name of the importer that owns the imported records")
+		f.BoolVar(&dryRun, "dry-run", false, "Report what would change without storing anything")
+		f.BoolVar(&fullSnapshot, "full-snapshot", false, "Remove customers that are not part of the input anymore")
+		f.Float64Var(&maxRemove, "max-remove", 0, "The maximum fraction of customers that may be removed in full-snapshot mode (defaults to the server setting)")
+		f.StringVar(&resume, "resume", "", "The id of an interrupted import session to resume")
+	}
+
+	cmd.MarkFlagRequired("importer")
+
+	return cmd
+}
+
+// removeDeleted removes the import states of all deleted records. It
+// returns the number of records that could not be removed.
+func removeDeleted(root *cli.Root, importerName string, deletes map[string]int, dryRun bool) int {
+	refs := make([]string, 0, len(deletes))
+	for ref := range deletes {
+		refs = append(refs, ref)
+	}
+
+	// remove the records in the order of the input
+	sort.Slice(refs, func(i, j int) bool {
+		return deletes[refs[i]] < deletes[refs[j]]
+	})
+
+	var failed int
+	for _, ref := range refs {
+		if dryRun {
+			logrus.Infof("line %d: would remove deleted record %s", deletes[ref], ref)
+			continue
+		}
+
+		res, err := removeRecord(root.Context(), root.HttpClient, root.Config().BaseURLS.CustomerService, importerName, ref)
+		switch {
+		case errors.Is(err, errRecordNotFound):
+			logrus.Infof("line %d: deleted record %s has already been removed", deletes[ref], ref)
+
+		case err != nil:
+			logrus.Errorf("line %d: failed to remove deleted record %s: %s", deletes[ref], ref, err)
+			failed++
+
+		case res.Deleted:
+			logrus.Infof("line %d: removed deleted record %s and customer %s", deletes[ref], ref, res.CustomerID)
+
+		default:
+			logrus.Infof("line %d: removed deleted record %s from customer %s, %d attributes pruned", deletes[ref], ref, res.CustomerID, res.PrunedAttributes)
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Record is a single line of the JSON-lines input. All fields except ref,
+// extra and deleted are decoded as a protojson encoded customerv1.Customer.
+type Record struct {
+	Ref      string
+	Extra    map[string]any
+	Deleted  bool
+	Customer *customerv1.Customer
+}
+
+// ParseRecord decodes a single line of the JSON-lines input.
+func ParseRecord(line []byte) (*Record, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+
+	var record Record
+
+	if value, ok := fields["ref"]; ok {
+		if err := json.Unmarshal(value, &record.Ref); err != nil {
+			return nil, fmt.Errorf("invalid ref: %w", err)
+		}
+
+		delete(fields, "ref")
+	}
+
+	if record.Ref == "" {
+		return nil, fmt.Errorf("missing ref")
+	}
+
+	if value, ok := fields["extra"]; ok {
+		if err := json.Unmarshal(value, &record.Extra); err != nil {
+			return nil, fmt.Errorf("invalid extra data: %w", err)
+		}
+
+		delete(fields, "extra")
+	}
+
+	if value, ok := fields["deleted"]; ok {
+		if err := json.Unmarshal(value, &record.Deleted); err != nil {
+			return nil, fmt.Errorf("invalid deleted marker: %w", err)
+		}
+
+		delete(fields, "deleted")
+	}
+
+	blob, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Customer = new(customerv1.Customer)
+	if err := protojson.Unmarshal(blob, record.Customer); err != nil {
+		return nil, fmt.Errorf("invalid customer: %w", err)
+	}
+
+	return &record, nil
+}
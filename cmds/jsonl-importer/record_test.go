@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseRecord(t *testing.T) {
+	cases := []struct {
+		name     string
+		line     string
+		expected *Record
+		err      string
+	}{
+		{
+			name: "customer",
+			line: `{"ref": "1234", "firstName": "Jane", "lastName": "Doe", "phoneNumbers": ["+43 1 234567"], "emailAddresses": ["jane@example.com"]}`,
+			expected: &Record{
+				Ref: "1234",
+				Customer: &customerv1.Customer{
+					FirstName:      "Jane",
+					LastName:       "Doe",
+					PhoneNumbers:   []string{"+43 1 234567"},
+					EmailAddresses: []string{"jane@example.com"},
+				},
+			},
+		},
+		{
+			name: "addresses and extra data",
+			line: `{"ref": "1", "lastName": "Doe", "addresses": [{"street": "Hauptstraße 1", "postalCode": "1010", "city": "Wien"}], "extra": {"vip": true, "source": "legacy"}}`,
+			expected: &Record{
+				Ref:   "1",
+				Extra: map[string]any{"vip": true, "source": "legacy"},
+				Customer: &customerv1.Customer{
+					LastName: "Doe",
+					Addresses: []*customerv1.Address{
+						{Street: "Hauptstraße 1", PostalCode: "1010", City: "Wien"},
+					},
+				},
+			},
+		},
+		{
+			name: "deleted",
+			line: `{"ref": "5678", "deleted": true}`,
+			expected: &Record{
+				Ref:      "5678",
+				Deleted:  true,
+				Customer: &customerv1.Customer{},
+			},
+		},
+		{
+			name: "snake case field names",
+			line: `{"ref": "1", "first_name": "Jane"}`,
+			expected: &Record{
+				Ref:      "1",
+				Customer: &customerv1.Customer{FirstName: "Jane"},
+			},
+		},
+		{
+			name: "missing ref",
+			line: `{"firstName": "Jane"}`,
+			err:  "missing ref",
+		},
+		{
+			name: "empty ref",
+			line: `{"ref": "", "firstName": "Jane"}`,
+			err:  "missing ref",
+		},
+		{
+			name: "numeric ref",
+			line: `{"ref": 1234}`,
+			err:  "invalid ref",
+		},
+		{
+			name: "invalid extra data",
+			line: `{"ref": "1", "extra": [1, 2]}`,
+			err:  "invalid extra data",
+		},
+		{
+			name: "invalid deleted marker",
+			line: `{"ref": "1", "deleted": "yes"}`,
+			err:  "invalid deleted marker",
+		},
+		{
+			name: "unknown field",
+			line: `{"ref": "1", "nickname": "JD"}`,
+			err:  "invalid customer",
+		},
+		{
+			name: "invalid field type",
+			line: `{"ref": "1", "phoneNumbers": "+43 1 234567"}`,
+			err:  "invalid customer",
+		},
+		{
+			name: "not an object",
+			line: `["1", "Jane"]`,
+			err:  "cannot unmarshal",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			record, err := ParseRecord([]byte(c.line))
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, c.expected.Ref, record.Ref)
+			require.Equal(t, c.expected.Extra, record.Extra)
+			require.Equal(t, c.expected.Deleted, record.Deleted)
+			require.True(t, proto.Equal(c.expected.Customer, record.Customer), "unexpected customer: %v", record.Customer)
+		})
+	}
+}
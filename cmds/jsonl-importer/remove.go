@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	connect "github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/importservice"
+)
+
+// errRecordNotFound is returned by removeRecord if no customer holds the
+// record.
+var errRecordNotFound = errors.New("record not found")
+
+// removeRecord removes the import state of a deleted record using the
+// /imports/states/remove admin endpoint of customerd.
+func removeRecord(ctx context.Context, cli connect.HTTPClient, baseURL, importerName, ref string) (*importservice.RemoveImportStateResponse, error) {
+	blob, err := json.Marshal(importservice.RemoveImportStateRequest{
+		Importer: importerName,
+		Ref:      ref,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/imports/states/remove", bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errRecordNotFound
+	default:
+		msg, _ := io.ReadAll(res.Body)
+
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result importservice.RemoveImportStateResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
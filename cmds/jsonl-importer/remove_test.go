@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tierklinik-dobersberg/customer-service/internal/services/importservice"
+)
+
+func TestRemoveRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/imports/states/remove", r.URL.Path)
+
+		var body importservice.RemoveImportStateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "test", body.Importer)
+
+		switch body.Ref {
+		case "1":
+			_ = json.NewEncoder(w).Encode(importservice.RemoveImportStateResponse{CustomerID: "id", Deleted: true})
+		case "2":
+			http.Error(w, "customer not found", http.StatusNotFound)
+		default:
+			http.Error(w, "customer locked", http.StatusConflict)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	res, err := removeRecord(ctx, srv.Client(), srv.URL+"/", "test", "1")
+	require.NoError(t, err)
+	require.Equal(t, "id", res.CustomerID)
+	require.True(t, res.Deleted)
+
+	_, err = removeRecord(ctx, srv.Client(), srv.URL, "test", "2")
+	require.ErrorIs(t, err, errRecordNotFound)
+
+	_, err = removeRecord(ctx, srv.Client(), srv.URL, "test", "3")
+	require.ErrorContains(t, err, "customer locked")
+}
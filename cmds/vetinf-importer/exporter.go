@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
-	"github.com/nyaruka/phonenumbers"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
 	"github.com/tierklinik-dobersberg/go-vetinf/vetinf"
 )
 
@@ -31,13 +33,6 @@ type Exporter struct {
 	country string
 }
 
-type ImportResults struct {
-	New      int
-	Pristine int
-	Updated  int
-	Deleted  int
-}
-
 type VetInf struct {
 	Directory string
 	Encoding  string
@@ -68,30 +63,73 @@ func NewExporter(path, encoding, country, phonePrefix string) (*Exporter, error)
 	}, nil
 }
 
+// Export streams the customers of a VetInf database.
+type Export struct {
+	// Customers receives all valid customer records, including deleted
+	// ones. It is closed once all records have been read.
+	Customers <-chan *ExportedCustomer
+
+	// Total is the number of records in the customer database.
+	Total int
+
+	wg       sync.WaitGroup
+	errs     []error
+	canceled error
+	invalid  int
+}
+
+// Err returns the errors encountered while reading customer records. It
+// blocks until the export is finished.
+func (e *Export) Err() error {
+	e.wg.Wait()
+
+	return errors.Join(append(e.errs, e.canceled)...)
+}
+
+// Invalid returns the number of invalid customer records that have been
+// skipped. It blocks until the export is finished.
+func (e *Export) Invalid() int {
+	e.wg.Wait()
+
+	return e.invalid
+}
+
 // ExportCustomers exports all vetinf customers and streams them to
-// the returned channel. Errors encountered when exporting single
-// customers are logged and ignored.
-func (e *Exporter) ExportCustomers(ctx context.Context) (<-chan *ExportedCustomer, int, error) {
+// the returned export. Errors encountered when exporting single
+// customers are logged and reported by Export.Err.
+func (e *Exporter) ExportCustomers(ctx context.Context) (*Export, error) {
 	customerDB, err := e.db.CustomerDB(e.encoding)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	dataCh, errCh, total := customerDB.StreamAll(ctx)
 
 	customers := make(chan *ExportedCustomer, 10)
 
+	export := &Export{
+		Customers: customers,
+		Total:     total,
+	}
+
+	export.wg.Add(2)
+
 	go func() {
+		defer export.wg.Done()
+
 		for err := range errCh {
 			logrus.Errorf("export: %s", err)
+			export.errs = append(export.errs, err)
 		}
 	}()
 
 	go func() {
+		defer export.wg.Done()
 		defer close(customers)
 		for customer := range dataCh {
 			if !isValidCustomer(&customer) {
 				logrus.Infof("vetinf: skipping customer record: %+v", customer)
+				export.invalid++
 				continue
 			}
 
@@ -141,34 +179,27 @@ func (e *Exporter) ExportCustomers(ctx context.Context) (<-chan *ExportedCustome
 			select {
 			case customers <- dbCustomer:
 			case <-ctx.Done():
+				export.canceled = ctx.Err()
 				return
 			}
 		}
 	}()
 
-	return customers, total, nil
+	return export, nil
 }
 
 func addNumber(prefix string, numbers []string, number, country string, hasError *bool) []string {
-	number = strings.TrimSpace(number)
-
-	if number == "" {
+	if strings.TrimSpace(number) == "" {
 		return numbers
 	}
 
-	if !strings.HasPrefix(number, "+") && !strings.HasPrefix(number, "0") && prefix != "" {
-		number = prefix + number
-	}
-
-	p, err := phonenumbers.Parse(number, country)
+	formatted, err := importer.NormalizePhoneNumber(number, country, prefix)
 	if err != nil {
 		*hasError = true
 		return numbers
 	}
 
-	return append(numbers, []string{
-		phonenumbers.Format(p, phonenumbers.INTERNATIONAL),
-	}...)
+	return append(numbers, formatted)
 }
 
 func isValidCustomer(c *vetinf.Customer) bool {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"os"
 
 	connect "github.com/bufbuild/connect-go"
 	"github.com/sirupsen/logrus"
@@ -14,6 +15,10 @@ import (
 var (
 	encoding           string
 	defaultPhonePrefix string
+	dryRun             bool
+	fullSnapshot       bool
+	maxRemove          float64
+	resume             string
 )
 
 func main() {
@@ -35,6 +40,10 @@ func getRootCommand() *cli.Root {
 	{
 		f.StringVar(&encoding, "encoding", "IBM852", "The encoding of the VetInf database")
 		f.StringVar(&defaultPhonePrefix, "phone-prefix", "", "The default phone region code")
+		f.BoolVar(&dryRun, "dry-run", false, "Report what would change without storing anything")
+		f.BoolVar(&fullSnapshot, "full-snapshot", false, "Remove customers that are not part of the VetInf export anymore")
+		f.Float64Var(&maxRemove, "max-remove", 0, "The maximum fraction of customers that may be removed in full-snapshot mode (defaults to the server setting)")
+		f.StringVar(&resume, "resume", "", "The id of an interrupted import session to resume")
 	}
 
 	cmd.MarkFlagRequired("server")
@@ -65,31 +74,115 @@ func execute(root *cli.Root, args []string) {
 		NewAuthInterceptor(root),
 	))
 
-	stream, _, err := exporter.ExportCustomers(context.Background())
+	export, err := exporter.ExportCustomers(context.Background())
 	if err != nil {
 		logrus.Fatalf("failed to create vetinf exporter: %s", err)
 	}
 
-	importStream := cli.ImportSession(context.Background())
+	opts := importer.StreamOptions{
+		DryRun:    dryRun,
+		Snapshot:  fullSnapshot,
+		MaxRemove: maxRemove,
+		Resume:    resume,
+	}
+
+	newStream := func(ctx context.Context) importer.ImportStream {
+		return opts.Apply(cli.ImportSession(ctx))
+	}
 
-	session, err := importer.NewManager(context.Background(), "vetinf", importStream)
+	// full exports contain thousands of customers. 64 upserts in flight
+	// keep the session workers of customerd (8 by default) busy while
+	// responses are on the way back, and sending them in groups of 32, the
+	// default IMPORT_BATCH_SIZE of customerd, lets the server coalesce the
+	// writes of concurrently processed upserts instead of storing each one
+	// as it trickles in.
+	session, err := importer.NewManager(context.Background(), "vetinf", newStream, importer.Options{
+		MaxInFlight: 64,
+		BatchSize:   32,
+		OnProgress: func(p importer.Progress) {
+			if p.Completed%100 == 0 {
+				logrus.Infof("vetinf: %d customers imported, %d failed", p.Completed, p.Failed)
+			}
+		},
+	})
 	if err != nil {
 		logrus.Fatalf("failed to create import manager: %s", err)
 	}
 
-	for customer := range stream {
+	if resume != "" {
+		logrus.Infof("resuming import session %s, skipping %d already imported customers", session.SessionID(), session.Checkpoint())
+	} else {
+		logrus.Infof("started import session %s, use --resume %s to continue if it gets interrupted", session.SessionID(), session.SessionID())
+	}
+
+	var deleted int
+
+	collector := &importer.Collector{
+		OnError: func(ref string, err error) {
+			logrus.Errorf("failed to upsert customer %s: %s", ref, err)
+		},
+	}
+
+	for customer := range export.Customers {
+		if collector.Err() != nil {
+			break
+		}
+
 		if customer.Deleted {
 			// TODO(ppacher)
 			logrus.Infof("vetinf: skipping deleted customer %s (%s %s)", customer.InternalRef, customer.LastName, customer.FirstName)
+			deleted++
 			continue
 		}
 
 		logrus.Infof("vetinf: upserting customer %s (%s %s)", customer.InternalRef, customer.LastName, customer.FirstName)
 
-		if err := session.UpsertCustomerByRef(customer.InternalRef, customer.Customer, nil); err != nil {
-			logrus.Errorf("failed to upsert customer: %s", err)
+		collector.Add(customer.InternalRef, session.UpsertAsync(customer.InternalRef, customer.Customer, nil))
+	}
+
+	if err := collector.Wait(); err != nil {
+		logrus.Fatalf("import session failed: %s, use --resume %s to continue", err, session.SessionID())
+	}
+
+	exportErr := export.Err()
+	invalid := export.Invalid()
+
+	// never complete a snapshot session with partial input since that
+	// would remove all records that have not been upserted.
+	if fullSnapshot {
+		if exportErr != nil {
+			logrus.Fatalf("refusing to complete the full snapshot since the export failed: %s", exportErr)
 		}
+
+		if invalid > 0 || deleted > 0 {
+			logrus.Fatalf("refusing to complete the full snapshot since %d invalid and %d deleted records have been skipped", invalid, deleted)
+		}
+	}
+
+	summary, err := session.Stop()
+	if err != nil {
+		logrus.Fatalf("failed to complete import session: %s, use --resume %s to continue", err, session.SessionID())
+	}
+
+	if summary != nil {
+		summary.Print(os.Stdout)
+
+		if summary.DryRun && summary.RunID != "" {
+			if err := importer.PrintRunDiffs(context.Background(), os.Stdout, root.HttpClient, root.Config().BaseURLS.CustomerService, summary.RunID); err != nil {
+				logrus.Warnf("failed to load the dry-run changes: %s, use \"customercli imports show --changes %s\" to see them", err, summary.RunID)
+			}
+		}
+	}
+
+	if exportErr != nil {
+		logrus.Errorf("failed to export customers: %s", exportErr)
 	}
 
-	session.Stop()
+	if invalid > 0 || deleted > 0 {
+		logrus.Warnf("%d invalid and %d deleted records have been skipped", invalid, deleted)
+	}
+
+	if exportErr != nil || invalid > 0 || (summary != nil && (summary.Failed > 0 || summary.SnapshotAborted)) {
+		os.Exit(1)
+	}
 }
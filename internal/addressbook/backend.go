@@ -0,0 +1,140 @@
+// Package addressbook serves the customer database as a read-only CardDAV
+// address book.
+package addressbook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// errReadOnly is returned for all requests that try to modify the address
+// book.
+var errReadOnly = webdav.NewHTTPError(http.StatusForbidden, errors.New("the customer address book is read-only"))
+
+// Backend implements carddav.Backend on top of the customer repository.
+// There is only a single address book shared by all users.
+type Backend struct {
+	store  repo.Repo
+	prefix string
+}
+
+var _ carddav.Backend = (*Backend)(nil)
+
+// NewBackend returns a backend that serves the address book below prefix.
+func NewBackend(store repo.Repo, prefix string) *Backend {
+	return &Backend{
+		store:  store,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+func (b *Backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return b.prefix + "/principal/", nil
+}
+
+func (b *Backend) AddressbookHomeSetPath(ctx context.Context) (string, error) {
+	return b.prefix + "/principal/addressbooks/", nil
+}
+
+// addressBookPath returns the path of the customer address book.
+func (b *Backend) addressBookPath() string {
+	return b.prefix + "/principal/addressbooks/customers/"
+}
+
+func (b *Backend) objectPath(id string) string {
+	return b.addressBookPath() + id + ".vcf"
+}
+
+func (b *Backend) AddressBook(ctx context.Context) (*carddav.AddressBook, error) {
+	return &carddav.AddressBook{
+		Path:        b.addressBookPath(),
+		Name:        "Customers",
+		Description: "Read-only list of all customers",
+		SupportedAddressData: []carddav.AddressDataType{
+			{ContentType: vcard.MIMEType, Version: "3.0"},
+		},
+	}, nil
+}
+
+func (b *Backend) GetAddressObject(ctx context.Context, objPath string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	dir, file := path.Split(objPath)
+	if dir != b.addressBookPath() || !strings.HasSuffix(file, ".vcf") {
+		return nil, webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf("address object %s not found", objPath))
+	}
+
+	id := strings.TrimSuffix(file, ".vcf")
+
+	customer, _, revision, err := b.store.LookupCustomerById(ctx, id)
+	if err != nil {
+		if errors.Is(err, repo.ErrCustomerNotFound) {
+			return nil, webdav.NewHTTPError(http.StatusNotFound, err)
+		}
+
+		return nil, err
+	}
+
+	return &carddav.AddressObject{
+		Path: objPath,
+		ETag: formatETag(revision),
+		Card: customerToCard(customer),
+	}, nil
+}
+
+func (b *Backend) ListAddressObjects(ctx context.Context, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	// the revisions are loaded first so a customer that is updated in
+	// between is reported with an outdated ETag and fetched again by the
+	// next sync instead of being missed.
+	revisions, err := b.store.ListCustomerRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	customers, _, err := b.store.ListCustomers(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]carddav.AddressObject, 0, len(customers))
+	for _, c := range customers {
+		objects = append(objects, carddav.AddressObject{
+			Path: b.objectPath(c.Customer.Id),
+			ETag: formatETag(revisions[c.Customer.Id]),
+			Card: customerToCard(c.Customer),
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *Backend) QueryAddressObjects(ctx context.Context, query *carddav.AddressBookQuery) ([]carddav.AddressObject, error) {
+	objects, err := b.ListAddressObjects(ctx, &query.DataRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return carddav.Filter(query, objects)
+}
+
+func (b *Backend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *carddav.PutAddressObjectOptions) (string, error) {
+	return "", errReadOnly
+}
+
+func (b *Backend) DeleteAddressObject(ctx context.Context, path string) error {
+	return errReadOnly
+}
+
+// formatETag returns the entity tag for a customer revision. go-webdav
+// quotes it when writing responses.
+func formatETag(revision uint64) string {
+	return strconv.FormatUint(revision, 10)
+}
@@ -0,0 +1,450 @@
+package addressbook
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+const (
+	nsDAV            = "DAV:"
+	nsCardDAV        = "urn:ietf:params:xml:ns:carddav"
+	nsCalendarServer = "http://calendarserver.org/ns/"
+
+	// maxRequestSize limits the size of PROPFIND and REPORT request bodies.
+	maxRequestSize = 1024 * 1024
+)
+
+var (
+	syncTokenName          = xml.Name{Space: nsDAV, Local: "sync-token"}
+	getCTagName            = xml.Name{Space: nsCalendarServer, Local: "getctag"}
+	supportedReportSetName = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	getETagName            = xml.Name{Space: nsDAV, Local: "getetag"}
+	addressDataName        = xml.Name{Space: nsCardDAV, Local: "address-data"}
+)
+
+// Handler serves the customer address book. It wraps carddav.Handler and
+// adds support for sync-collection reports (RFC 6578) which go-webdav does
+// not implement.
+type Handler struct {
+	backend    *Backend
+	carddav    *carddav.Handler
+	syncStates *syncStates
+	revisions  revisionCache
+}
+
+// NewHandler returns a handler that serves the customer address book below
+// prefix.
+func NewHandler(store repo.Repo, prefix string) *Handler {
+	backend := NewBackend(store, prefix)
+
+	return &Handler{
+		backend: backend,
+		carddav: &carddav.Handler{
+			Backend: backend,
+			Prefix:  backend.prefix,
+		},
+		syncStates: newSyncStates(),
+		revisions: revisionCache{
+			ttl: revisionCacheTTL,
+		},
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	isAddressBook := strings.TrimSuffix(r.URL.Path, "/") == strings.TrimSuffix(h.backend.addressBookPath(), "/")
+
+	if isAddressBook && (r.Method == "REPORT" || r.Method == "PROPFIND") {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if h.serveSync(w, r, body) {
+			return
+		}
+	}
+
+	h.carddav.ServeHTTP(w, r)
+}
+
+type rawElement struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+type propList struct {
+	Names []rawElement `xml:",any"`
+}
+
+func (p *propList) has(names ...xml.Name) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, el := range p.Names {
+		for _, n := range names {
+			if el.XMLName == n {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type syncCollectionRequest struct {
+	XMLName   xml.Name  `xml:"DAV: sync-collection"`
+	SyncToken string    `xml:"DAV: sync-token"`
+	Prop      *propList `xml:"DAV: prop"`
+}
+
+type propFindRequest struct {
+	XMLName xml.Name  `xml:"DAV: propfind"`
+	Prop    *propList `xml:"DAV: prop"`
+}
+
+type multiStatus struct {
+	XMLName   xml.Name   `xml:"DAV: multistatus"`
+	Responses []response `xml:"DAV: response"`
+	SyncToken string     `xml:"DAV: sync-token,omitempty"`
+}
+
+type response struct {
+	Href      string     `xml:"DAV: href"`
+	PropStats []propStat `xml:"DAV: propstat,omitempty"`
+	Status    string     `xml:"DAV: status,omitempty"`
+}
+
+type propStat struct {
+	Prop   propList `xml:"DAV: prop"`
+	Status string   `xml:"DAV: status"`
+}
+
+// serveSync handles sync-collection reports and PROPFIND requests for the
+// sync token of the address book. It returns false if the request must be
+// handled by go-webdav.
+func (h *Handler) serveSync(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var root struct {
+		XMLName xml.Name
+	}
+
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return false
+	}
+
+	switch {
+	case r.Method == "REPORT" && root.XMLName == xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		var req syncCollectionRequest
+		if err := xml.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+
+		h.serveSyncCollection(w, r, &req)
+
+		return true
+
+	case r.Method == "PROPFIND" && r.Header.Get("Depth") == "0":
+		var req propFindRequest
+		if err := xml.Unmarshal(body, &req); err != nil {
+			return false
+		}
+
+		if !req.Prop.has(syncTokenName, getCTagName, supportedReportSetName) {
+			return false
+		}
+
+		h.servePropFind(w, r, &req)
+
+		return true
+	}
+
+	return false
+}
+
+func (h *Handler) serveSyncCollection(w http.ResponseWriter, r *http.Request, req *syncCollectionRequest) {
+	ctx := r.Context()
+
+	token, current, err := h.currentToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load customer revisions", slog.Any("error", err.Error()))
+		http.Error(w, "failed to load customers", http.StatusInternalServerError)
+
+		return
+	}
+
+	var old map[string]uint64
+	if clientToken := strings.TrimSpace(req.SyncToken); clientToken != "" {
+		var ok bool
+
+		old, ok = h.syncStates.get(clientToken)
+
+		// tokens are derived from the revisions so the current token is
+		// still valid if the state has been lost by a restart.
+		if !ok && clientToken == token {
+			old, ok = current, true
+		}
+
+		if !ok {
+			// RFC 6578: the client has to start over with an initial sync.
+			writeXML(w, http.StatusForbidden, `<error xmlns="DAV:"><valid-sync-token/></error>`)
+			return
+		}
+	}
+
+	changed, deleted := diffRevisions(old, current)
+
+	var objects map[string]addressObject
+	if req.Prop.has(addressDataName) && len(changed) > 0 {
+		objects, err = h.loadObjects(ctx, old == nil, changed, current)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to load customers", slog.Any("error", err.Error()))
+			http.Error(w, "failed to load customers", http.StatusInternalServerError)
+
+			return
+		}
+	}
+
+	ms := multiStatus{
+		SyncToken: token,
+	}
+
+	for _, id := range changed {
+		var (
+			card     vcard.Card
+			revision = current[id]
+		)
+
+		if objects != nil {
+			obj, ok := objects[id]
+
+			// the customer has been deleted in the meantime.
+			if !ok {
+				continue
+			}
+
+			card, revision = obj.card, obj.revision
+		}
+
+		res := response{
+			Href:      h.backend.objectPath(id),
+			PropStats: objectPropStats(req.Prop, revision, card),
+		}
+
+		// RFC 6578 reports changed members without properties if none
+		// have been requested.
+		if len(res.PropStats) == 0 {
+			res.Status = statusText(http.StatusOK)
+		}
+
+		ms.Responses = append(ms.Responses, res)
+	}
+
+	for _, id := range deleted {
+		ms.Responses = append(ms.Responses, response{
+			Href:   h.backend.objectPath(id),
+			Status: statusText(http.StatusNotFound),
+		})
+	}
+
+	writeMultiStatus(w, &ms)
+}
+
+// addressObject is a customer loaded for a sync-collection report.
+type addressObject struct {
+	card     vcard.Card
+	revision uint64
+}
+
+// loadObjects loads the customers with the given ids together with their
+// revision. Initial syncs load the whole collection instead and take the
+// revisions from current, which have been loaded before the customers so
+// an ETag is never newer than its card. A customer updated in between is
+// reported again by the next sync.
+func (h *Handler) loadObjects(ctx context.Context, initial bool, ids []string, current map[string]uint64) (map[string]addressObject, error) {
+	objects := make(map[string]addressObject, len(ids))
+
+	if initial {
+		customers, _, err := h.backend.store.ListCustomers(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range customers {
+			objects[c.Customer.Id] = addressObject{
+				card:     customerToCard(c.Customer),
+				revision: current[c.Customer.Id],
+			}
+		}
+
+		return objects, nil
+	}
+
+	for _, id := range ids {
+		customer, _, revision, err := h.backend.store.LookupCustomerById(ctx, id)
+		if err != nil {
+			if errors.Is(err, repo.ErrCustomerNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		objects[id] = addressObject{
+			card:     customerToCard(customer),
+			revision: revision,
+		}
+	}
+
+	return objects, nil
+}
+
+// objectPropStats returns the requested properties of an address object.
+func objectPropStats(props *propList, revision uint64, card vcard.Card) []propStat {
+	var found, missing propList
+
+	if props != nil {
+		for _, el := range props.Names {
+			switch el.XMLName {
+			case getETagName:
+				found.Names = append(found.Names, textElement(el.XMLName, `"`+formatETag(revision)+`"`))
+
+			case addressDataName:
+				var buf bytes.Buffer
+				if err := vcard.NewEncoder(&buf).Encode(card); err != nil {
+					missing.Names = append(missing.Names, rawElement{XMLName: el.XMLName})
+					continue
+				}
+
+				found.Names = append(found.Names, textElement(el.XMLName, buf.String()))
+
+			default:
+				missing.Names = append(missing.Names, rawElement{XMLName: el.XMLName})
+			}
+		}
+	}
+
+	return propStats(found, missing)
+}
+
+func (h *Handler) servePropFind(w http.ResponseWriter, r *http.Request, req *propFindRequest) {
+	ctx := r.Context()
+
+	token, _, err := h.currentToken(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load customer revisions", slog.Any("error", err.Error()))
+		http.Error(w, "failed to load customers", http.StatusInternalServerError)
+
+		return
+	}
+
+	book, _ := h.backend.AddressBook(ctx)
+	principal, _ := h.backend.CurrentUserPrincipal(ctx)
+
+	var found, missing propList
+	for _, el := range req.Prop.Names {
+		switch el.XMLName {
+		case syncTokenName, getCTagName:
+			found.Names = append(found.Names, textElement(el.XMLName, token))
+
+		case supportedReportSetName:
+			var inner strings.Builder
+			for _, report := range []xml.Name{
+				{Space: nsDAV, Local: "sync-collection"},
+				{Space: nsCardDAV, Local: "addressbook-query"},
+				{Space: nsCardDAV, Local: "addressbook-multiget"},
+			} {
+				inner.WriteString(`<supported-report xmlns="DAV:"><report><` + report.Local + ` xmlns="` + report.Space + `"/></report></supported-report>`)
+			}
+
+			found.Names = append(found.Names, rawElement{XMLName: el.XMLName, Inner: inner.String()})
+
+		case xml.Name{Space: nsDAV, Local: "resourcetype"}:
+			found.Names = append(found.Names, rawElement{
+				XMLName: el.XMLName,
+				Inner:   `<collection xmlns="DAV:"/><addressbook xmlns="` + nsCardDAV + `"/>`,
+			})
+
+		case xml.Name{Space: nsDAV, Local: "displayname"}:
+			found.Names = append(found.Names, textElement(el.XMLName, book.Name))
+
+		case xml.Name{Space: nsCardDAV, Local: "addressbook-description"}:
+			found.Names = append(found.Names, textElement(el.XMLName, book.Description))
+
+		case xml.Name{Space: nsDAV, Local: "current-user-principal"}:
+			found.Names = append(found.Names, rawElement{XMLName: el.XMLName, Inner: `<href xmlns="DAV:">` + escapeText(principal) + `</href>`})
+
+		default:
+			missing.Names = append(missing.Names, rawElement{XMLName: el.XMLName})
+		}
+	}
+
+	writeMultiStatus(w, &multiStatus{
+		Responses: []response{
+			{
+				Href:      book.Path,
+				PropStats: propStats(found, missing),
+			},
+		},
+	})
+}
+
+func propStats(found, missing propList) []propStat {
+	var result []propStat
+
+	if len(found.Names) > 0 {
+		result = append(result, propStat{Prop: found, Status: statusText(http.StatusOK)})
+	}
+
+	if len(missing.Names) > 0 {
+		result = append(result, propStat{Prop: missing, Status: statusText(http.StatusNotFound)})
+	}
+
+	return result
+}
+
+func textElement(name xml.Name, value string) rawElement {
+	return rawElement{XMLName: name, Inner: escapeText(value)}
+}
+
+func escapeText(value string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(value))
+
+	return buf.String()
+}
+
+func statusText(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+func writeMultiStatus(w http.ResponseWriter, ms *multiStatus) {
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeXML(w, http.StatusMultiStatus, string(body))
+}
+
+func writeXML(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+
+	_, _ = io.WriteString(w, xml.Header+body)
+}
@@ -0,0 +1,225 @@
+package addressbook
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+func syncCollection(t *testing.T, h http.Handler, token string) (int, *multiStatus) {
+	t.Helper()
+
+	return syncCollectionProps(t, h, token, `<d:prop><d:getetag/><card:address-data/></d:prop>`)
+}
+
+func syncCollectionProps(t *testing.T, h http.Handler, token, props string) (int, *multiStatus) {
+	t.Helper()
+
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:sync-collection xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:sync-token>` + token + `</d:sync-token>
+  <d:sync-level>1</d:sync-level>
+  ` + props + `
+</d:sync-collection>`
+
+	req := httptest.NewRequest("REPORT", "/carddav/principal/addressbooks/customers/", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMultiStatus {
+		return rec.Code, nil
+	}
+
+	var ms multiStatus
+	require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &ms))
+
+	return rec.Code, &ms
+}
+
+func TestSyncCollection(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	jane := &customerv1.Customer{FirstName: "Jane", LastName: "Doe", PhoneNumbers: []string{"+43 1 234567"}}
+	john := &customerv1.Customer{FirstName: "John", LastName: "Doe"}
+
+	_, err := store.StoreCustomer(ctx, jane, nil, 0)
+	require.NoError(t, err)
+	johnRev, err := store.StoreCustomer(ctx, john, nil, 0)
+	require.NoError(t, err)
+
+	h := NewHandler(store, "/carddav")
+	h.revisions.ttl = 0
+
+	// the initial sync returns all customers
+	code, ms := syncCollection(t, h, "")
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Len(t, ms.Responses, 2)
+	require.NotEmpty(t, ms.SyncToken)
+
+	for _, res := range ms.Responses {
+		require.Len(t, res.PropStats, 1)
+		require.Contains(t, res.PropStats[0].Status, "200")
+		require.Len(t, res.PropStats[0].Prop.Names, 2)
+	}
+
+	// nothing changed
+	code, unchanged := syncCollection(t, h, ms.SyncToken)
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Empty(t, unchanged.Responses)
+	require.Equal(t, ms.SyncToken, unchanged.SyncToken)
+
+	// update one customer and delete the other one
+	john.PhoneNumbers = []string{"+43 664 1234567"}
+	_, err = store.StoreCustomer(ctx, john, nil, johnRev)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteCustomer(ctx, jane.Id))
+
+	code, changes := syncCollection(t, h, ms.SyncToken)
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Len(t, changes.Responses, 2)
+
+	require.Equal(t, "/carddav/principal/addressbooks/customers/"+john.Id+".vcf", changes.Responses[0].Href)
+	require.Contains(t, changes.Responses[0].PropStats[0].Prop.Names[1].Inner, "+43 664 1234567")
+
+	require.Equal(t, "/carddav/principal/addressbooks/customers/"+jane.Id+".vcf", changes.Responses[1].Href)
+	require.Contains(t, changes.Responses[1].Status, "404")
+
+	// unknown tokens require a full sync
+	code, _ = syncCollection(t, h, "urn:x-customerd:sync:unknown")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestSyncTokenCache(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	jane := &customerv1.Customer{FirstName: "Jane", LastName: "Doe"}
+	rev, err := store.StoreCustomer(ctx, jane, nil, 0)
+	require.NoError(t, err)
+
+	h := NewHandler(store, "/carddav")
+
+	_, ms := syncCollection(t, h, "")
+	require.Len(t, ms.Responses, 1)
+
+	// the current token is still accepted after a restart
+	restarted := NewHandler(store, "/carddav")
+
+	code, unchanged := syncCollection(t, restarted, ms.SyncToken)
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Empty(t, unchanged.Responses)
+
+	// changes are only reported once the cached revisions expired
+	jane.LastName = "Roe"
+	_, err = store.StoreCustomer(ctx, jane, nil, rev)
+	require.NoError(t, err)
+
+	_, cached := syncCollection(t, h, ms.SyncToken)
+	require.Empty(t, cached.Responses)
+	require.Equal(t, ms.SyncToken, cached.SyncToken)
+
+	h.revisions.loadedAt = time.Time{}
+
+	_, changes := syncCollection(t, h, ms.SyncToken)
+	require.Len(t, changes.Responses, 1)
+	require.Contains(t, changes.Responses[0].PropStats[0].Prop.Names[1].Inner, "Roe")
+	require.NotEqual(t, ms.SyncToken, changes.SyncToken)
+}
+
+func TestSyncCollectionWithoutProps(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	jane := &customerv1.Customer{FirstName: "Jane", LastName: "Doe"}
+	_, err := store.StoreCustomer(ctx, jane, nil, 0)
+	require.NoError(t, err)
+
+	h := NewHandler(store, "/carddav")
+
+	code, ms := syncCollectionProps(t, h, "", "")
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Len(t, ms.Responses, 1)
+	require.Empty(t, ms.Responses[0].PropStats)
+	require.Contains(t, ms.Responses[0].Status, "200")
+}
+
+func TestSyncCollectionETag(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	jane := &customerv1.Customer{FirstName: "Jane", LastName: "Doe"}
+	rev, err := store.StoreCustomer(ctx, jane, nil, 0)
+	require.NoError(t, err)
+
+	h := NewHandler(store, "/carddav")
+
+	_, ms := syncCollection(t, h, "")
+	require.Len(t, ms.Responses, 1)
+	require.Equal(t, escapeText(`"1"`), ms.Responses[0].PropStats[0].Prop.Names[0].Inner)
+
+	// the cached revisions see the first update but not the second one
+	jane.LastName = "Roe"
+	rev, err = store.StoreCustomer(ctx, jane, nil, rev)
+	require.NoError(t, err)
+
+	h.revisions.loadedAt = time.Time{}
+	_, _, err = h.currentToken(ctx)
+	require.NoError(t, err)
+
+	jane.LastName = "Poe"
+	_, err = store.StoreCustomer(ctx, jane, nil, rev)
+	require.NoError(t, err)
+
+	// the ETag belongs to the card that is returned
+	_, changes := syncCollection(t, h, ms.SyncToken)
+	require.Len(t, changes.Responses, 1)
+	require.Equal(t, escapeText(`"3"`), changes.Responses[0].PropStats[0].Prop.Names[0].Inner)
+	require.Contains(t, changes.Responses[0].PropStats[0].Prop.Names[1].Inner, "Poe")
+}
+
+func TestGetAddressObject(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	customer := &customerv1.Customer{
+		FirstName:      "Jane",
+		LastName:       "Doe",
+		EmailAddresses: []string{"jane@example.com"},
+		Addresses: []*customerv1.Address{
+			{Street: "Hauptstraße 1", PostalCode: "1010", City: "Wien"},
+		},
+	}
+
+	_, err := store.StoreCustomer(ctx, customer, nil, 0)
+	require.NoError(t, err)
+
+	h := NewHandler(store, "/carddav")
+
+	req := httptest.NewRequest(http.MethodGet, "/carddav/principal/addressbooks/customers/"+customer.Id+".vcf", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"1"`, rec.Header().Get("ETag"))
+	require.Contains(t, rec.Body.String(), "FN:Jane Doe")
+	require.Contains(t, rec.Body.String(), "ADR:;;Hauptstraße 1;Wien;;1010;")
+	require.Contains(t, rec.Body.String(), "UID:"+customer.Id)
+
+	// the address book is read-only
+	req = httptest.NewRequest(http.MethodDelete, "/carddav/principal/addressbooks/customers/"+customer.Id+".vcf", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
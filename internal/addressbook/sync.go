@@ -0,0 +1,206 @@
+package addressbook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSyncStates is the number of sync states that are kept in memory.
+// Clients that present an older token have to perform a full sync.
+const maxSyncStates = 64
+
+// revisionCacheTTL is the time the current customer revisions are cached.
+// Clients see changes with at most that delay but polling the sync token
+// does not scan the customer collection on every request.
+const revisionCacheTTL = 10 * time.Second
+
+const syncTokenPrefix = "urn:x-customerd:sync:"
+
+// syncStates remembers the customer revisions for recently issued sync
+// tokens. Only the latest state is kept in full, older states are stored
+// as the changes needed to restore them from the next newer one, so the
+// memory used grows with the number of changed customers rather than the
+// number of tokens. The states are only kept in memory so clients have to
+// perform a full sync after a restart unless no customer changed in the
+// meantime.
+type syncStates struct {
+	l           sync.Mutex
+	latestToken string
+	latest      map[string]uint64
+
+	// older holds the older states, oldest first.
+	older []syncDelta
+}
+
+// syncDelta restores the state of token from the next newer state.
+type syncDelta struct {
+	token string
+
+	// revisions holds the revisions of customers that have been updated
+	// or deleted since and absent the ids of customers created since.
+	revisions map[string]uint64
+	absent    []string
+}
+
+func newSyncStates() *syncStates {
+	return &syncStates{}
+}
+
+// current returns the sync token for revisions and remembers the state.
+// revisions must not be modified afterwards.
+func (s *syncStates) current(revisions map[string]uint64) string {
+	token := syncToken(revisions)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if token == s.latestToken {
+		return token
+	}
+
+	if s.latest != nil {
+		delta := syncDelta{
+			token:     s.latestToken,
+			revisions: make(map[string]uint64),
+		}
+
+		for id, rev := range s.latest {
+			if cur, ok := revisions[id]; !ok || cur != rev {
+				delta.revisions[id] = rev
+			}
+		}
+
+		for id := range revisions {
+			if _, ok := s.latest[id]; !ok {
+				delta.absent = append(delta.absent, id)
+			}
+		}
+
+		s.older = append(s.older, delta)
+
+		if len(s.older) >= maxSyncStates {
+			s.older = s.older[1:]
+		}
+	}
+
+	s.latestToken = token
+	s.latest = revisions
+
+	return token
+}
+
+// get returns the revisions for token. The revisions must not be
+// modified.
+func (s *syncStates) get(token string) (map[string]uint64, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.latest != nil && token == s.latestToken {
+		return s.latest, true
+	}
+
+	idx := len(s.older) - 1
+	for idx >= 0 && s.older[idx].token != token {
+		idx--
+	}
+
+	if idx < 0 {
+		return nil, false
+	}
+
+	revisions := make(map[string]uint64, len(s.latest))
+	for id, rev := range s.latest {
+		revisions[id] = rev
+	}
+
+	// walk back from the latest state to the requested one.
+	for i := len(s.older) - 1; i >= idx; i-- {
+		for id, rev := range s.older[i].revisions {
+			revisions[id] = rev
+		}
+
+		for _, id := range s.older[i].absent {
+			delete(revisions, id)
+		}
+	}
+
+	return revisions, true
+}
+
+// syncToken returns a sync token URI for the given customer revisions.
+func syncToken(revisions map[string]uint64) string {
+	ids := make([]string, 0, len(revisions))
+	for id := range revisions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s:%d\n", id, revisions[id])
+	}
+
+	return syncTokenPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// diffRevisions returns the sorted ids of all customers that have been
+// created or updated, and of all customers that have been deleted since
+// the state old.
+func diffRevisions(old, current map[string]uint64) (changed, deleted []string) {
+	for id, rev := range current {
+		if prev, ok := old[id]; !ok || prev != rev {
+			changed = append(changed, id)
+		}
+	}
+
+	for id := range old {
+		if _, ok := current[id]; !ok {
+			deleted = append(deleted, id)
+		}
+	}
+
+	sort.Strings(changed)
+	sort.Strings(deleted)
+
+	return changed, deleted
+}
+
+// revisionCache caches the current customer revisions and their sync
+// token. The returned revisions must not be modified.
+type revisionCache struct {
+	l         sync.Mutex
+	ttl       time.Duration
+	loadedAt  time.Time
+	token     string
+	revisions map[string]uint64
+}
+
+// currentToken returns the sync token for the current state of the
+// customer database. Concurrent callers share a single load of the
+// revisions.
+func (h *Handler) currentToken(ctx context.Context) (string, map[string]uint64, error) {
+	cache := &h.revisions
+
+	cache.l.Lock()
+	defer cache.l.Unlock()
+
+	if cache.revisions != nil && time.Since(cache.loadedAt) < cache.ttl {
+		return cache.token, cache.revisions, nil
+	}
+
+	revisions, err := h.backend.store.ListCustomerRevisions(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cache.revisions = revisions
+	cache.token = h.syncStates.current(revisions)
+	cache.loadedAt = time.Now()
+
+	return cache.token, cache.revisions, nil
+}
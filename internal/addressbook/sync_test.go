@@ -0,0 +1,55 @@
+package addressbook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncStates(t *testing.T) {
+	s := newSyncStates()
+
+	states := []map[string]uint64{
+		{"a": 1, "b": 0},
+		{"a": 2, "b": 0, "c": 1},
+		{"b": 0, "c": 1},
+		{"b": 0, "c": 2, "d": 1},
+	}
+
+	tokens := make([]string, len(states))
+	for idx, state := range states {
+		tokens[idx] = s.current(state)
+	}
+
+	// only the changed customers are kept for older states
+	require.Len(t, s.older, len(states)-1)
+	require.Equal(t, map[string]uint64{"a": 1}, s.older[0].revisions)
+	require.Equal(t, []string{"c"}, s.older[0].absent)
+
+	for idx, token := range tokens {
+		revisions, ok := s.get(token)
+		require.True(t, ok)
+		require.Equal(t, states[idx], revisions)
+	}
+
+	_, ok := s.get(syncTokenPrefix + "unknown")
+	require.False(t, ok)
+}
+
+func TestSyncStatesLimit(t *testing.T) {
+	s := newSyncStates()
+
+	first := s.current(map[string]uint64{"a": 0})
+	for rev := uint64(1); rev < maxSyncStates; rev++ {
+		s.current(map[string]uint64{"a": rev})
+	}
+
+	_, ok := s.get(first)
+	require.True(t, ok)
+
+	s.current(map[string]uint64{"a": maxSyncStates})
+
+	_, ok = s.get(first)
+	require.False(t, ok)
+	require.Len(t, s.older, maxSyncStates-1)
+}
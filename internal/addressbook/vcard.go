@@ -0,0 +1,71 @@
+package addressbook
+
+import (
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+// customerToCard converts customer to a vCard 3.0 card.
+func customerToCard(customer *customerv1.Customer) vcard.Card {
+	card := make(vcard.Card)
+
+	card.SetValue(vcard.FieldVersion, "3.0")
+	card.SetValue(vcard.FieldUID, customer.Id)
+
+	card.SetName(&vcard.Name{
+		GivenName:  escapeComponent(customer.FirstName),
+		FamilyName: escapeComponent(customer.LastName),
+	})
+
+	// FN is required by vCard 3.0
+	name := strings.TrimSpace(customer.FirstName + " " + customer.LastName)
+	if name == "" {
+		switch {
+		case len(customer.PhoneNumbers) > 0:
+			name = customer.PhoneNumbers[0]
+		case len(customer.EmailAddresses) > 0:
+			name = customer.EmailAddresses[0]
+		default:
+			name = customer.Id
+		}
+	}
+	card.SetValue(vcard.FieldFormattedName, name)
+
+	for _, phone := range customer.PhoneNumbers {
+		card.Add(vcard.FieldTelephone, &vcard.Field{
+			Value: phone,
+			Params: vcard.Params{
+				vcard.ParamType: {vcard.TypeVoice},
+			},
+		})
+	}
+
+	for _, mail := range customer.EmailAddresses {
+		card.Add(vcard.FieldEmail, &vcard.Field{
+			Value: mail,
+			Params: vcard.Params{
+				vcard.ParamType: {"internet"},
+			},
+		})
+	}
+
+	for _, addr := range customer.Addresses {
+		card.AddAddress(&vcard.Address{
+			ExtendedAddress: escapeComponent(addr.Extra),
+			StreetAddress:   escapeComponent(addr.Street),
+			Locality:        escapeComponent(addr.City),
+			PostalCode:      escapeComponent(addr.PostalCode),
+		})
+	}
+
+	return card
+}
+
+// escapeComponent replaces the component separator of structured values
+// like N and ADR. go-vcard joins components without escaping them and
+// escapes backslashes when encoding so \; cannot be used.
+func escapeComponent(value string) string {
+	return strings.ReplaceAll(strings.TrimSpace(value), ";", ",")
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/sethvargo/go-envconfig"
 )
@@ -14,6 +15,44 @@ type Config struct {
 	AllowedOrigins     []string `env:"ALLOWED_ORIGINS, default=*"`
 	MongoDBURL         string   `env:"MONGO_URL"`
 	MongoDatabaseName  string   `env:"MONGO_DATABASE, default=customer-service"`
+
+	// LockTTL is the time after which a customer lock expires if it is not
+	// renewed, for example because customerd crashed. It must be at least
+	// one second.
+	LockTTL time.Duration `env:"LOCK_TTL, default=30s"`
+	// LockWaitTimeout is the maximum time to wait for a customer lock held
+	// by someone else.
+	LockWaitTimeout time.Duration `env:"LOCK_WAIT_TIMEOUT, default=10s"`
+
+	// DuplicateScanInterval configures how often customers are scanned for
+	// likely duplicates. Set to 0 to disable the duplicate detection.
+	DuplicateScanInterval time.Duration `env:"DUPLICATE_SCAN_INTERVAL, default=6h"`
+	// DuplicateMinScore is the minimum score (between 0 and 1) for a customer
+	// pair to be added to the duplicate review queue. With the default a
+	// shared phone number or e-mail address alone is not enough.
+	DuplicateMinScore float64 `env:"DUPLICATE_MIN_SCORE, default=0.5"`
+
+	// ImportMatchStrategy is a comma separated list of attributes that are used
+	// to match imported customers to existing records. Supported values are
+	// "phone", "email" and "name-address".
+	ImportMatchStrategy string `env:"IMPORT_MATCH_STRATEGY, default=phone,email"`
+
+	// ImportSessionWorkers is the number of messages processed concurrently
+	// per import session.
+	ImportSessionWorkers int `env:"IMPORT_SESSION_WORKERS, default=8"`
+	// ImportMaxConcurrency limits the number of messages processed concurrently
+	// across all import sessions. Set to 0 to disable the limit.
+	ImportMaxConcurrency int `env:"IMPORT_MAX_CONCURRENCY, default=32"`
+	// ImportBatchSize is the maximum number of customer writes of concurrently
+	// processed upserts that are stored with a single database request.
+	// Set to 0 to store every write on its own.
+	ImportBatchSize int `env:"IMPORT_BATCH_SIZE, default=32"`
+	// ImportBatchLatency is the maximum time a customer write waits for
+	// other writes to be stored with.
+	ImportBatchLatency time.Duration `env:"IMPORT_BATCH_LATENCY, default=5ms"`
+	// ImportSnapshotMaxRemove is the maximum fraction (between 0 and 1) of an
+	// importer's states that may be removed by a full snapshot session.
+	ImportSnapshotMaxRemove float64 `env:"IMPORT_SNAPSHOT_MAX_REMOVE, default=0.1"`
 }
 
 func LoadConfig(ctx context.Context) (*Config, error) {
@@ -0,0 +1,200 @@
+package duplicates
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// Signal names reported in repo.DuplicateCandidate.Signals.
+const (
+	SignalPhone        = "phone"
+	SignalEmail        = "email"
+	SignalNamePostal   = "name+postal-code"
+	SignalPhoneticName = "phonetic-name"
+)
+
+// signalWeights defines how much each signal contributes to the score of
+// a candidate pair. A shared phone number or e-mail address alone stays
+// below the default minimum score of 0.5 on purpose: family members and
+// employees of the same company often share them, so a pair is only
+// reported if the names sound alike as well or both contact signals match.
+var signalWeights = map[string]float64{
+	SignalPhone:        0.4,
+	SignalEmail:        0.4,
+	SignalNamePostal:   0.6,
+	SignalPhoneticName: 0.2,
+}
+
+// maxBucketSize limits the number of customers that share a single key
+// (like a phone number) to avoid a quadratic number of candidate pairs
+// for very common values.
+const maxBucketSize = 50
+
+// Detector finds likely duplicates in a list of customers.
+type Detector struct {
+	// MinScore is the minimum score a candidate pair must reach.
+	MinScore float64
+
+	// Region is the default region used to normalize phone numbers.
+	Region string
+}
+
+// Find returns all candidate pairs in customers that reach the configured
+// minimum score. The returned candidates are sorted by descending score
+// and have the state repo.DuplicatePending.
+func (d *Detector) Find(customers []*customerv1.Customer) []*repo.DuplicateCandidate {
+	keys := make([]customerKeys, len(customers))
+	buckets := make(map[string][]int)
+
+	for idx, c := range customers {
+		keys[idx] = d.keysFor(c)
+
+		for _, k := range keys[idx].all() {
+			buckets[k] = append(buckets[k], idx)
+		}
+	}
+
+	seen := make(map[[2]int]struct{})
+
+	var candidates []*repo.DuplicateCandidate
+	for _, members := range buckets {
+		if len(members) < 2 || len(members) > maxBucketSize {
+			continue
+		}
+
+		for i := 0; i < len(members); i++ {
+			for j := i + 1; j < len(members); j++ {
+				pair := [2]int{members[i], members[j]}
+				if _, ok := seen[pair]; ok {
+					continue
+				}
+				seen[pair] = struct{}{}
+
+				score, signals := compare(keys[pair[0]], keys[pair[1]])
+				if score < d.MinScore {
+					continue
+				}
+
+				a, b := customers[pair[0]].Id, customers[pair[1]].Id
+
+				candidates = append(candidates, &repo.DuplicateCandidate{
+					ID:        repo.DuplicateCandidateID(a, b),
+					CustomerA: a,
+					CustomerB: b,
+					Score:     score,
+					Signals:   signals,
+					State:     repo.DuplicatePending,
+				})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	return candidates
+}
+
+type customerKeys struct {
+	phones      []string
+	mails       []string
+	namePostals []string
+	phonetic    string
+}
+
+func (k customerKeys) all() []string {
+	var result []string
+
+	for _, p := range k.phones {
+		result = append(result, SignalPhone+":"+p)
+	}
+	for _, m := range k.mails {
+		result = append(result, SignalEmail+":"+m)
+	}
+	for _, n := range k.namePostals {
+		result = append(result, SignalNamePostal+":"+n)
+	}
+	if k.phonetic != "" {
+		result = append(result, SignalPhoneticName+":"+k.phonetic)
+	}
+
+	return result
+}
+
+func (d *Detector) keysFor(c *customerv1.Customer) customerKeys {
+	var k customerKeys
+
+	for _, phone := range c.PhoneNumbers {
+		normalized := phone
+
+		if parsed, err := phonenumbers.Parse(phone, d.Region); err == nil {
+			normalized = phonenumbers.Format(parsed, phonenumbers.E164)
+		}
+
+		k.phones = append(k.phones, normalized)
+	}
+
+	for _, mail := range c.EmailAddresses {
+		k.mails = append(k.mails, strings.ToLower(strings.TrimSpace(mail)))
+	}
+
+	name := strings.ToLower(strings.TrimSpace(c.FirstName) + " " + strings.TrimSpace(c.LastName))
+	if strings.TrimSpace(name) != "" {
+		for _, addr := range c.Addresses {
+			if addr.PostalCode != "" {
+				k.namePostals = append(k.namePostals, name+"|"+strings.TrimSpace(addr.PostalCode))
+			}
+		}
+
+		// both names are required for phonetic matches, otherwise we get
+		// way too many false positives.
+		first, last := ColognePhonetic(c.FirstName), ColognePhonetic(c.LastName)
+		if first != "" && last != "" {
+			k.phonetic = first + " " + last
+		}
+	}
+
+	return k
+}
+
+func compare(a, b customerKeys) (float64, []string) {
+	var (
+		score   float64
+		signals []string
+	)
+
+	add := func(signal string, matched bool) {
+		if matched {
+			score += signalWeights[signal]
+			signals = append(signals, signal)
+		}
+	}
+
+	add(SignalPhone, intersects(a.phones, b.phones))
+	add(SignalEmail, intersects(a.mails, b.mails))
+	add(SignalNamePostal, intersects(a.namePostals, b.namePostals))
+	add(SignalPhoneticName, a.phonetic != "" && a.phonetic == b.phonetic)
+
+	if score > 1 {
+		score = 1
+	}
+
+	return score, signals
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package duplicates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+func TestColognePhonetic(t *testing.T) {
+	cases := map[string]string{
+		"Wikipedia":           "3412",
+		"Müller-Lüdenscheidt": "65752682",
+		"Maier":               "67",
+		"Meyer":               "67",
+		"":                    "",
+	}
+
+	for input, expected := range cases {
+		require.Equal(t, expected, ColognePhonetic(input), input)
+	}
+}
+
+func TestDetectorFind(t *testing.T) {
+	d := &Detector{MinScore: 0.5, Region: "AT"}
+
+	customers := []*customerv1.Customer{
+		{
+			Id:           "1",
+			FirstName:    "Anna",
+			LastName:     "Maier",
+			PhoneNumbers: []string{"+43 660 1234567"},
+			Addresses:    []*customerv1.Address{{PostalCode: "3843", City: "Dobersberg"}},
+		},
+		{
+			Id:             "2",
+			FirstName:      "Anna",
+			LastName:       "Meyer",
+			PhoneNumbers:   []string{"0660 1234567"},
+			EmailAddresses: []string{"anna@example.com"},
+		},
+		{
+			Id:             "3",
+			FirstName:      "anna",
+			LastName:       "maier",
+			EmailAddresses: []string{"Anna@example.com"},
+			Addresses:      []*customerv1.Address{{PostalCode: "3843", City: "Dobersberg"}},
+		},
+		{
+			Id:        "4",
+			FirstName: "Bernd",
+			LastName:  "Huber",
+		},
+	}
+
+	candidates := d.Find(customers)
+
+	byId := make(map[string][]string)
+	for _, c := range candidates {
+		byId[c.ID] = c.Signals
+	}
+
+	require.Len(t, candidates, 3)
+	require.ElementsMatch(t, []string{SignalPhone, SignalPhoneticName}, byId["1:2"])
+	require.ElementsMatch(t, []string{SignalEmail, SignalPhoneticName}, byId["2:3"])
+	require.ElementsMatch(t, []string{SignalNamePostal, SignalPhoneticName}, byId["1:3"])
+}
+
+func TestDetectorFindPhoneOnly(t *testing.T) {
+	customers := []*customerv1.Customer{
+		{
+			Id:           "1",
+			FirstName:    "Anna",
+			LastName:     "Maier",
+			PhoneNumbers: []string{"+43 660 1234567"},
+		},
+		{
+			Id:           "2",
+			FirstName:    "Bernd",
+			LastName:     "Huber",
+			PhoneNumbers: []string{"0660 1234567"},
+		},
+	}
+
+	// a shared phone number alone does not reach the default minimum score
+	d := &Detector{MinScore: 0.5, Region: "AT"}
+	require.Empty(t, d.Find(customers))
+
+	d.MinScore = 0.4
+	candidates := d.Find(customers)
+	require.Len(t, candidates, 1)
+	require.Equal(t, []string{SignalPhone}, candidates[0].Signals)
+	require.InDelta(t, 0.4, candidates[0].Score, 0.001)
+}
@@ -0,0 +1,108 @@
+package duplicates
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// Job periodically scans all customers for likely duplicates and adds
+// them to the duplicate review queue.
+type Job struct {
+	repo     repo.Repo
+	detector *Detector
+	interval time.Duration
+}
+
+func NewJob(repo repo.Repo, detector *Detector, interval time.Duration) *Job {
+	return &Job{
+		repo:     repo,
+		detector: detector,
+		interval: interval,
+	}
+}
+
+// Run scans for duplicates immediately and then once per interval until ctx
+// is cancelled.
+func (job *Job) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job.Scan(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to scan for duplicate customers", slog.Any("error", err.Error()))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Scan performs a single scan and stores all new candidates in the
+// review queue.
+func (job *Job) Scan(ctx context.Context) error {
+	results, _, err := job.repo.ListCustomers(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to list customers: %w", err)
+	}
+
+	customers := make([]*customerv1.Customer, len(results))
+	exists := make(map[string]struct{}, len(results))
+	for idx, r := range results {
+		customers[idx] = r.Customer
+		exists[r.Customer.Id] = struct{}{}
+	}
+
+	if err := job.closeStale(ctx, exists); err != nil {
+		return err
+	}
+
+	candidates := job.detector.Find(customers)
+
+	now := time.Now()
+	for _, c := range candidates {
+		c.CreatedAt = now
+
+		if err := job.repo.StoreDuplicateCandidate(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	slog.InfoContext(ctx, "duplicate scan complete", slog.Any("customers", len(customers)), slog.Any("candidates", len(candidates)))
+
+	return nil
+}
+
+// closeStale marks all pending candidates as obsolete if one of their
+// customers does not exist anymore, for example because it has been merged
+// into another customer.
+func (job *Job) closeStale(ctx context.Context, exists map[string]struct{}) error {
+	pending, err := job.repo.ListDuplicateCandidates(ctx, repo.DuplicatePending)
+	if err != nil {
+		return fmt.Errorf("failed to list pending duplicate candidates: %w", err)
+	}
+
+	for _, c := range pending {
+		_, hasA := exists[c.CustomerA]
+		_, hasB := exists[c.CustomerB]
+
+		if hasA && hasB {
+			continue
+		}
+
+		if err := job.repo.SetDuplicateCandidateState(ctx, c.ID, repo.DuplicateObsolete); err != nil {
+			return fmt.Errorf("failed to close stale duplicate candidate %s: %w", c.ID, err)
+		}
+
+		slog.InfoContext(ctx, "closed stale duplicate candidate", slog.Any("id", c.ID))
+	}
+
+	return nil
+}
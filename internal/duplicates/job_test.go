@@ -0,0 +1,50 @@
+package duplicates
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+func TestScanClosesStaleCandidates(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	a := &customerv1.Customer{FirstName: "Anna", LastName: "Maier"}
+	b := &customerv1.Customer{FirstName: "Bernd", LastName: "Huber"}
+
+	for _, c := range []*customerv1.Customer{a, b} {
+		_, err := store.StoreCustomer(ctx, c, nil, 0)
+		require.NoError(t, err)
+	}
+
+	candidate := &repo.DuplicateCandidate{
+		ID:        repo.DuplicateCandidateID(a.Id, b.Id),
+		CustomerA: a.Id,
+		CustomerB: b.Id,
+		State:     repo.DuplicatePending,
+	}
+	require.NoError(t, store.StoreDuplicateCandidate(ctx, candidate))
+
+	job := NewJob(store, &Detector{MinScore: 0.5, Region: "AT"}, time.Hour)
+
+	// both customers exist
+	require.NoError(t, job.Scan(ctx))
+
+	c, err := store.GetDuplicateCandidate(ctx, candidate.ID)
+	require.NoError(t, err)
+	require.Equal(t, repo.DuplicatePending, c.State)
+
+	// b has been merged into another customer
+	require.NoError(t, store.DeleteCustomer(ctx, b.Id))
+	require.NoError(t, job.Scan(ctx))
+
+	c, err = store.GetDuplicateCandidate(ctx, candidate.ID)
+	require.NoError(t, err)
+	require.Equal(t, repo.DuplicateObsolete, c.State)
+}
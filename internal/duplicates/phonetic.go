@@ -0,0 +1,107 @@
+package duplicates
+
+import "strings"
+
+var umlauts = strings.NewReplacer(
+	"Ä", "A",
+	"Ö", "O",
+	"Ü", "U",
+	"ß", "S",
+)
+
+// ColognePhonetic returns the "Kölner Phonetik" code of s. Names that
+// sound alike in German (like "Maier", "Meyer" and "Mayr") share the
+// same code.
+func ColognePhonetic(s string) string {
+	s = umlauts.Replace(strings.ToUpper(s))
+
+	var letters []byte
+	for _, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, byte(r))
+		}
+	}
+
+	var codes []byte
+	for i, c := range letters {
+		var prev, next byte
+		if i > 0 {
+			prev = letters[i-1]
+		}
+		if i < len(letters)-1 {
+			next = letters[i+1]
+		}
+
+		var code string
+		switch c {
+		case 'A', 'E', 'I', 'J', 'O', 'U', 'Y':
+			code = "0"
+		case 'H':
+			code = ""
+		case 'B':
+			code = "1"
+		case 'P':
+			if next == 'H' {
+				code = "3"
+			} else {
+				code = "1"
+			}
+		case 'D', 'T':
+			if strings.IndexByte("CSZ", next) >= 0 && next != 0 {
+				code = "8"
+			} else {
+				code = "2"
+			}
+		case 'F', 'V', 'W':
+			code = "3"
+		case 'G', 'K', 'Q':
+			code = "4"
+		case 'C':
+			switch {
+			case i == 0:
+				if next != 0 && strings.IndexByte("AHKLOQRUX", next) >= 0 {
+					code = "4"
+				} else {
+					code = "8"
+				}
+			case prev == 'S' || prev == 'Z':
+				code = "8"
+			case next != 0 && strings.IndexByte("AHKOQUX", next) >= 0:
+				code = "4"
+			default:
+				code = "8"
+			}
+		case 'X':
+			if prev != 0 && strings.IndexByte("CKQ", prev) >= 0 {
+				code = "8"
+			} else {
+				code = "48"
+			}
+		case 'L':
+			code = "5"
+		case 'M', 'N':
+			code = "6"
+		case 'R':
+			code = "7"
+		case 'S', 'Z':
+			code = "8"
+		}
+
+		// collapse adjacent duplicate codes
+		for j := 0; j < len(code); j++ {
+			if len(codes) == 0 || codes[len(codes)-1] != code[j] {
+				codes = append(codes, code[j])
+			}
+		}
+	}
+
+	// remove all vowel codes except at the very beginning
+	result := make([]byte, 0, len(codes))
+	for i, c := range codes {
+		if c != '0' || i == 0 {
+			result = append(result, c)
+		}
+	}
+
+	return string(result)
+}
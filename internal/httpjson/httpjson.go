@@ -0,0 +1,43 @@
+// Package httpjson contains helpers for the plain HTTP/JSON endpoints of
+// customerd that are not (yet) covered by the protobuf service definitions.
+package httpjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Decode decodes the JSON request body into v. It writes an error response
+// and returns false if the request method does not match method or the body
+// is invalid.
+func Decode(w http.ResponseWriter, req *http.Request, method string, v any) bool {
+	if req.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// Write writes response as JSON.
+func Write(w http.ResponseWriter, req *http.Request, response any) {
+	blob, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(blob); err != nil {
+		slog.ErrorContext(req.Context(), "failed to write response", slog.Any("error", err.Error()))
+	}
+}
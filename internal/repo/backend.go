@@ -15,18 +15,92 @@ func Clone[T proto.Message](a T) T {
 }
 
 type Backend interface {
-	// StoreCustomer upserts a customer record into the database.
-	StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState) error
-
-	// LockCustomer locks a customer record.
+	// StoreCustomer upserts a customer record into the database and returns
+	// the new revision of the record. Existing records are only replaced if
+	// their stored revision still equals revision, otherwise
+	// ErrRevisionConflict is returned. Records stored before revisions were
+	// introduced have revision 0.
+	StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error)
+
+	// DeleteCustomer deletes a customer record.
+	DeleteCustomer(ctx context.Context, id string) error
+
+	// LockCustomer locks a customer record. If the customer is already locked,
+	// LockCustomer waits until the lock is released, ctx is cancelled or the
+	// configured wait timeout is exceeded.
 	LockCustomer(ctx context.Context, id string) (func(), error)
 
+	// ListLocks returns all customer locks that are currently held.
+	ListLocks(ctx context.Context) ([]*CustomerLock, error)
+
+	// BreakLock forcefully releases the lock held on a customer record.
+	BreakLock(ctx context.Context, id string) error
+
+	// AddMatchExclusion marks the import state identified by importer and ref
+	// so it is never automatically matched to the customer with the given id
+	// again.
+	AddMatchExclusion(ctx context.Context, customerId, importer, ref string) error
+
+	// IsMatchExcluded reports whether the import state identified by importer
+	// and ref must not be automatically matched to the given customer.
+	IsMatchExcluded(ctx context.Context, customerId, importer, ref string) (bool, error)
+
+	// Duplicate review queue
+
+	// StoreDuplicateCandidate adds a new candidate to the duplicate review queue.
+	// Candidates that already exist are left untouched so review decisions are
+	// never overwritten.
+	StoreDuplicateCandidate(ctx context.Context, candidate *DuplicateCandidate) error
+
+	// ListDuplicateCandidates returns all duplicate candidates with the given
+	// state, ordered by descending score.
+	ListDuplicateCandidates(ctx context.Context, state DuplicateState) ([]*DuplicateCandidate, error)
+
+	GetDuplicateCandidate(ctx context.Context, id string) (*DuplicateCandidate, error)
+
+	// SetDuplicateCandidateState updates the review state of a duplicate candidate.
+	SetDuplicateCandidateState(ctx context.Context, id string, state DuplicateState) error
+
+	// Import review list
+
+	// StorePendingUpsert parks an upsert that needs manual review. An existing
+	// pending upsert with the same ID is replaced.
+	StorePendingUpsert(ctx context.Context, pending *PendingUpsert) error
+
+	ListPendingUpserts(ctx context.Context) ([]*PendingUpsert, error)
+	GetPendingUpsert(ctx context.Context, id string) (*PendingUpsert, error)
+	DeletePendingUpsert(ctx context.Context, id string) error
+
+	// Import run history
+
+	// StoreImportRun creates or replaces an import run record.
+	StoreImportRun(ctx context.Context, run *ImportRun) error
+
+	// StoreImportCheckpoint updates the checkpoint, summary, error messages
+	// and diffs of an existing import run and appends touched to its touched
+	// references. The stored touched references are not replaced.
+	StoreImportCheckpoint(ctx context.Context, run *ImportRun, touched []string) error
+
+	// ListImportRuns returns the most recent import runs of importer, newest
+	// first. If importer is empty the runs of all importers are returned.
+	// A limit of zero returns all runs. The error messages, changes and
+	// touched references of the runs are omitted.
+	ListImportRuns(ctx context.Context, importer string, limit int) ([]*ImportRun, error)
+
+	GetImportRun(ctx context.Context, id string) (*ImportRun, error)
+
 	// Lookup methds
 
 	ListCustomers(ctx context.Context, pagination *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error)
 
-	LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, error)
-	LookupCustomerByRef(ctx context.Context, importer, ref string) (*customerv1.Customer, []*customerv1.ImportState, error)
+	// ListCustomerRevisions returns the current revision of all customers
+	// keyed by the customer id.
+	ListCustomerRevisions(ctx context.Context) (map[string]uint64, error)
+
+	// LookupCustomerById and LookupCustomerByRef also return the current
+	// revision of the customer record which must be passed to StoreCustomer.
+	LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error)
+	LookupCustomerByRef(ctx context.Context, importer, ref string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error)
 
 	LookupCustomerByName(ctx context.Context, name string, pagination *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error)
 	LookupCustomerByPhone(ctx context.Context, phone string, pagination *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error)
@@ -37,6 +111,7 @@ type Repo interface {
 	Backend
 	SingleQueryRunnger
 	MultiQueryRunner
+	BatchWriter
 }
 
 type SingleQueryRunnger interface {
@@ -47,6 +122,20 @@ type MultiQueryRunner interface {
 	SearchQueries(ctx context.Context, queries []*customerv1.CustomerQuery, p *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error)
 }
 
+// CustomerWrite holds the arguments of a single StoreCustomer call.
+type CustomerWrite struct {
+	Customer *customerv1.Customer
+	States   []*customerv1.ImportState
+	Revision uint64
+}
+
+type BatchWriter interface {
+	// StoreCustomers stores all writes like StoreCustomer and returns the
+	// new revision and the error of each write. Writes are independent of
+	// each other so a failed write does not affect the others.
+	StoreCustomers(ctx context.Context, writes []CustomerWrite) ([]uint64, []error)
+}
+
 type repo struct {
 	Backend
 }
@@ -92,6 +181,23 @@ func (r *repo) SearchQueries(ctx context.Context, queries []*customerv1.Customer
 	return cleanedResult, len(cleanedResult), nil
 }
 
+func (r *repo) StoreCustomers(ctx context.Context, writes []CustomerWrite) ([]uint64, []error) {
+	if cap, ok := r.Backend.(BatchWriter); ok {
+		return cap.StoreCustomers(ctx, writes)
+	}
+
+	var (
+		revisions = make([]uint64, len(writes))
+		errs      = make([]error, len(writes))
+	)
+
+	for idx, w := range writes {
+		revisions[idx], errs[idx] = r.StoreCustomer(ctx, w.Customer, w.States, w.Revision)
+	}
+
+	return revisions, errs
+}
+
 func (r *repo) SearchQuery(ctx context.Context, query *customerv1.CustomerQuery, p *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error) {
 	if cap, ok := r.Backend.(SingleQueryRunnger); ok {
 		return cap.SearchQuery(ctx, query, p)
@@ -106,7 +212,7 @@ func (r *repo) SearchQuery(ctx context.Context, query *customerv1.CustomerQuery,
 
 	switch v := query.Query.(type) {
 	case *customerv1.CustomerQuery_Id:
-		c, states, err := r.LookupCustomerById(ctx, v.Id)
+		c, states, _, err := r.LookupCustomerById(ctx, v.Id)
 		if err != nil && !errors.Is(err, ErrCustomerNotFound) {
 			return nil, 0, err
 		}
@@ -119,7 +225,7 @@ func (r *repo) SearchQuery(ctx context.Context, query *customerv1.CustomerQuery,
 		}
 
 	case *customerv1.CustomerQuery_InternalReference:
-		c, states, err := r.LookupCustomerByRef(ctx, v.InternalReference.Importer, v.InternalReference.Ref)
+		c, states, _, err := r.LookupCustomerByRef(ctx, v.InternalReference.Importer, v.InternalReference.Ref)
 		if err != nil && !errors.Is(err, ErrCustomerNotFound) {
 			return nil, 0, err
 		}
@@ -0,0 +1,47 @@
+package repo
+
+import "time"
+
+// DuplicateState describes the review state of a DuplicateCandidate.
+type DuplicateState string
+
+const (
+	DuplicatePending  DuplicateState = "pending"
+	DuplicateAccepted DuplicateState = "accepted"
+	DuplicateRejected DuplicateState = "rejected"
+
+	// DuplicateObsolete marks candidates of which at least one customer
+	// has been deleted or merged into another one.
+	DuplicateObsolete DuplicateState = "obsolete"
+)
+
+// DuplicateCandidate is a pair of customer records that are likely
+// duplicates of each other and need to be reviewed.
+type DuplicateCandidate struct {
+	// ID uniquely identifies the customer pair. See DuplicateCandidateID.
+	ID string `json:"id" bson:"_id"`
+
+	CustomerA string `json:"customerA" bson:"customerA"`
+	CustomerB string `json:"customerB" bson:"customerB"`
+
+	// Score is a value between 0 and 1 describing how likely both
+	// customers are duplicates.
+	Score float64 `json:"score" bson:"score"`
+
+	// Signals holds the names of all signals that matched.
+	Signals []string `json:"signals" bson:"signals"`
+
+	State     DuplicateState `json:"state" bson:"state"`
+	CreatedAt time.Time      `json:"createdAt" bson:"createdAt"`
+	DecidedAt time.Time      `json:"decidedAt,omitempty" bson:"decidedAt,omitempty"`
+}
+
+// DuplicateCandidateID returns the ID of the duplicate candidate for the
+// given customer pair. The ID does not depend on the order of a and b.
+func DuplicateCandidateID(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+
+	return a + ":" + b
+}
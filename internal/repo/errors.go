@@ -3,6 +3,15 @@ package repo
 import "errors"
 
 var (
-	ErrCustomerNotFound = errors.New("customer not found")
-	ErrCustomerLocked   = errors.New("customer already locked")
+	ErrCustomerNotFound  = errors.New("customer not found")
+	ErrCustomerLocked    = errors.New("customer already locked")
+	ErrDuplicateNotFound = errors.New("duplicate candidate not found")
+	ErrPendingNotFound   = errors.New("pending upsert not found")
+	ErrLockNotFound      = errors.New("customer lock not found")
+	ErrImportRunNotFound = errors.New("import run not found")
+	ErrRevisionConflict  = errors.New("customer has been modified concurrently")
+
+	// ErrDuplicateImportState is returned by StoreCustomer if one of the
+	// import states already belongs to a different customer.
+	ErrDuplicateImportState = errors.New("import state already belongs to another customer")
 )
@@ -2,8 +2,11 @@ package inmem
 
 import (
 	"context"
+	"maps"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	commonv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/common/v1"
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
@@ -16,57 +19,364 @@ type Repository struct {
 
 	customers map[string]*customerv1.Customer
 	states    map[string][]*customerv1.ImportState
+	revisions map[string]uint64
 
-	locks map[string]string
+	locks map[string]*repo.CustomerLock
+
+	exclusions map[matchExclusion]struct{}
+
+	duplicates map[string]*repo.DuplicateCandidate
+
+	pending map[string]*repo.PendingUpsert
+
+	runs map[string]*repo.ImportRun
+}
+
+type matchExclusion struct {
+	customerId string
+	importer   string
+	ref        string
 }
 
 func New() *Repository {
 	return &Repository{
-		customers: make(map[string]*customerv1.Customer),
-		states:    make(map[string][]*customerv1.ImportState),
-		locks:     make(map[string]string),
+		customers:  make(map[string]*customerv1.Customer),
+		states:     make(map[string][]*customerv1.ImportState),
+		revisions:  make(map[string]uint64),
+		locks:      make(map[string]*repo.CustomerLock),
+		exclusions: make(map[matchExclusion]struct{}),
+		duplicates: make(map[string]*repo.DuplicateCandidate),
+		pending:    make(map[string]*repo.PendingUpsert),
+		runs:       make(map[string]*repo.ImportRun),
 	}
 }
 
 func (r *Repository) LockCustomer(ctx context.Context, id string) (func(), error) {
-	r.l.Lock()
-	defer r.l.Unlock()
-
-	if _, ok := r.locks[id]; ok {
-		return func() {}, repo.ErrCustomerLocked
+	lock := &repo.CustomerLock{
+		CustomerID: id,
+		Owner:      repo.LockOwner(ctx),
+		LeaseID:    importer.GenerateCorrelationId(32),
 	}
 
-	lockId := importer.GenerateCorrelationId(32)
-	r.locks[id] = lockId
+	// in-memory locks cannot outlive the process so there's no need
+	// for them to expire.
+	err := repo.RetryLock(ctx, repo.DefaultLockOptions, func() (bool, error) {
+		r.l.Lock()
+		defer r.l.Unlock()
+
+		if _, ok := r.locks[id]; ok {
+			return false, nil
+		}
+
+		lock.LockedAt = time.Now()
+		r.locks[id] = lock
+
+		return true, nil
+	})
+	if err != nil {
+		return func() {}, err
+	}
 
 	return func() {
 		r.l.Lock()
 		defer r.l.Unlock()
 
-		storedLockId := r.locks[id]
-		if storedLockId != lockId {
-			panic("customer locks are invalid")
+		if stored, ok := r.locks[id]; ok && stored.LeaseID == lock.LeaseID {
+			delete(r.locks, id)
 		}
-
-		delete(r.locks, id)
 	}, nil
 }
 
-func (r *Repository) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState) error {
+func (r *Repository) ListLocks(ctx context.Context) ([]*repo.CustomerLock, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	results := make([]*repo.CustomerLock, 0, len(r.locks))
+	for _, l := range r.locks {
+		cpy := *l
+		results = append(results, &cpy)
+	}
+
+	return results, nil
+}
+
+func (r *Repository) BreakLock(ctx context.Context, id string) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if _, ok := r.locks[id]; !ok {
+		return repo.ErrLockNotFound
+	}
+
+	delete(r.locks, id)
+
+	return nil
+}
+
+func (r *Repository) AddMatchExclusion(ctx context.Context, customerId, importer, ref string) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.exclusions[matchExclusion{customerId, importer, ref}] = struct{}{}
+
+	return nil
+}
+
+func (r *Repository) IsMatchExcluded(ctx context.Context, customerId, importer, ref string) (bool, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	_, ok := r.exclusions[matchExclusion{customerId, importer, ref}]
+
+	return ok, nil
+}
+
+func (r *Repository) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error) {
 	r.l.Lock()
 	defer r.l.Unlock()
 
+	if customer.Id != "" {
+		if current := r.revisions[customer.Id]; current != revision {
+			return current, repo.ErrRevisionConflict
+		}
+	}
+
+	// import states must be unique, just like the index in mongodb
+	for id, existing := range r.states {
+		if id == customer.Id {
+			continue
+		}
+
+		for _, e := range existing {
+			for _, s := range states {
+				if e.Importer == s.Importer && e.InternalReference == s.InternalReference {
+					return 0, repo.ErrDuplicateImportState
+				}
+			}
+		}
+	}
+
 	if customer.Id == "" {
 		customer.Id = importer.GenerateCorrelationId(32)
+		revision = 0
 	}
 
 	r.customers[customer.Id] = customer
 	r.states[customer.Id] = states
+	r.revisions[customer.Id] = revision + 1
+
+	return revision + 1, nil
+}
+
+func (r *Repository) DeleteCustomer(ctx context.Context, id string) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if _, ok := r.customers[id]; !ok {
+		return repo.ErrCustomerNotFound
+	}
+
+	delete(r.customers, id)
+	delete(r.states, id)
+	delete(r.revisions, id)
+
+	return nil
+}
+
+func (r *Repository) StoreDuplicateCandidate(ctx context.Context, candidate *repo.DuplicateCandidate) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if _, ok := r.duplicates[candidate.ID]; ok {
+		return nil
+	}
+
+	c := *candidate
+	r.duplicates[c.ID] = &c
 
 	return nil
 }
 
-func (r *Repository) LookupCustomerByRef(ctx context.Context, importer string, internalRef string) (*customerv1.Customer, []*customerv1.ImportState, error) {
+func (r *Repository) ListDuplicateCandidates(ctx context.Context, state repo.DuplicateState) ([]*repo.DuplicateCandidate, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	var results []*repo.DuplicateCandidate
+	for _, c := range r.duplicates {
+		if c.State == state {
+			cpy := *c
+			results = append(results, &cpy)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+
+	return results, nil
+}
+
+func (r *Repository) GetDuplicateCandidate(ctx context.Context, id string) (*repo.DuplicateCandidate, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	c, ok := r.duplicates[id]
+	if !ok {
+		return nil, repo.ErrDuplicateNotFound
+	}
+
+	cpy := *c
+
+	return &cpy, nil
+}
+
+func (r *Repository) SetDuplicateCandidateState(ctx context.Context, id string, state repo.DuplicateState) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	c, ok := r.duplicates[id]
+	if !ok {
+		return repo.ErrDuplicateNotFound
+	}
+
+	c.State = state
+	c.DecidedAt = time.Now()
+
+	return nil
+}
+
+func (r *Repository) StorePendingUpsert(ctx context.Context, pending *repo.PendingUpsert) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.pending[pending.ID] = clonePending(pending)
+
+	return nil
+}
+
+func (r *Repository) ListPendingUpserts(ctx context.Context) ([]*repo.PendingUpsert, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	results := make([]*repo.PendingUpsert, 0, len(r.pending))
+	for _, p := range r.pending {
+		results = append(results, clonePending(p))
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedAt.Before(results[j].CreatedAt)
+	})
+
+	return results, nil
+}
+
+func (r *Repository) GetPendingUpsert(ctx context.Context, id string) (*repo.PendingUpsert, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	p, ok := r.pending[id]
+	if !ok {
+		return nil, repo.ErrPendingNotFound
+	}
+
+	return clonePending(p), nil
+}
+
+func (r *Repository) DeletePendingUpsert(ctx context.Context, id string) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if _, ok := r.pending[id]; !ok {
+		return repo.ErrPendingNotFound
+	}
+
+	delete(r.pending, id)
+
+	return nil
+}
+
+func (r *Repository) StoreImportRun(ctx context.Context, run *repo.ImportRun) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.runs[run.ID] = cloneRun(run)
+
+	return nil
+}
+
+func (r *Repository) StoreImportCheckpoint(ctx context.Context, run *repo.ImportRun, touched []string) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	stored, ok := r.runs[run.ID]
+	if !ok {
+		return repo.ErrImportRunNotFound
+	}
+
+	cpy := cloneRun(run)
+	cpy.Touched = append(stored.Touched, touched...)
+
+	r.runs[run.ID] = cpy
+
+	return nil
+}
+
+func (r *Repository) ListImportRuns(ctx context.Context, importer string, limit int) ([]*repo.ImportRun, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	var results []*repo.ImportRun
+	for _, run := range r.runs {
+		if importer == "" || run.Importer == importer {
+			cpy := cloneRun(run)
+			cpy.Errors, cpy.Diffs, cpy.Touched = nil, nil, nil
+
+			results = append(results, cpy)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StartedAt.After(results[j].StartedAt)
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func (r *Repository) GetImportRun(ctx context.Context, id string) (*repo.ImportRun, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	run, ok := r.runs[id]
+	if !ok {
+		return nil, repo.ErrImportRunNotFound
+	}
+
+	return cloneRun(run), nil
+}
+
+func cloneRun(run *repo.ImportRun) *repo.ImportRun {
+	cpy := *run
+	cpy.Summary.Matches = maps.Clone(run.Summary.Matches)
+	cpy.Errors = append([]string(nil), run.Errors...)
+	cpy.Diffs = append([]importer.RecordDiff(nil), run.Diffs...)
+	cpy.Touched = append([]string(nil), run.Touched...)
+
+	return &cpy
+}
+
+func clonePending(p *repo.PendingUpsert) *repo.PendingUpsert {
+	cpy := *p
+	cpy.Upsert = repo.Clone(p.Upsert)
+	cpy.Candidates = append([]string(nil), p.Candidates...)
+
+	return &cpy
+}
+
+func (r *Repository) LookupCustomerByRef(ctx context.Context, importer string, internalRef string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error) {
 	r.l.RLock()
 	defer r.l.RUnlock()
 
@@ -84,26 +394,26 @@ func (r *Repository) LookupCustomerByRef(ctx context.Context, importer string, i
 	}
 
 	if existingCustomer == nil {
-		return nil, nil, repo.ErrCustomerNotFound
+		return nil, nil, 0, repo.ErrCustomerNotFound
 	}
 
 	customerClone := repo.Clone(existingCustomer)
 
-	return customerClone, r.cloneCustomerStates(customerClone.Id), nil
+	return customerClone, r.cloneCustomerStates(customerClone.Id), r.revisions[customerClone.Id], nil
 }
 
-func (r *Repository) LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, error) {
+func (r *Repository) LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error) {
 	r.l.RLock()
 	defer r.l.RUnlock()
 
 	customer, ok := r.customers[id]
 	if !ok {
-		return nil, nil, repo.ErrCustomerNotFound
+		return nil, nil, 0, repo.ErrCustomerNotFound
 	}
 
 	customerClone := repo.Clone(customer)
 
-	return customerClone, r.cloneCustomerStates(customerClone.Id), nil
+	return customerClone, r.cloneCustomerStates(customerClone.Id), r.revisions[id], nil
 }
 
 func (r *Repository) LookupCustomerByMail(ctx context.Context, mail string, _ *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error) {
@@ -191,4 +501,16 @@ func (r *Repository) ListCustomers(_ context.Context, _ *commonv1.Pagination) ([
 	return results, len(results), nil
 }
 
+func (r *Repository) ListCustomerRevisions(_ context.Context) (map[string]uint64, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	revisions := make(map[string]uint64, len(r.customers))
+	for id := range r.customers {
+		revisions[id] = r.revisions[id]
+	}
+
+	return revisions, nil
+}
+
 var _ repo.Backend = (*Repository)(nil)
@@ -0,0 +1,117 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+func TestLockCustomerWaits(t *testing.T) {
+	r := New()
+
+	unlock, err := r.LockCustomer(context.Background(), "customer")
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlock()
+	}()
+
+	start := time.Now()
+	unlock2, err := r.LockCustomer(context.Background(), "customer")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = r.LockCustomer(ctx, "customer")
+	require.ErrorIs(t, err, repo.ErrCustomerLocked)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlock2()
+}
+
+func TestBreakLock(t *testing.T) {
+	r := New()
+	ctx := repo.WithLockOwner(context.Background(), "test")
+
+	unlock, err := r.LockCustomer(ctx, "customer")
+	require.NoError(t, err)
+
+	locks, err := r.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	require.Contains(t, locks[0].Owner, "test@")
+
+	require.NoError(t, r.BreakLock(ctx, "customer"))
+	require.ErrorIs(t, r.BreakLock(ctx, "customer"), repo.ErrLockNotFound)
+
+	unlock2, err := r.LockCustomer(ctx, "customer")
+	require.NoError(t, err)
+
+	// releasing the broken lock must not release the new one
+	unlock()
+
+	locks, err = r.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+
+	unlock2()
+}
+
+func TestStoreCustomerRevision(t *testing.T) {
+	r := New()
+	ctx := context.Background()
+
+	customer := &customerv1.Customer{LastName: "Doe"}
+
+	rev, err := r.StoreCustomer(ctx, customer, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rev)
+
+	_, _, current, err := r.LookupCustomerById(ctx, customer.Id)
+	require.NoError(t, err)
+	require.Equal(t, rev, current)
+
+	rev, err = r.StoreCustomer(ctx, customer, nil, current)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rev)
+
+	// storing with the outdated revision must fail
+	_, err = r.StoreCustomer(ctx, customer, nil, current)
+	require.ErrorIs(t, err, repo.ErrRevisionConflict)
+}
+
+func TestListImportRuns(t *testing.T) {
+	r := New()
+	ctx := context.Background()
+
+	now := time.Now()
+	for idx, importer := range []string{"vetinf", "carddav", "vetinf"} {
+		require.NoError(t, r.StoreImportRun(ctx, &repo.ImportRun{
+			ID:        fmt.Sprintf("run-%d", idx),
+			Importer:  importer,
+			State:     repo.ImportRunCompleted,
+			StartedAt: now.Add(time.Duration(idx) * time.Minute),
+		}))
+	}
+
+	runs, err := r.ListImportRuns(ctx, "vetinf", 0)
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, "run-2", runs[0].ID)
+
+	runs, err = r.ListImportRuns(ctx, "", 1)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.Equal(t, "run-2", runs[0].ID)
+
+	_, err = r.GetImportRun(ctx, "unknown")
+	require.ErrorIs(t, err, repo.ErrImportRunNotFound)
+}
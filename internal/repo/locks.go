@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CustomerLock describes a lock held on a customer record.
+type CustomerLock struct {
+	CustomerID string `json:"customerId" bson:"id"`
+
+	// Owner describes who acquired the lock. See WithLockOwner.
+	Owner string `json:"owner" bson:"owner"`
+
+	// LeaseID is unique for each acquired lock and is used to ensure
+	// a lock is only released or renewed by it's owner.
+	LeaseID string `json:"leaseId" bson:"leaseId"`
+
+	LockedAt time.Time `json:"lockedAt" bson:"lockedAt"`
+
+	// ExpiresAt is the time at which the lock is considered stale if it is
+	// not renewed. A zero value means the lock never expires.
+	ExpiresAt time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+}
+
+// Stale reports whether the lock has expired.
+func (l *CustomerLock) Stale(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && l.ExpiresAt.Before(now)
+}
+
+// LockOptions configures customer locks.
+type LockOptions struct {
+	// TTL is the time after which a lock expires if it is not renewed
+	// by the lock owner. Backends renew locks while they are held.
+	TTL time.Duration
+
+	// WaitTimeout is the maximum time LockCustomer waits for a lock
+	// held by someone else to be released.
+	WaitTimeout time.Duration
+}
+
+var DefaultLockOptions = LockOptions{
+	TTL:         30 * time.Second,
+	WaitTimeout: 10 * time.Second,
+}
+
+// MinLockTTL is the shortest TTL accepted by LockOptions.Normalize. Locks
+// are renewed three times per TTL so shorter values would flood the
+// backend.
+const MinLockTTL = time.Second
+
+// Normalize returns opts with a zero TTL replaced by the TTL of
+// DefaultLockOptions. It fails if the TTL is negative or shorter than
+// MinLockTTL. A zero WaitTimeout waits without a limit.
+func (opts LockOptions) Normalize() (LockOptions, error) {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultLockOptions.TTL
+	}
+
+	if opts.TTL < MinLockTTL {
+		return opts, fmt.Errorf("invalid lock TTL %s: must be at least %s", opts.TTL, MinLockTTL)
+	}
+
+	return opts, nil
+}
+
+type lockOwnerContextKey struct{}
+
+// WithLockOwner returns a new context that causes all customer locks acquired
+// with it to be owned by owner.
+func WithLockOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, lockOwnerContextKey{}, owner)
+}
+
+// LockOwner returns the lock owner for ctx. The hostname of the current
+// process is always included so stale locks can be attributed to a
+// customerd instance.
+func LockOwner(ctx context.Context) string {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s[%d]", hostname, os.Getpid())
+
+	if v, ok := ctx.Value(lockOwnerContextKey{}).(string); ok && v != "" {
+		owner = v + "@" + owner
+	}
+
+	return owner
+}
+
+// RetryLock calls try until it acquired the lock, returned an error, ctx is
+// cancelled or the wait timeout of opts is exceeded. In the latter cases an
+// error wrapping ErrCustomerLocked is returned.
+func RetryLock(ctx context.Context, opts LockOptions, try func() (bool, error)) error {
+	var deadline <-chan time.Time
+	if opts.WaitTimeout > 0 {
+		timer := time.NewTimer(opts.WaitTimeout)
+		defer timer.Stop()
+
+		deadline = timer.C
+	}
+
+	backoff := 10 * time.Millisecond
+
+	for {
+		ok, err := try()
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-deadline:
+			return fmt.Errorf("%w: timeout after %s", ErrCustomerLocked, opts.WaitTimeout)
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrCustomerLocked, ctx.Err())
+		}
+
+		backoff *= 2
+		if backoff > 500*time.Millisecond {
+			backoff = 500 * time.Millisecond
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockOptionsNormalize(t *testing.T) {
+	opts, err := LockOptions{WaitTimeout: time.Second}.Normalize()
+	require.NoError(t, err)
+	require.Equal(t, LockOptions{TTL: DefaultLockOptions.TTL, WaitTimeout: time.Second}, opts)
+
+	opts, err = LockOptions{TTL: time.Minute}.Normalize()
+	require.NoError(t, err)
+	require.Equal(t, LockOptions{TTL: time.Minute}, opts)
+
+	_, err = LockOptions{TTL: -time.Second}.Normalize()
+	require.Error(t, err)
+
+	_, err = LockOptions{TTL: 2 * time.Nanosecond}.Normalize()
+	require.Error(t, err)
+}
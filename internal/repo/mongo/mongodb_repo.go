@@ -21,14 +21,26 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 type Repository struct {
-	customers *mongo.Collection
-	locks     *mongo.Collection
+	lockOptions repo.LockOptions
+
+	customers  *mongo.Collection
+	locks      *mongo.Collection
+	exclusions *mongo.Collection
+	duplicates *mongo.Collection
+	pending    *mongo.Collection
+	runs       *mongo.Collection
 }
 
-func New(ctx context.Context, uri, dbName string) (*Repository, error) {
+func New(ctx context.Context, uri, dbName string, lockOptions repo.LockOptions) (*Repository, error) {
+	lockOptions, err := lockOptions.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
 	cli, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create mongodb client: %w", err)
@@ -41,8 +53,13 @@ func New(ctx context.Context, uri, dbName string) (*Repository, error) {
 	db := cli.Database(dbName)
 
 	repo := &Repository{
-		customers: db.Collection("customers"),
-		locks:     db.Collection("locks"),
+		lockOptions: lockOptions,
+		customers:   db.Collection("customers"),
+		locks:       db.Collection("locks"),
+		exclusions:  db.Collection("matchExclusions"),
+		duplicates:  db.Collection("duplicates"),
+		pending:     db.Collection("pendingUpserts"),
+		runs:        db.Collection("importRuns"),
 	}
 
 	if err := repo.setup(ctx); err != nil {
@@ -52,68 +69,681 @@ func New(ctx context.Context, uri, dbName string) (*Repository, error) {
 	return repo, nil
 }
 
-func (r *Repository) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState) error {
+func (r *Repository) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error) {
 	document, err := r.customerToBSON(&customerv1.CustomerResponse{
 		Customer: customer,
 		States:   states,
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to prepare BSON document: %w", err)
+		return 0, fmt.Errorf("failed to prepare BSON document: %w", err)
 	}
 
 	if customer.Id != "" {
 		oid, err := primitive.ObjectIDFromHex(customer.Id)
 		if err != nil {
-			return fmt.Errorf("invalid customer id %q: %w", customer.Id, err)
+			return 0, fmt.Errorf("invalid customer id %q: %w", customer.Id, err)
 		}
 
-		res, err := r.customers.ReplaceOne(ctx, bson.M{"_id": oid}, document)
+		document["revision"] = int64(revision + 1)
+
+		res, err := r.customers.ReplaceOne(ctx, revisionFilter(oid, revision), document)
 		if err != nil {
-			return fmt.Errorf("failed to replace customer %q: %w", customer.Id, err)
+			return 0, fmt.Errorf("failed to replace customer %q: %w", customer.Id, convertErr(err))
 		}
 
 		if res.MatchedCount == 0 {
-			return fmt.Errorf("failed to replace customer %q: %w", customer.Id, repo.ErrCustomerNotFound)
+			count, err := r.customers.CountDocuments(ctx, bson.M{"_id": oid})
+			if err != nil {
+				return 0, fmt.Errorf("failed to replace customer %q: %w", customer.Id, err)
+			}
+
+			if count == 0 {
+				return 0, fmt.Errorf("failed to replace customer %q: %w", customer.Id, repo.ErrCustomerNotFound)
+			}
+
+			return 0, fmt.Errorf("failed to replace customer %q: %w", customer.Id, repo.ErrRevisionConflict)
 		}
 
 	} else {
+		revision = 0
+		document["revision"] = int64(1)
+
 		res, err := r.customers.InsertOne(ctx, document)
 		if err != nil {
-			return fmt.Errorf("failed to insert customer: %w", err)
+			return 0, fmt.Errorf("failed to insert customer: %w", convertErr(err))
 		}
 
 		customer.Id = res.InsertedID.(primitive.ObjectID).Hex()
 	}
 
-	return nil
+	return revision + 1, nil
 }
 
-func (r *Repository) LockCustomer(ctx context.Context, id string) (func(), error) {
-	_, err := r.locks.InsertOne(ctx, bson.M{
-		"id":       id,
-		"lockedAt": time.Now(),
-	})
+// revisionFilter matches the customer with the given id if its stored
+// revision equals revision.
+func revisionFilter(oid primitive.ObjectID, revision uint64) bson.M {
+	filter := bson.M{
+		"_id":      oid,
+		"revision": int64(revision),
+	}
+
+	// documents stored before revisions have been introduced don't
+	// have a revision field at all.
+	if revision == 0 {
+		filter["revision"] = bson.M{"$in": bson.A{int64(0), nil}}
+	}
+
+	return filter
+}
+
+// StoreCustomers stores all writes using a single unordered bulk write.
+func (r *Repository) StoreCustomers(ctx context.Context, writes []repo.CustomerWrite) ([]uint64, []error) {
+	var (
+		revisions = make([]uint64, len(writes))
+		errs      = make([]error, len(writes))
+		ids       = make([]primitive.ObjectID, len(writes))
+
+		// writeIDs identifies the documents stored by replacements in case
+		// the result has to be checked by checkReplaced.
+		writeIDs = make([]primitive.ObjectID, len(writes))
+
+		// models holds the write model and indexes the write of each
+		// prepared write.
+		models  []mongo.WriteModel
+		indexes []int
+
+		// replaced holds the indexes of all writes that replace an existing
+		// customer.
+		replaced []int
+	)
+
+	for idx, w := range writes {
+		document, err := r.customerToBSON(&customerv1.CustomerResponse{
+			Customer: w.Customer,
+			States:   w.States,
+		})
+		if err != nil {
+			errs[idx] = fmt.Errorf("failed to prepare BSON document: %w", err)
+			continue
+		}
+
+		if w.Customer.Id != "" {
+			ids[idx] = document["_id"].(primitive.ObjectID)
+			revisions[idx] = w.Revision + 1
+			writeIDs[idx] = primitive.NewObjectID()
+			document["revision"] = int64(revisions[idx])
+			document["writeId"] = writeIDs[idx]
+
+			models = append(models, mongo.NewReplaceOneModel().SetFilter(revisionFilter(ids[idx], w.Revision)).SetReplacement(document))
+			replaced = append(replaced, idx)
+		} else {
+			ids[idx] = primitive.NewObjectID()
+			revisions[idx] = 1
+			document["_id"] = ids[idx]
+			document["revision"] = int64(1)
+
+			models = append(models, mongo.NewInsertOneModel().SetDocument(document))
+		}
+
+		indexes = append(indexes, idx)
+	}
+
+	if len(models) == 0 {
+		return revisions, errs
+	}
+
+	res, err := r.customers.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil) {
+		for _, idx := range indexes {
+			revisions[idx], errs[idx] = 0, fmt.Errorf("failed to store customers: %w", err)
+		}
+
+		return revisions, errs
+	}
+
+	for _, we := range bulkErr.WriteErrors {
+		idx := indexes[we.Index]
+
+		revisions[idx], errs[idx] = 0, fmt.Errorf("failed to store customer: %w", convertErr(we.WriteError))
+	}
+
+	var matched int64
+	if res != nil {
+		matched = res.MatchedCount
+	}
 
+	// replacements without a write error should have matched their filter.
+	var succeeded []int
+	for _, idx := range replaced {
+		if errs[idx] == nil {
+			succeeded = append(succeeded, idx)
+		}
+	}
+
+	if int64(len(succeeded)) > matched {
+		r.checkReplaced(ctx, writes, ids, writeIDs, succeeded, revisions, errs)
+	}
+
+	for idx, w := range writes {
+		if errs[idx] == nil && w.Customer.Id == "" {
+			w.Customer.Id = ids[idx].Hex()
+		}
+	}
+
+	return revisions, errs
+}
+
+// checkReplaced reloads the customers replaced at indexes since some of
+// them did not match their filter and the bulk write result does not tell
+// which. A replacement succeeded if the stored document still carries its
+// revision and write id. If the customer has been replaced again in the
+// meantime the write is reported as a revision conflict so the caller
+// re-applies it on top of the newer revision.
+func (r *Repository) checkReplaced(ctx context.Context, writes []repo.CustomerWrite, ids, writeIDs []primitive.ObjectID, indexes []int, revisions []uint64, errs []error) {
+	oids := make(bson.A, len(indexes))
+	for i, idx := range indexes {
+		oids[i] = ids[idx]
+	}
+
+	documents, err := r.loadReplaced(ctx, oids)
+
+	for _, idx := range indexes {
+		cause := err
+		if cause == nil {
+			cause = replacedErr(documents[ids[idx]], revisions[idx], writeIDs[idx])
+		}
+
+		if cause != nil {
+			revisions[idx], errs[idx] = 0, fmt.Errorf("failed to replace customer %q: %w", writes[idx].Customer.Id, cause)
+		}
+	}
+}
+
+// loadReplaced returns the id, revision and write id of the customers with
+// the given ids.
+func (r *Repository) loadReplaced(ctx context.Context, oids bson.A) (map[primitive.ObjectID]bson.M, error) {
+	res, err := r.customers.Find(ctx, bson.M{"_id": bson.M{"$in": oids}}, options.Find().SetProjection(bson.M{
+		"_id":      1,
+		"revision": 1,
+		"writeId":  1,
+	}))
 	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			return func() {}, repo.ErrCustomerLocked
+		return nil, err
+	}
+	defer res.Close(ctx)
+
+	documents := make(map[primitive.ObjectID]bson.M)
+	for res.Next(ctx) {
+		var m bson.M
+		if err := res.Decode(&m); err != nil {
+			return nil, err
+		}
+
+		if oid, ok := m["_id"].(primitive.ObjectID); ok {
+			documents[oid] = m
 		}
+	}
+
+	return documents, res.Err()
+}
+
+// replacedErr checks if the customer document stored by a replacement with
+// the given revision and write id. A nil document means the customer does
+// not exist.
+func replacedErr(document bson.M, revision uint64, writeID primitive.ObjectID) error {
+	if document == nil {
+		return repo.ErrCustomerNotFound
+	}
+
+	// the revision alone is not enough since a concurrent writer that
+	// caused the conflict stored the same revision.
+	if id, ok := document["writeId"].(primitive.ObjectID); !ok || id != writeID || documentRevision(document) != revision {
+		return repo.ErrRevisionConflict
+	}
+
+	return nil
+}
+
+func (r *Repository) DeleteCustomer(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fmt.Errorf("invalid customer id %q: %w", id, err)
+	}
 
-		return func() {}, fmt.Errorf("failed to create customer lock: %w", err)
+	res, err := r.customers.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return fmt.Errorf("failed to delete customer %q: %w", id, err)
 	}
 
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("failed to delete customer %q: %w", id, repo.ErrCustomerNotFound)
+	}
+
+	return nil
+}
+
+func (r *Repository) LockCustomer(ctx context.Context, id string) (func(), error) {
+	lock := &repo.CustomerLock{
+		CustomerID: id,
+		Owner:      repo.LockOwner(ctx),
+		LeaseID:    primitive.NewObjectID().Hex(),
+	}
+
+	err := repo.RetryLock(ctx, r.lockOptions, func() (bool, error) {
+		return r.tryLock(ctx, lock)
+	})
+	if err != nil {
+		return func() {}, err
+	}
+
+	// keep renewing the lease while the lock is held.
+	stop := make(chan struct{})
+	go r.renewLock(lock, stop)
+
 	return func() {
-		res := r.locks.FindOneAndDelete(context.Background(), bson.M{
-			"id": id,
+		close(stop)
+
+		_, err := r.locks.DeleteOne(context.Background(), bson.M{
+			"id":      id,
+			"leaseId": lock.LeaseID,
 		})
 
-		if res.Err() != nil {
+		if err != nil {
 			slog.Error("failed to unlock customer", slog.Attr{
 				Key:   "error",
-				Value: slog.StringValue(res.Err().Error()),
+				Value: slog.StringValue(err.Error()),
+			})
+		}
+	}, nil
+}
+
+func (r *Repository) tryLock(ctx context.Context, lock *repo.CustomerLock) (bool, error) {
+	lock.LockedAt = time.Now()
+	lock.ExpiresAt = lock.LockedAt.Add(r.lockOptions.TTL)
+
+	_, err := r.locks.InsertOne(ctx, lock)
+	if err == nil {
+		return true, nil
+	}
+
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, fmt.Errorf("failed to create customer lock: %w", err)
+	}
+
+	// The TTL monitor of MongoDB only runs once per minute so we need to
+	// take over expired locks ourself. Locks without an expiry have been
+	// created by older versions and are always considered stale.
+	res := r.locks.FindOneAndReplace(ctx, bson.M{
+		"id": lock.CustomerID,
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$lt": lock.LockedAt}},
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+		},
+	}, lock)
+
+	if err := res.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to take over stale customer lock: %w", err)
+	}
+
+	var stale repo.CustomerLock
+	if err := res.Decode(&stale); err == nil {
+		slog.WarnContext(ctx, "took over stale customer lock", slog.Any("id", lock.CustomerID), slog.Any("owner", stale.Owner), slog.Any("lockedAt", stale.LockedAt))
+	}
+
+	return true, nil
+}
+
+func (r *Repository) renewLock(lock *repo.CustomerLock, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.lockOptions.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			res, err := r.locks.UpdateOne(context.Background(), bson.M{
+				"id":      lock.CustomerID,
+				"leaseId": lock.LeaseID,
+			}, bson.M{
+				"$set": bson.M{
+					"expiresAt": time.Now().Add(r.lockOptions.TTL),
+				},
 			})
+
+			if err != nil {
+				slog.Error("failed to renew customer lock", slog.Any("id", lock.CustomerID), slog.Any("error", err.Error()))
+			} else if res.MatchedCount == 0 {
+				slog.Error("customer lock has been lost", slog.Any("id", lock.CustomerID), slog.Any("leaseId", lock.LeaseID))
+				return
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *Repository) ListLocks(ctx context.Context) ([]*repo.CustomerLock, error) {
+	res, err := r.locks.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{
+		{Key: "lockedAt", Value: 1},
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find customer locks: %w", err)
+	}
+
+	var results []*repo.CustomerLock
+	if err := res.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode customer locks: %w", err)
+	}
+
+	return results, nil
+}
+
+func (r *Repository) BreakLock(ctx context.Context, id string) error {
+	res, err := r.locks.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to break customer lock: %w", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return repo.ErrLockNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) AddMatchExclusion(ctx context.Context, customerId, importer, ref string) error {
+	filter := bson.M{
+		"customerId": customerId,
+		"importer":   importer,
+		"ref":        ref,
+	}
+
+	_, err := r.exclusions.UpdateOne(ctx, filter, bson.M{
+		"$setOnInsert": bson.M{
+			"createdAt": time.Now(),
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to store match exclusion: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repository) IsMatchExcluded(ctx context.Context, customerId, importer, ref string) (bool, error) {
+	count, err := r.exclusions.CountDocuments(ctx, bson.M{
+		"customerId": customerId,
+		"importer":   importer,
+		"ref":        ref,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check match exclusions: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+func (r *Repository) StoreDuplicateCandidate(ctx context.Context, candidate *repo.DuplicateCandidate) error {
+	_, err := r.duplicates.UpdateOne(ctx, bson.M{"_id": candidate.ID}, bson.M{
+		"$setOnInsert": bson.M{
+			"customerA": candidate.CustomerA,
+			"customerB": candidate.CustomerB,
+			"score":     candidate.Score,
+			"signals":   candidate.Signals,
+			"state":     candidate.State,
+			"createdAt": candidate.CreatedAt,
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to store duplicate candidate: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repository) ListDuplicateCandidates(ctx context.Context, state repo.DuplicateState) ([]*repo.DuplicateCandidate, error) {
+	res, err := r.duplicates.Find(ctx, bson.M{"state": state}, options.Find().SetSort(bson.D{
+		{Key: "score", Value: -1},
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find duplicate candidates: %w", err)
+	}
+
+	var results []*repo.DuplicateCandidate
+	if err := res.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode duplicate candidates: %w", err)
+	}
+
+	return results, nil
+}
+
+func (r *Repository) GetDuplicateCandidate(ctx context.Context, id string) (*repo.DuplicateCandidate, error) {
+	res := r.duplicates.FindOne(ctx, bson.M{"_id": id})
+	if res.Err() != nil {
+		if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+			return nil, repo.ErrDuplicateNotFound
+		}
+
+		return nil, res.Err()
+	}
+
+	var c repo.DuplicateCandidate
+	if err := res.Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode duplicate candidate: %w", err)
+	}
+
+	return &c, nil
+}
+
+func (r *Repository) SetDuplicateCandidateState(ctx context.Context, id string, state repo.DuplicateState) error {
+	res, err := r.duplicates.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"state":     state,
+			"decidedAt": time.Now(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update duplicate candidate: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repo.ErrDuplicateNotFound
+	}
+
+	return nil
+}
+
+type pendingUpsertDocument struct {
+	ID         string    `bson:"_id"`
+	Importer   string    `bson:"importer"`
+	Upsert     bson.M    `bson:"upsert"`
+	Candidates []string  `bson:"candidates"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+func (r *Repository) StorePendingUpsert(ctx context.Context, pending *repo.PendingUpsert) error {
+	upsert, err := protoToBSON(pending.Upsert)
+	if err != nil {
+		return fmt.Errorf("failed to prepare BSON document: %w", err)
+	}
+
+	_, err = r.pending.ReplaceOne(ctx, bson.M{"_id": pending.ID}, pendingUpsertDocument{
+		ID:         pending.ID,
+		Importer:   pending.Importer,
+		Upsert:     upsert,
+		Candidates: pending.Candidates,
+		CreatedAt:  pending.CreatedAt,
+	}, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to store pending upsert: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repository) ListPendingUpserts(ctx context.Context) ([]*repo.PendingUpsert, error) {
+	res, err := r.pending.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{
+		{Key: "createdAt", Value: 1},
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pending upserts: %w", err)
+	}
+
+	var documents []pendingUpsertDocument
+	if err := res.All(ctx, &documents); err != nil {
+		return nil, fmt.Errorf("failed to decode pending upserts: %w", err)
+	}
+
+	results := make([]*repo.PendingUpsert, 0, len(documents))
+	for _, d := range documents {
+		p, err := d.toPendingUpsert()
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, p)
+	}
+
+	return results, nil
+}
+
+func (r *Repository) GetPendingUpsert(ctx context.Context, id string) (*repo.PendingUpsert, error) {
+	res := r.pending.FindOne(ctx, bson.M{"_id": id})
+	if res.Err() != nil {
+		if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+			return nil, repo.ErrPendingNotFound
+		}
+
+		return nil, res.Err()
+	}
+
+	var d pendingUpsertDocument
+	if err := res.Decode(&d); err != nil {
+		return nil, fmt.Errorf("failed to decode pending upsert: %w", err)
+	}
+
+	return d.toPendingUpsert()
+}
+
+func (r *Repository) DeletePendingUpsert(ctx context.Context, id string) error {
+	res, err := r.pending.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete pending upsert: %w", err)
+	}
+
+	if res.DeletedCount == 0 {
+		return repo.ErrPendingNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) StoreImportRun(ctx context.Context, run *repo.ImportRun) error {
+	if _, err := r.runs.ReplaceOne(ctx, bson.M{"_id": run.ID}, run, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("failed to store import run: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Repository) StoreImportCheckpoint(ctx context.Context, run *repo.ImportRun, touched []string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"checkpoint":     run.Checkpoint,
+			"summary":        run.Summary,
+			"errors":         run.Errors,
+			"diffs":          run.Diffs,
+			"diffsTruncated": run.DiffsTruncated,
+		},
+	}
+
+	if len(touched) > 0 {
+		update["$push"] = bson.M{
+			"touched": bson.M{"$each": touched},
 		}
+	}
+
+	res, err := r.runs.UpdateOne(ctx, bson.M{"_id": run.ID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to store import checkpoint: %w", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return repo.ErrImportRunNotFound
+	}
+
+	return nil
+}
+
+func (r *Repository) ListImportRuns(ctx context.Context, importer string, limit int) ([]*repo.ImportRun, error) {
+	filter := bson.M{}
+	if importer != "" {
+		filter["importer"] = importer
+	}
+
+	// the error messages, changes and touched references can be large and
+	// are only returned for single runs.
+	opts := options.Find().SetSort(bson.D{
+		{Key: "startedAt", Value: -1},
+	}).SetProjection(bson.M{
+		"errors":  0,
+		"diffs":   0,
+		"touched": 0,
+	})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	res, err := r.runs.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find import runs: %w", err)
+	}
+
+	var results []*repo.ImportRun
+	if err := res.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode import runs: %w", err)
+	}
+
+	return results, nil
+}
+
+func (r *Repository) GetImportRun(ctx context.Context, id string) (*repo.ImportRun, error) {
+	res := r.runs.FindOne(ctx, bson.M{"_id": id})
+	if res.Err() != nil {
+		if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+			return nil, repo.ErrImportRunNotFound
+		}
+
+		return nil, res.Err()
+	}
+
+	var run repo.ImportRun
+	if err := res.Decode(&run); err != nil {
+		return nil, fmt.Errorf("failed to decode import run: %w", err)
+	}
+
+	return &run, nil
+}
+
+func (d pendingUpsertDocument) toPendingUpsert() (*repo.PendingUpsert, error) {
+	upsert := new(customerv1.UpsertCustomerRequest)
+	if err := bsonToProto(d.Upsert, upsert); err != nil {
+		return nil, fmt.Errorf("pending upsert %q: %w", d.ID, err)
+	}
+
+	return &repo.PendingUpsert{
+		ID:         d.ID,
+		Importer:   d.Importer,
+		Upsert:     upsert,
+		Candidates: d.Candidates,
+		CreatedAt:  d.CreatedAt,
 	}, nil
 }
 
@@ -121,31 +751,60 @@ func (r *Repository) ListCustomers(ctx context.Context, p *commonv1.Pagination)
 	return r.searchCustomers(ctx, bson.M{}, p)
 }
 
-func (r *Repository) LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, error) {
+func (r *Repository) ListCustomerRevisions(ctx context.Context) (map[string]uint64, error) {
+	res, err := r.customers.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"revision": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find customers: %w", err)
+	}
+	defer res.Close(ctx)
+
+	revisions := make(map[string]uint64)
+	for res.Next(ctx) {
+		var m bson.M
+		if err := res.Decode(&m); err != nil {
+			return nil, fmt.Errorf("failed to decode customer revision: %w", err)
+		}
+
+		oid, ok := m["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+
+		revisions[oid.Hex()] = documentRevision(m)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list customer revisions: %w", err)
+	}
+
+	return revisions, nil
+}
+
+func (r *Repository) LookupCustomerById(ctx context.Context, id string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error) {
 	oid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	res := r.customers.FindOne(ctx, bson.M{"_id": oid})
 	if res.Err() != nil {
-		return nil, nil, convertErr(res.Err())
+		return nil, nil, 0, convertErr(res.Err())
 	}
 
 	var m bson.M
 	if err := res.Decode(&m); err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	customer, err := r.bsonToCustomer(m)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
-	return customer.Customer, customer.States, nil
+	return customer.Customer, customer.States, documentRevision(m), nil
 }
 
-func (r *Repository) LookupCustomerByRef(ctx context.Context, importer, ref string) (*customerv1.Customer, []*customerv1.ImportState, error) {
+func (r *Repository) LookupCustomerByRef(ctx context.Context, importer, ref string) (*customerv1.Customer, []*customerv1.ImportState, uint64, error) {
 	filter := bson.M{
 		"states": bson.M{
 			"$elemMatch": bson.M{
@@ -159,20 +818,20 @@ func (r *Repository) LookupCustomerByRef(ctx context.Context, importer, ref stri
 
 	res := r.customers.FindOne(ctx, filter)
 	if res.Err() != nil {
-		return nil, nil, convertErr(res.Err())
+		return nil, nil, 0, convertErr(res.Err())
 	}
 
 	var m bson.M
 	if err := res.Decode(&m); err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
 	customer, err := r.bsonToCustomer(m)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 
-	return customer.Customer, customer.States, nil
+	return customer.Customer, customer.States, documentRevision(m), nil
 }
 
 func (r *Repository) LookupCustomerByName(ctx context.Context, name string, p *commonv1.Pagination) ([]*customerv1.CustomerResponse, int, error) {
@@ -412,13 +1071,50 @@ func (r *Repository) searchCustomers(ctx context.Context, filters bson.M, p *com
 func (repo *Repository) setup(ctx context.Context) error {
 	repo.customers.Indexes().DropOne(ctx, "customer.lastName_text")
 
-	if _, err := repo.locks.Indexes().CreateOne(ctx, mongo.IndexModel{
+	if _, err := repo.locks.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "id", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{
+				{Key: "expiresAt", Value: 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := repo.exclusions.Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys: bson.D{
-			{Key: "id", Value: 1},
+			{Key: "customerId", Value: 1},
+			{Key: "importer", Value: 1},
+			{Key: "ref", Value: 1},
 		},
 		Options: options.Index().SetUnique(true),
 	}); err != nil {
-		return err
+		return fmt.Errorf("failed to create match exclusion indices: %w", err)
+	}
+
+	if _, err := repo.duplicates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "state", Value: 1},
+			{Key: "score", Value: -1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create duplicate indices: %w", err)
+	}
+
+	if _, err := repo.runs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "importer", Value: 1},
+			{Key: "startedAt", Value: -1},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create import run indices: %w", err)
 	}
 
 	if _, err := repo.customers.Indexes().CreateMany(ctx, []mongo.IndexModel{
@@ -501,13 +1197,45 @@ func (repo *Repository) bsonToCustomer(document bson.M) (*customerv1.CustomerRes
 	return customer, nil
 }
 
+// documentRevision returns the revision stored in a customer document.
+func documentRevision(document bson.M) uint64 {
+	switch v := document["revision"].(type) {
+	case int64:
+		return uint64(v)
+	case int32:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
+
 func (repo *Repository) customerToBSON(customer *customerv1.CustomerResponse) (bson.M, error) {
+	m, err := protoToBSON(customer)
+	if err != nil {
+		return nil, err
+	}
+
+	if customer.Customer.Id != "" {
+		var err error
+
+		m["_id"], err = primitive.ObjectIDFromHex(customer.Customer.Id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse document id: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+// protoToBSON converts msg to a BSON document using it's protojson
+// representation.
+func protoToBSON(msg proto.Message) (bson.M, error) {
 	opts := protojson.MarshalOptions{
 		Multiline: true,
 		Indent:    "  ",
 	}
 
-	blob, err := opts.Marshal(customer)
+	blob, err := opts.Marshal(msg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert proto.Message to JSON: %w", err)
 	}
@@ -527,16 +1255,26 @@ func (repo *Repository) customerToBSON(customer *customerv1.CustomerResponse) (b
 		return nil, fmt.Errorf("failed to decode extended JSON to BSON: %w", err)
 	}
 
-	if customer.Customer.Id != "" {
-		var err error
+	return m, nil
+}
 
-		m["_id"], err = primitive.ObjectIDFromHex(customer.Customer.Id)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse document id: %w", err)
-		}
+// bsonToProto is the reverse of protoToBSON. Unknown fields in document
+// are ignored.
+func bsonToProto(document bson.M, msg proto.Message) error {
+	json, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		return fmt.Errorf("failed to marshal BSON as JSON: %w", err)
 	}
 
-	return m, nil
+	unmarshaler := protojson.UnmarshalOptions{
+		DiscardUnknown: true,
+	}
+
+	if err := unmarshaler.Unmarshal(json, msg); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON to protobuf message: %w", err)
+	}
+
+	return nil
 }
 
 // Compile-time check
@@ -551,5 +1289,11 @@ func convertErr(err error) error {
 		return repo.ErrCustomerNotFound
 	}
 
+	// the only unique index on the customers collection is the one on
+	// the import states.
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", repo.ErrDuplicateImportState, err)
+	}
+
 	return err
 }
@@ -0,0 +1,37 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReplacedErr(t *testing.T) {
+	var (
+		fresh = primitive.NewObjectID()
+		stale = primitive.NewObjectID()
+		other = primitive.NewObjectID()
+	)
+
+	// a batch replaced two customers at revision 1. The fresh write has
+	// been stored while a concurrent writer already stored revision 2 of
+	// the other customer.
+	documents := map[primitive.ObjectID]bson.M{
+		fresh: {"_id": fresh, "revision": int64(2), "writeId": fresh},
+		stale: {"_id": stale, "revision": int64(2), "writeId": other},
+	}
+
+	require.NoError(t, replacedErr(documents[fresh], 2, fresh))
+	require.ErrorIs(t, replacedErr(documents[stale], 2, stale), repo.ErrRevisionConflict)
+
+	// replaced again after the batch
+	require.ErrorIs(t, replacedErr(bson.M{"revision": int64(3), "writeId": other}, 2, fresh), repo.ErrRevisionConflict)
+
+	// stored without a write id by StoreCustomer
+	require.ErrorIs(t, replacedErr(bson.M{"revision": int32(2)}, 2, fresh), repo.ErrRevisionConflict)
+
+	require.ErrorIs(t, replacedErr(nil, 2, fresh), repo.ErrCustomerNotFound)
+}
@@ -0,0 +1,29 @@
+package repo
+
+import (
+	"time"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+// PendingUpsert is an upsert of an import session that could not be applied
+// automatically because it matched more than one existing customer record.
+type PendingUpsert struct {
+	// ID uniquely identifies the pending upsert. See PendingUpsertID.
+	ID       string
+	Importer string
+
+	Upsert *customerv1.UpsertCustomerRequest
+
+	// Candidates holds the IDs of all customers that matched.
+	Candidates []string
+
+	CreatedAt time.Time
+}
+
+// PendingUpsertID returns the ID of the pending upsert for the given
+// importer and internal reference. Newer upserts for the same reference
+// replace older ones.
+func PendingUpsertID(importer, ref string) string {
+	return importer + "/" + ref
+}
@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+// ImportRunState describes the state of an import run.
+type ImportRunState string
+
+const (
+	ImportRunRunning   ImportRunState = "running"
+	ImportRunCompleted ImportRunState = "completed"
+	ImportRunAborted   ImportRunState = "aborted"
+)
+
+// ImportRun is the history record of a single import session.
+type ImportRun struct {
+	ID       string `json:"id" bson:"_id"`
+	Importer string `json:"importer" bson:"importer"`
+
+	// Caller is the authenticated user that started the import session.
+	Caller string `json:"caller,omitempty" bson:"caller,omitempty"`
+
+	State ImportRunState `json:"state" bson:"state"`
+
+	// Error holds the reason why an import run has been aborted.
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+
+	StartedAt  time.Time `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+
+	Summary importer.SessionSummary `json:"summary" bson:"summary"`
+
+	// Errors holds the error messages of failed records and Diffs the
+	// changes of all modified records of a dry-run. Both lists are capped,
+	// DiffsTruncated is set if changes have been omitted. They are not
+	// included when listing import runs.
+	Errors         []string              `json:"errors,omitempty" bson:"errors,omitempty"`
+	Diffs          []importer.RecordDiff `json:"diffs,omitempty" bson:"diffs,omitempty"`
+	DiffsTruncated bool                  `json:"diffsTruncated,omitempty" bson:"diffsTruncated,omitempty"`
+
+	// Snapshot and SnapshotMaxRemove hold the full snapshot settings of the
+	// run so they can be restored when the run is resumed.
+	Snapshot          bool    `json:"snapshot,omitempty" bson:"snapshot,omitempty"`
+	SnapshotMaxRemove float64 `json:"snapshotMaxRemove,omitempty" bson:"snapshotMaxRemove,omitempty"`
+
+	// Checkpoint is the number of upserts that have been processed without
+	// a gap in the order they have been received. An importer resuming the
+	// run skips that many upserts.
+	Checkpoint uint64 `json:"checkpoint" bson:"checkpoint"`
+
+	// Touched holds all references upserted when the checkpoint has been
+	// stored. It is required to detect orphaned states in resumed snapshot runs and is
+	// cleared once the run is completed.
+	Touched []string `json:"-" bson:"touched,omitempty"`
+}
@@ -133,6 +133,29 @@ func (svc *CustomerService) SearchCustomer(ctx context.Context, msg *connect.Req
 		msg.Msg.Queries = append(msg.Msg.Queries, &customerv1.CustomerQuery{})
 	}
 
+	// lookups of a single customer by ID also return the ETag required for
+	// conditional updates.
+	if len(msg.Msg.Queries) == 1 && msg.Msg.Queries[0].GetId() != "" {
+		customer, states, revision, err := svc.repo.LookupCustomerById(ctx, msg.Msg.Queries[0].GetId())
+		if err != nil && !errors.Is(err, repo.ErrCustomerNotFound) {
+			return nil, err
+		}
+
+		res := connect.NewResponse(&customerv1.SearchCustomerResponse{})
+		if customer != nil {
+			res.Msg.Results = []*customerv1.CustomerResponse{
+				{
+					Customer: customer,
+					States:   states,
+				},
+			}
+			res.Msg.TotalResults = 1
+			res.Header().Set("ETag", formatETag(revision))
+		}
+
+		return res, nil
+	}
+
 	customers, count, err := svc.repo.SearchQueries(ctx, msg.Msg.Queries, msg.Msg.Pagination)
 	if err != nil {
 		return nil, err
@@ -144,38 +167,77 @@ func (svc *CustomerService) SearchCustomer(ctx context.Context, msg *connect.Req
 	}), nil
 }
 
+// maxUpdateAttempts limits how often UpdateCustomer re-applies an update if
+// the customer has been modified concurrently.
+const maxUpdateAttempts = 5
+
+// UpdateCustomer creates or updates a customer. Clients may send an If-Match
+// header with the ETag of a previous response in which case the update is
+// rejected if the customer has been modified in the meantime. The new ETag
+// is returned in the response headers.
 func (svc *CustomerService) UpdateCustomer(ctx context.Context, req *connect.Request[customerv1.UpdateCustomerRequest]) (*connect.Response[customerv1.UpdateCustomerResponse], error) {
-	var (
-		customer *customerv1.Customer
-		states   []*customerv1.ImportState
-		err      error
-	)
+	precondition, err := parseIfMatch(req.Header())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
 
-	if id := req.Msg.GetCustomer().GetId(); id != "" {
-		customer, states, err = svc.repo.LookupCustomerById(ctx, id)
-		if err != nil {
-			if errors.Is(err, repo.ErrCustomerNotFound) {
-				return nil, connect.NewError(connect.CodeNotFound, err)
+	id := req.Msg.GetCustomer().GetId()
+
+	if id == "" && precondition != nil {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("If-Match is not supported when creating customers"))
+	}
+
+	for attempt := 1; ; attempt++ {
+		var (
+			customer *customerv1.Customer
+			states   []*customerv1.ImportState
+			revision uint64
+		)
+
+		if id != "" {
+			customer, states, revision, err = svc.repo.LookupCustomerById(ctx, id)
+			if err != nil {
+				if errors.Is(err, repo.ErrCustomerNotFound) {
+					return nil, connect.NewError(connect.CodeNotFound, err)
+				}
+
+				return nil, err
+			}
+
+			if precondition != nil && !precondition.matches(revision) {
+				return nil, connect.NewError(connect.CodeFailedPrecondition, repo.ErrRevisionConflict)
 			}
+		}
+
+		p := session.NewPatcher("user", "ref", svc.resolver, customer, states)
 
+		if err := p.Apply(req.Msg.Customer); err != nil {
 			return nil, err
 		}
-	}
 
-	p := session.NewPatcher("user", "ref", svc.resolver, customer, states)
+		newRevision, err := svc.repo.StoreCustomer(ctx, p.Result, p.States, revision)
+		if err != nil {
+			if !errors.Is(err, repo.ErrRevisionConflict) {
+				return nil, err
+			}
 
-	if err := p.Apply(req.Msg.Customer); err != nil {
-		return nil, err
-	}
+			// the client explicitly asked to update the revision it has seen
+			// so we must not re-apply the update.
+			if (precondition != nil && !precondition.any) || attempt >= maxUpdateAttempts {
+				return nil, connect.NewError(connect.CodeFailedPrecondition, err)
+			}
 
-	if err := svc.repo.StoreCustomer(ctx, p.Result, p.States); err != nil {
-		return nil, err
-	}
+			continue
+		}
 
-	return connect.NewResponse(&customerv1.UpdateCustomerResponse{
-		Response: &customerv1.CustomerResponse{
-			Customer: p.Result,
-			States:   p.States,
-		},
-	}), nil
+		res := connect.NewResponse(&customerv1.UpdateCustomerResponse{
+			Response: &customerv1.CustomerResponse{
+				Customer: p.Result,
+				States:   p.States,
+			},
+		})
+		res.Header().Set("ETag", formatETag(newRevision))
+
+		return res, nil
+	}
 }
@@ -0,0 +1,97 @@
+package customerservice
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+type DuplicateDecisionRequest struct {
+	ID string `json:"id"`
+}
+
+type ListDuplicatesResponse struct {
+	Candidates []*repo.DuplicateCandidate `json:"candidates"`
+}
+
+// GET /duplicates?state=pending
+func (svc *CustomerService) ListDuplicatesHandler(w http.ResponseWriter, req *http.Request) {
+	state := repo.DuplicateState(req.URL.Query().Get("state"))
+	if state == "" {
+		state = repo.DuplicatePending
+	}
+
+	candidates, err := svc.repo.ListDuplicateCandidates(req.Context(), state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpjson.Write(w, req, ListDuplicatesResponse{
+		Candidates: candidates,
+	})
+}
+
+// POST /duplicates/accept
+//
+// Accepting a duplicate candidate merges CustomerB into CustomerA.
+func (svc *CustomerService) AcceptDuplicateHandler(w http.ResponseWriter, req *http.Request) {
+	svc.handleDuplicateDecision(w, req, repo.DuplicateAccepted)
+}
+
+// POST /duplicates/reject
+//
+// Rejected duplicate candidates are never suggested again.
+func (svc *CustomerService) RejectDuplicateHandler(w http.ResponseWriter, req *http.Request) {
+	svc.handleDuplicateDecision(w, req, repo.DuplicateRejected)
+}
+
+func (svc *CustomerService) handleDuplicateDecision(w http.ResponseWriter, req *http.Request, state repo.DuplicateState) {
+	var body DuplicateDecisionRequest
+	if !httpjson.Decode(w, req, http.MethodPost, &body) {
+		return
+	}
+
+	candidate, err := svc.repo.GetDuplicateCandidate(req.Context(), body.ID)
+	if err != nil {
+		if errors.Is(err, repo.ErrDuplicateNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if candidate.State != repo.DuplicatePending {
+		http.Error(w, fmt.Sprintf("duplicate candidate has already been %s", candidate.State), http.StatusConflict)
+		return
+	}
+
+	if state == repo.DuplicateAccepted {
+		if _, err := svc.MergeCustomers(req.Context(), candidate.CustomerA, candidate.CustomerB); err != nil {
+			switch {
+			case errors.Is(err, repo.ErrCustomerNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, repo.ErrCustomerLocked):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+
+			return
+		}
+	}
+
+	if err := svc.repo.SetDuplicateCandidateState(req.Context(), candidate.ID, state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	candidate.State = state
+
+	httpjson.Write(w, req, candidate)
+}
@@ -0,0 +1,67 @@
+package customerservice
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// formatETag returns the entity tag for a customer revision.
+func formatETag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+// ifMatch is a parsed If-Match request header.
+type ifMatch struct {
+	any       bool
+	revisions []uint64
+}
+
+// parseIfMatch parses the If-Match header. It returns nil if the header
+// is not set.
+func parseIfMatch(header http.Header) (*ifMatch, error) {
+	value := strings.TrimSpace(header.Get("If-Match"))
+	if value == "" {
+		return nil, nil
+	}
+
+	if value == "*" {
+		return &ifMatch{any: true}, nil
+	}
+
+	result := new(ifMatch)
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+		unquoted, err := strconv.Unquote(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entity tag %s", tag)
+		}
+
+		revision, err := strconv.ParseUint(unquoted, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entity tag %s", tag)
+		}
+
+		result.revisions = append(result.revisions, revision)
+	}
+
+	return result, nil
+}
+
+// matches reports whether the precondition holds for an existing customer
+// with the given revision.
+func (m *ifMatch) matches(revision uint64) bool {
+	if m.any {
+		return true
+	}
+
+	for _, r := range m.revisions {
+		if r == revision {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package customerservice
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+type CustomerLock struct {
+	*repo.CustomerLock
+
+	Stale bool `json:"stale"`
+}
+
+type ListLocksResponse struct {
+	Locks []CustomerLock `json:"locks"`
+}
+
+type BreakLockRequest struct {
+	CustomerID string `json:"customerId"`
+}
+
+// GET /locks
+func (svc *CustomerService) ListLocksHandler(w http.ResponseWriter, req *http.Request) {
+	locks, err := svc.repo.ListLocks(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	response := ListLocksResponse{
+		Locks: make([]CustomerLock, len(locks)),
+	}
+
+	for idx, l := range locks {
+		response.Locks[idx] = CustomerLock{
+			CustomerLock: l,
+			Stale:        l.Stale(now),
+		}
+	}
+
+	httpjson.Write(w, req, response)
+}
+
+// POST /locks/break
+func (svc *CustomerService) BreakLockHandler(w http.ResponseWriter, req *http.Request) {
+	var body BreakLockRequest
+	if !httpjson.Decode(w, req, http.MethodPost, &body) {
+		return
+	}
+
+	if err := svc.repo.BreakLock(req.Context(), body.CustomerID); err != nil {
+		if errors.Is(err, repo.ErrLockNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	httpjson.Write(w, req, body)
+}
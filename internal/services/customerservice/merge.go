@@ -0,0 +1,71 @@
+package customerservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/session"
+)
+
+// MergeCustomers merges the customer identified by sourceId into the customer
+// identified by targetId. The source customer is deleted afterwards.
+func (svc *CustomerService) MergeCustomers(ctx context.Context, targetId, sourceId string) (*customerv1.CustomerResponse, error) {
+	if targetId == sourceId {
+		return nil, fmt.Errorf("cannot merge customer %q into itself", targetId)
+	}
+
+	ctx = repo.WithLockOwner(ctx, "merge")
+
+	// always lock in the same order to prevent dead-locks with concurrent
+	// merges of the same customers.
+	ids := []string{targetId, sourceId}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		unlock, err := svc.repo.LockCustomer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	target, targetStates, targetRevision, err := svc.repo.LookupCustomerById(ctx, targetId)
+	if err != nil {
+		return nil, err
+	}
+
+	source, sourceStates, sourceRevision, err := svc.repo.LookupCustomerById(ctx, sourceId)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := session.MergeImportStates(svc.resolver, target, targetStates, sourceStates)
+	if err != nil {
+		return nil, err
+	}
+
+	// import states must be unique so we first need to strip them from the
+	// source customer before they can be stored with the merged one.
+	sourceRevision, err = svc.repo.StoreCustomer(ctx, source, nil, sourceRevision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update source customer: %w", err)
+	}
+
+	if _, err := svc.repo.StoreCustomer(ctx, merged.Customer, merged.States, targetRevision); err != nil {
+		if _, restoreErr := svc.repo.StoreCustomer(ctx, source, sourceStates, sourceRevision); restoreErr != nil {
+			slog.ErrorContext(ctx, "failed to restore customer after failed merge", slog.Any("id", sourceId), slog.Any("error", restoreErr.Error()))
+		}
+
+		return nil, fmt.Errorf("failed to store merged customer: %w", err)
+	}
+
+	if err := svc.repo.DeleteCustomer(ctx, sourceId); err != nil {
+		return nil, fmt.Errorf("failed to delete source customer: %w", err)
+	}
+
+	return merged, nil
+}
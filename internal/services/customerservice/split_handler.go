@@ -0,0 +1,119 @@
+package customerservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/session"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type SplitCustomerRequest struct {
+	CustomerID string `json:"customerId"`
+	Importer   string `json:"importer"`
+	Ref        string `json:"ref"`
+}
+
+type SplitCustomerResponse struct {
+	Remaining json.RawMessage `json:"remaining"`
+	Detached  json.RawMessage `json:"detached"`
+}
+
+// SplitCustomer detaches the import state identified by importer and ref from
+// the customer with the given id and stores it as a new customer. The import
+// state will not be automatically matched to the original customer again.
+func (svc *CustomerService) SplitCustomer(ctx context.Context, id, importer, ref string) (*customerv1.CustomerResponse, *customerv1.CustomerResponse, error) {
+	ctx = repo.WithLockOwner(ctx, "split")
+
+	unlock, err := svc.repo.LockCustomer(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	customer, states, revision, err := svc.repo.LookupCustomerById(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remaining, detached, err := session.SplitImportState(importer, ref, svc.resolver, customer, states)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the exclusion is added before anything is stored so a completed split
+	// is never re-merged by the next import. An exclusion left behind by a
+	// failed split only prevents automatic matching, the import state is
+	// still found by its reference.
+	if err := svc.repo.AddMatchExclusion(ctx, id, importer, ref); err != nil {
+		return nil, nil, fmt.Errorf("failed to add match exclusion: %w", err)
+	}
+
+	// the remaining customer must be stored first since the import state
+	// of the detached one must be unique.
+	revision, err = svc.repo.StoreCustomer(ctx, remaining.Customer, remaining.States, revision)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store remaining customer: %w", err)
+	}
+
+	if _, err := svc.repo.StoreCustomer(ctx, detached.Customer, detached.States, 0); err != nil {
+		// try to restore the original customer record
+		if _, restoreErr := svc.repo.StoreCustomer(ctx, customer, states, revision); restoreErr != nil {
+			slog.ErrorContext(ctx, "failed to restore customer after failed split", slog.Any("id", id), slog.Any("error", restoreErr.Error()))
+		}
+
+		return nil, nil, fmt.Errorf("failed to store detached customer: %w", err)
+	}
+
+	return remaining, detached, nil
+}
+
+// POST /customers/split
+func (svc *CustomerService) SplitCustomerHandler(w http.ResponseWriter, req *http.Request) {
+	var body SplitCustomerRequest
+	if !httpjson.Decode(w, req, http.MethodPost, &body) {
+		return
+	}
+
+	if body.CustomerID == "" || body.Importer == "" || body.Ref == "" {
+		http.Error(w, "customerId, importer and ref are required", http.StatusBadRequest)
+		return
+	}
+
+	remaining, detached, err := svc.SplitCustomer(req.Context(), body.CustomerID, body.Importer, body.Ref)
+	if err != nil {
+		switch {
+		case errors.Is(err, repo.ErrCustomerNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, repo.ErrCustomerLocked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	var response SplitCustomerResponse
+
+	response.Remaining, err = protojson.Marshal(remaining)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Detached, err = protojson.Marshal(detached)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpjson.Write(w, req, response)
+}
@@ -13,20 +13,22 @@ import (
 type ImportService struct {
 	repo     repo.Repo
 	resolver session.PriorityResolver
+	opts     session.Options
 
 	customerv1connect.UnimplementedCustomerImportServiceHandler
 }
 
-func NewImportService(repo repo.Repo, resolver session.PriorityResolver) *ImportService {
+func NewImportService(repo repo.Repo, resolver session.PriorityResolver, opts session.Options) *ImportService {
 	return &ImportService{
 		repo:     repo,
 		resolver: resolver,
+		opts:     opts,
 	}
 }
 
 func (svc *ImportService) ImportSession(ctx context.Context, stream *connect.BidiStream[customerv1.ImportSessionRequest, customerv1.ImportSessionResponse]) error {
 	// create a new import session hand start handling customer updates.
-	session := session.NewImportSession(stream, svc.repo, svc.resolver)
+	session := session.NewImportSession(stream, svc.repo, svc.resolver, svc.opts)
 
 	return session.Handle(ctx)
 }
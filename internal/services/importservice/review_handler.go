@@ -0,0 +1,110 @@
+package importservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/session"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type PendingUpsert struct {
+	ID         string          `json:"id"`
+	Importer   string          `json:"importer"`
+	Upsert     json.RawMessage `json:"upsert"`
+	Candidates []string        `json:"candidates"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+type ListPendingUpsertsResponse struct {
+	Pending []PendingUpsert `json:"pending"`
+}
+
+type ResolvePendingUpsertRequest struct {
+	ID string `json:"id"`
+
+	// CustomerID is the ID of the customer the pending upsert should be
+	// applied to. If empty, a new customer is created.
+	CustomerID string `json:"customerId"`
+}
+
+type ResolvePendingUpsertResponse struct {
+	CustomerID string `json:"customerId"`
+}
+
+// GET /imports/review
+func (svc *ImportService) ListPendingUpsertsHandler(w http.ResponseWriter, req *http.Request) {
+	pending, err := svc.repo.ListPendingUpserts(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := ListPendingUpsertsResponse{
+		Pending: make([]PendingUpsert, len(pending)),
+	}
+
+	for idx, p := range pending {
+		blob, err := protojson.Marshal(p.Upsert)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Pending[idx] = PendingUpsert{
+			ID:         p.ID,
+			Importer:   p.Importer,
+			Upsert:     blob,
+			Candidates: p.Candidates,
+			CreatedAt:  p.CreatedAt,
+		}
+	}
+
+	httpjson.Write(w, req, response)
+}
+
+// POST /imports/review/resolve
+func (svc *ImportService) ResolvePendingUpsertHandler(w http.ResponseWriter, req *http.Request) {
+	var body ResolvePendingUpsertRequest
+	if !httpjson.Decode(w, req, http.MethodPost, &body) {
+		return
+	}
+
+	pending, err := svc.repo.GetPendingUpsert(req.Context(), body.ID)
+	if err != nil {
+		if errors.Is(err, repo.ErrPendingNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	result, err := session.ApplyUpsert(req.Context(), svc.repo, svc.resolver, pending.Importer, body.CustomerID, pending.Upsert)
+	if err != nil {
+		switch {
+		case errors.Is(err, repo.ErrCustomerNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, repo.ErrCustomerLocked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if err := svc.repo.DeletePendingUpsert(req.Context(), pending.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpjson.Write(w, req, ResolvePendingUpsertResponse{
+		CustomerID: result.Customer.Id,
+	})
+}
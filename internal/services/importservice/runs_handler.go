@@ -0,0 +1,62 @@
+package importservice
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+type ListImportRunsResponse struct {
+	Runs []*repo.ImportRun `json:"runs"`
+}
+
+// GET /imports/runs?importer=vetinf&limit=10
+func (svc *ImportService) ListImportRunsHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	var limit int
+	if value := query.Get("limit"); value != "" {
+		var err error
+
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := svc.repo.ListImportRuns(req.Context(), query.Get("importer"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpjson.Write(w, req, ListImportRunsResponse{
+		Runs: runs,
+	})
+}
+
+// GET /imports/runs/show?id=
+func (svc *ImportService) GetImportRunHandler(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	run, err := svc.repo.GetImportRun(req.Context(), id)
+	if err != nil {
+		if errors.Is(err, repo.ErrImportRunNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	httpjson.Write(w, req, run)
+}
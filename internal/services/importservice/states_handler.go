@@ -0,0 +1,78 @@
+package importservice
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tierklinik-dobersberg/customer-service/internal/httpjson"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/session"
+)
+
+type RemoveImportStateRequest struct {
+	Importer string `json:"importer"`
+	Ref      string `json:"ref"`
+}
+
+type RemoveImportStateResponse struct {
+	CustomerID string `json:"customerId"`
+
+	// Deleted is set if the customer has been deleted because no other
+	// import state was left.
+	Deleted          bool `json:"deleted"`
+	PrunedAttributes int  `json:"prunedAttributes"`
+}
+
+// POST /imports/states/remove
+//
+// Removes the import state of a record that has been deleted at the
+// importer's source. Attributes only owned by that state are pruned and the
+// customer is deleted if no other state is left.
+func (svc *ImportService) RemoveImportStateHandler(w http.ResponseWriter, req *http.Request) {
+	var body RemoveImportStateRequest
+	if !httpjson.Decode(w, req, http.MethodPost, &body) {
+		return
+	}
+
+	if body.Importer == "" || body.Ref == "" {
+		http.Error(w, "importer and ref are required", http.StatusBadRequest)
+		return
+	}
+
+	// an upsert of the record might still wait for review.
+	if err := svc.repo.DeletePendingUpsert(req.Context(), repo.PendingUpsertID(body.Importer, body.Ref)); err != nil && !errors.Is(err, repo.ErrPendingNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	customer, _, _, err := svc.repo.LookupCustomerByRef(req.Context(), body.Importer, body.Ref)
+	if err != nil {
+		if errors.Is(err, repo.ErrCustomerNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	deleted, pruned, err := session.RemoveImportState(req.Context(), svc.repo, svc.resolver, body.Importer, body.Ref, customer.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, repo.ErrCustomerNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, repo.ErrCustomerLocked):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	httpjson.Write(w, req, RemoveImportStateResponse{
+		CustomerID:       customer.Id,
+		Deleted:          deleted,
+		PrunedAttributes: pruned,
+	})
+}
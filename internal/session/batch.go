@@ -0,0 +1,133 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// WriteBatcher collects the customer writes of upserts that are processed
+// concurrently across all import sessions and stores them with a single
+// StoreCustomers call. A nil WriteBatcher stores every write on its own.
+type WriteBatcher struct {
+	store   repo.Repo
+	size    int
+	latency time.Duration
+
+	l       sync.Mutex
+	pending []*batchedWrite
+	timer   *time.Timer
+}
+
+type batchedWrite struct {
+	write    repo.CustomerWrite
+	revision uint64
+	err      error
+	done     chan struct{}
+}
+
+// NewWriteBatcher returns a batcher that stores customers in store once
+// size writes are waiting or the first one waited for latency. If size is
+// less than two nil is returned.
+func NewWriteBatcher(store repo.Repo, size int, latency time.Duration) *WriteBatcher {
+	if size < 2 {
+		return nil
+	}
+
+	return &WriteBatcher{
+		store:   store,
+		size:    size,
+		latency: latency,
+	}
+}
+
+// StoreCustomer queues the write and waits until it has been stored with
+// the next batch.
+func (b *WriteBatcher) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error) {
+	w := &batchedWrite{
+		write: repo.CustomerWrite{
+			Customer: customer,
+			States:   states,
+			Revision: revision,
+		},
+		done: make(chan struct{}),
+	}
+
+	b.l.Lock()
+	b.pending = append(b.pending, w)
+
+	var batch []*batchedWrite
+	switch {
+	case len(b.pending) >= b.size:
+		batch = b.takeLocked()
+
+	case len(b.pending) == 1:
+		// the batch is written on behalf of all callers so it must not
+		// fail just because ctx is cancelled.
+		flushCtx := context.WithoutCancel(ctx)
+
+		b.timer = time.AfterFunc(b.latency, func() {
+			b.l.Lock()
+			batch := b.takeLocked()
+			b.l.Unlock()
+
+			b.flush(flushCtx, batch)
+		})
+	}
+	b.l.Unlock()
+
+	if batch != nil {
+		b.flush(context.WithoutCancel(ctx), batch)
+	}
+
+	select {
+	case <-w.done:
+		return w.revision, w.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// takeLocked returns all pending writes. b.l must be held.
+func (b *WriteBatcher) takeLocked() []*batchedWrite {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := b.pending
+	b.pending = nil
+
+	return batch
+}
+
+func (b *WriteBatcher) flush(ctx context.Context, batch []*batchedWrite) {
+	if len(batch) == 0 {
+		return
+	}
+
+	writes := make([]repo.CustomerWrite, len(batch))
+	for idx, w := range batch {
+		writes[idx] = w.write
+	}
+
+	revisions, errs := b.store.StoreCustomers(ctx, writes)
+
+	for idx, w := range batch {
+		w.revision, w.err = revisions[idx], errs[idx]
+		close(w.done)
+	}
+}
+
+// batchedStore stores customers using a WriteBatcher.
+type batchedStore struct {
+	repo.Repo
+	batcher *WriteBatcher
+}
+
+func (s *batchedStore) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error) {
+	return s.batcher.StoreCustomer(ctx, customer, states, revision)
+}
@@ -0,0 +1,114 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+// batchRecorder records the size of all batches stored.
+type batchRecorder struct {
+	repo.Repo
+
+	l       sync.Mutex
+	batches []int
+}
+
+func (r *batchRecorder) StoreCustomers(ctx context.Context, writes []repo.CustomerWrite) ([]uint64, []error) {
+	r.l.Lock()
+	r.batches = append(r.batches, len(writes))
+	r.l.Unlock()
+
+	return r.Repo.StoreCustomers(ctx, writes)
+}
+
+func TestWriteBatcher(t *testing.T) {
+	ctx := context.Background()
+	store := &batchRecorder{Repo: repo.New(inmem.New())}
+
+	existing := &customerv1.Customer{LastName: "Doe"}
+	_, err := store.StoreCustomer(ctx, existing, nil, 0)
+	require.NoError(t, err)
+
+	b := NewWriteBatcher(store, 4, time.Hour)
+
+	var (
+		wg        sync.WaitGroup
+		customers = make([]*customerv1.Customer, 4)
+		revisions = make([]uint64, 4)
+		errs      = make([]error, 4)
+	)
+
+	for i := range customers {
+		customers[i] = &customerv1.Customer{LastName: fmt.Sprint(i)}
+
+		// the last write conflicts with the stored revision
+		revision := uint64(0)
+		if i == 3 {
+			customers[i] = &customerv1.Customer{Id: existing.Id, LastName: "Roe"}
+			revision = 5
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			revisions[i], errs[i] = b.StoreCustomer(ctx, customers[i], nil, revision)
+		}(i)
+	}
+
+	wg.Wait()
+
+	// all writes are stored with a single request
+	require.Equal(t, []int{4}, store.batches)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, uint64(1), revisions[i])
+		require.NotEmpty(t, customers[i].Id)
+	}
+
+	require.ErrorIs(t, errs[3], repo.ErrRevisionConflict)
+
+	// single writes are stored once the latency passed
+	b = NewWriteBatcher(store, 4, time.Millisecond)
+
+	revision, err := b.StoreCustomer(ctx, &customerv1.Customer{Id: existing.Id, LastName: "Roe"}, nil, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), revision)
+	require.Equal(t, []int{4, 1}, store.batches)
+
+	require.Nil(t, NewWriteBatcher(store, 1, time.Millisecond))
+}
+
+func TestBatchedUpsert(t *testing.T) {
+	ctx := context.Background()
+	store := &batchRecorder{Repo: repo.New(inmem.New())}
+
+	session := &ImportSession{
+		store:    &batchedStore{Repo: store, batcher: NewWriteBatcher(store, 8, time.Millisecond)},
+		importer: "test",
+		resolver: new(resolver),
+		strategy: DefaultMatchStrategy,
+	}
+
+	result, err := session.upsert(ctx, &customerv1.UpsertCustomerRequest{
+		InternalReference: "1",
+		Customer:          &customerv1.Customer{LastName: "Doe"},
+	})
+	require.NoError(t, err)
+	require.True(t, result.Created)
+
+	customer, states, _, err := store.LookupCustomerByRef(ctx, "test", "1")
+	require.NoError(t, err)
+	require.Equal(t, result.Customer.Id, customer.Id)
+	require.Len(t, states, 1)
+	require.Equal(t, []int{1}, store.batches)
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+// checkpointInterval is the number of processed upserts after which the
+// checkpoint of a session is persisted.
+const checkpointInterval = 100
+
+// checkpoint tracks the position of an import session. Upserts are numbered
+// in the order they are received but may complete out of order since they
+// are processed concurrently. The position is only advanced once all
+// preceding upserts have been processed.
+type checkpoint struct {
+	l        sync.Mutex
+	next     uint64
+	position uint64
+	stored   uint64
+	done     map[uint64]struct{}
+}
+
+func newCheckpoint(position uint64) *checkpoint {
+	return &checkpoint{
+		next:     position,
+		position: position,
+		stored:   position,
+		done:     make(map[uint64]struct{}),
+	}
+}
+
+// assign returns the sequence number of the next received upsert.
+func (c *checkpoint) assign() uint64 {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.next++
+
+	return c.next
+}
+
+// ack marks the upsert with the given sequence number as processed. It
+// reports whether the checkpoint should be persisted.
+func (c *checkpoint) ack(seq uint64) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.done[seq] = struct{}{}
+
+	for {
+		if _, ok := c.done[c.position+1]; !ok {
+			break
+		}
+
+		delete(c.done, c.position+1)
+		c.position++
+	}
+
+	if c.position-c.stored < checkpointInterval {
+		return false
+	}
+
+	c.stored = c.position
+
+	return true
+}
+
+func (c *checkpoint) current() uint64 {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.position
+}
+
+// resume loads the interrupted import run with the given id and restores
+// the session state from its last checkpoint.
+func (session *ImportSession) resume(ctx context.Context, id, caller string) (*repo.ImportRun, error) {
+	run, err := session.store.GetImportRun(ctx, id)
+	if err != nil {
+		if errors.Is(err, repo.ErrImportRunNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+
+		return nil, fmt.Errorf("failed to load import run: %w", err)
+	}
+
+	// only the importer and caller that started the run may resume it.
+	if run.Importer != session.importer {
+		return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("import run %q belongs to importer %q", id, run.Importer))
+	}
+
+	if run.Caller != "" && run.Caller != caller {
+		return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("import run %q has been started by %q", id, run.Caller))
+	}
+
+	if run.State == repo.ImportRunCompleted {
+		err := connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("import run %q has already been completed", id))
+
+		// the importer might have lost the response to the complete request
+		// so it still gets the summary of the run.
+		if blob, jsonErr := json.Marshal(run.Summary); jsonErr == nil {
+			err.Meta().Set(importer.SummaryTrailer, string(blob))
+		}
+
+		return nil, err
+	}
+
+	session.dryRun = run.Summary.DryRun
+	session.snapshot = run.Snapshot
+	session.maxRemove = run.SnapshotMaxRemove
+	session.stats.restore(run)
+	session.checkpoint = newCheckpoint(run.Checkpoint)
+
+	for _, ref := range run.Touched {
+		session.touched[ref] = struct{}{}
+	}
+
+	run.State = repo.ImportRunRunning
+	run.Error = ""
+	run.FinishedAt = time.Time{}
+
+	slog.InfoContext(ctx, "resuming import session", "id", run.ID, "importer", run.Importer, "checkpoint", run.Checkpoint)
+
+	return run, nil
+}
+
+// saveCheckpoint persists the current checkpoint of the session along with
+// the statistics. The references touched by snapshot sessions since the last
+// checkpoint are appended to the stored ones.
+func (session *ImportSession) saveCheckpoint(ctx context.Context) {
+	session.runL.Lock()
+	defer session.runL.Unlock()
+
+	session.run.Checkpoint = session.checkpoint.current()
+	session.stats.record(session.run)
+
+	session.touchedL.Lock()
+	touched := session.unsaved
+	session.unsaved = nil
+	session.touchedL.Unlock()
+
+	if err := session.store.StoreImportCheckpoint(ctx, session.run, touched); err != nil {
+		slog.ErrorContext(ctx, "failed to store import checkpoint", slog.Any("error", err.Error()))
+
+		// try again with the next checkpoint
+		session.touchedL.Lock()
+		session.unsaved = append(touched, session.unsaved...)
+		session.touchedL.Unlock()
+	}
+}
+
+// touchedRefs returns a sorted list of all references touched so far.
+func (session *ImportSession) touchedRefs() []string {
+	session.touchedL.Lock()
+	defer session.touchedL.Unlock()
+
+	refs := make([]string, 0, len(session.touched))
+	for ref := range session.touched {
+		refs = append(refs, ref)
+	}
+
+	sort.Strings(refs)
+
+	return refs
+}
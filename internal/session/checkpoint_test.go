@@ -0,0 +1,134 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+func TestCheckpoint(t *testing.T) {
+	c := newCheckpoint(10)
+
+	seqs := make([]uint64, checkpointInterval+1)
+	for i := range seqs {
+		seqs[i] = c.assign()
+	}
+	require.Equal(t, uint64(11), seqs[0])
+
+	// out-of-order acks do not advance the position
+	require.False(t, c.ack(seqs[1]))
+	require.Equal(t, uint64(10), c.current())
+
+	require.False(t, c.ack(seqs[0]))
+	require.Equal(t, uint64(12), c.current())
+
+	for _, seq := range seqs[2 : len(seqs)-2] {
+		require.False(t, c.ack(seq))
+	}
+
+	// the checkpoint should be stored once checkpointInterval upserts
+	// have been processed.
+	require.True(t, c.ack(seqs[len(seqs)-2]))
+	require.Equal(t, uint64(10+checkpointInterval), c.current())
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	run := &repo.ImportRun{
+		ID:         "run",
+		Importer:   "test",
+		Caller:     "alice",
+		State:      repo.ImportRunAborted,
+		Error:      "connection reset",
+		Snapshot:   true,
+		Checkpoint: 2,
+		Touched:    []string{"1", "2"},
+		Summary:    importer.SessionSummary{Importer: "test", Created: 3},
+	}
+	require.NoError(t, store.StoreImportRun(ctx, run))
+
+	session := &ImportSession{
+		store:    store,
+		importer: "test",
+		touched:  make(map[string]struct{}),
+	}
+
+	resumed, err := session.resume(ctx, "run", "alice")
+	require.NoError(t, err)
+	require.Equal(t, repo.ImportRunRunning, resumed.State)
+	require.Empty(t, resumed.Error)
+	require.True(t, session.snapshot)
+	require.Equal(t, uint64(2), session.checkpoint.current())
+	require.Equal(t, []string{"1", "2"}, session.touchedRefs())
+
+	// the next upsert continues after the checkpoint
+	require.Equal(t, uint64(3), session.checkpoint.assign())
+
+	_, err = session.resume(ctx, "unknown", "alice")
+	require.Equal(t, connect.CodeNotFound, connect.CodeOf(err))
+
+	run.State = repo.ImportRunCompleted
+	require.NoError(t, store.StoreImportRun(ctx, run))
+
+	_, err = session.resume(ctx, "run", "alice")
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// the summary is attached for importers that lost the complete response
+	var connectErr *connect.Error
+	require.ErrorAs(t, err, &connectErr)
+	summary, err := importer.SummaryFromTrailer(connectErr.Meta())
+	require.NoError(t, err)
+	require.Equal(t, 3, summary.Created)
+
+	// runs can only be resumed by their owner
+	_, err = session.resume(ctx, "run", "bob")
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+
+	session.importer = "other"
+	_, err = session.resume(ctx, "run", "alice")
+	require.Equal(t, connect.CodePermissionDenied, connect.CodeOf(err))
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	for _, snapshot := range []bool{true, false} {
+		run := &repo.ImportRun{ID: "run", Importer: "test", Snapshot: snapshot}
+		require.NoError(t, store.StoreImportRun(ctx, run))
+
+		session := &ImportSession{
+			store:      store,
+			importer:   "test",
+			snapshot:   snapshot,
+			run:        run,
+			touched:    make(map[string]struct{}),
+			checkpoint: newCheckpoint(0),
+		}
+
+		session.touch("1")
+		session.touch("2")
+		session.saveCheckpoint(ctx)
+
+		// only references touched since the last checkpoint are stored
+		session.touch("2")
+		session.touch("3")
+		session.saveCheckpoint(ctx)
+
+		stored, err := store.GetImportRun(ctx, "run")
+		require.NoError(t, err)
+
+		if snapshot {
+			require.Equal(t, []string{"1", "2", "3"}, stored.Touched)
+		} else {
+			require.Empty(t, stored.Touched)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"context"
+	"sort"
+
+	"github.com/nyaruka/phonenumbers"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// createLockKeys returns the lock keys that must be held while creating a
+// new customer for importer and ref. Creates for the same reference or with
+// a common phone number are serialised so concurrent upserts of the same
+// person cannot both create a new customer record.
+func createLockKeys(importer, ref string, customer *customerv1.Customer) []string {
+	keys := map[string]struct{}{
+		"create:ref:" + importer + "/" + ref: {},
+	}
+
+	for _, phone := range customer.GetPhoneNumbers() {
+		if parsed, err := phonenumbers.Parse(phone, "AT"); err == nil {
+			phone = phonenumbers.Format(parsed, phonenumbers.E164)
+		}
+
+		keys["create:phone:"+phone] = struct{}{}
+	}
+
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+
+	// always lock in the same order to prevent dead-locks.
+	sort.Strings(result)
+
+	return result
+}
+
+// lockCreate acquires all create locks for importer and ref. The returned
+// function releases them again.
+func lockCreate(ctx context.Context, store repo.Repo, importer, ref string, customer *customerv1.Customer) (func(), error) {
+	var unlocks []func()
+
+	unlockAll := func() {
+		for idx := len(unlocks) - 1; idx >= 0; idx-- {
+			unlocks[idx]()
+		}
+	}
+
+	for _, key := range createLockKeys(importer, ref, customer) {
+		unlock, err := store.LockCustomer(ctx, key)
+		if err != nil {
+			unlockAll()
+
+			return func() {}, err
+		}
+
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+func TestConcurrentCreates(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 10)
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		// half of the upserts use the same reference, the others come from
+		// different importers but share the phone number.
+		importer, ref := "test", "1"
+		if i%2 == 1 {
+			importer, ref = fmt.Sprintf("importer-%d", i), "1"
+		}
+
+		session := &ImportSession{
+			store:    store,
+			importer: importer,
+			resolver: new(resolver),
+			strategy: DefaultMatchStrategy,
+		}
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, errs[i] = session.upsert(ctx, &customerv1.UpsertCustomerRequest{
+				InternalReference: ref,
+				Customer: &customerv1.Customer{
+					LastName:     "Doe",
+					PhoneNumbers: []string{"+43 1234 5678"},
+				},
+			})
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	customers, _, err := store.ListCustomers(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, customers, 1)
+	require.Len(t, customers[0].States, 6)
+}
+
+func TestCreateLockKeys(t *testing.T) {
+	keys := createLockKeys("test", "1", &customerv1.Customer{
+		PhoneNumbers: []string{"+43 1234 5678", "+4312345678"},
+	})
+
+	require.Equal(t, []string{
+		"create:phone:+4312345678",
+		"create:ref:test/1",
+	}, keys)
+}
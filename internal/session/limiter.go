@@ -0,0 +1,45 @@
+package session
+
+import "context"
+
+// Limiter bounds the number of import messages that are processed
+// concurrently across all import sessions. A nil Limiter does not impose
+// any limit.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a limiter that allows up to n messages to be processed
+// concurrently. If n is less or equal to zero nil is returned.
+func NewLimiter(n int) *Limiter {
+	if n <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Acquire blocks until a slot is available or ctx is cancelled.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release releases a slot acquired by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+}
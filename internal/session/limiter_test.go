@@ -0,0 +1,29 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1)
+
+	require.NoError(t, l.Acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, l.Acquire(ctx), context.DeadlineExceeded)
+
+	l.Release()
+	require.NoError(t, l.Acquire(context.Background()))
+
+	// a nil limiter never blocks
+	var unlimited *Limiter
+	require.Nil(t, NewLimiter(0))
+	require.NoError(t, unlimited.Acquire(context.Background()))
+	unlimited.Release()
+}
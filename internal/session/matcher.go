@@ -0,0 +1,222 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+	"google.golang.org/protobuf/proto"
+)
+
+// MatchDecision describes how an upserted customer has been matched to an
+// existing customer record.
+type MatchDecision string
+
+const (
+	MatchByRef         MatchDecision = "ref"
+	MatchByPhone       MatchDecision = "phone"
+	MatchByEmail       MatchDecision = "email"
+	MatchByNameAddress MatchDecision = "name-address"
+	MatchNew           MatchDecision = "new"
+	MatchAmbiguous     MatchDecision = "ambiguous"
+)
+
+// ErrNeedsReview is returned for upserts that matched more than one
+// existing customer and have been parked for manual review. The returned
+// error is an *importer.NeedsReviewError holding the candidate IDs.
+var ErrNeedsReview = importer.ErrNeedsReview
+
+// MatchStrategy configures which attributes are used to match an upserted
+// customer to an existing record if the internal reference is not yet
+// known.
+type MatchStrategy struct {
+	Phone       bool
+	Email       bool
+	NameAddress bool
+}
+
+// DefaultMatchStrategy matches customers by phone numbers and e-mail addresses.
+var DefaultMatchStrategy = MatchStrategy{
+	Phone: true,
+	Email: true,
+}
+
+// ParseMatchStrategy parses a comma separated list of "phone", "email" and
+// "name-address".
+func ParseMatchStrategy(s string) (MatchStrategy, error) {
+	var strategy MatchStrategy
+
+	for _, part := range strings.Split(s, ",") {
+		switch strings.TrimSpace(part) {
+		case "":
+		case string(MatchByPhone):
+			strategy.Phone = true
+		case string(MatchByEmail):
+			strategy.Email = true
+		case string(MatchByNameAddress):
+			strategy.NameAddress = true
+		default:
+			return strategy, fmt.Errorf("unsupported match strategy %q", part)
+		}
+	}
+
+	return strategy, nil
+}
+
+// Match is the result of matching an upserted customer to existing
+// records.
+type Match struct {
+	Decision MatchDecision
+
+	// Customer and States are set if Decision is neither MatchNew nor
+	// MatchAmbiguous.
+	Customer *customerv1.Customer
+	States   []*customerv1.ImportState
+
+	// Candidates holds the IDs of all matching customers.
+	Candidates []string
+}
+
+// Find searches for an existing customer record for the upserted customer.
+// Customers that are excluded from automatic matching for importer and ref
+// are ignored.
+func (strategy MatchStrategy) Find(ctx context.Context, store repo.Repo, importer, ref string, customer *customerv1.Customer) (*Match, error) {
+	if ref != "" {
+		c, states, _, err := store.LookupCustomerByRef(ctx, importer, ref)
+		if err != nil && !errors.Is(err, repo.ErrCustomerNotFound) {
+			return nil, err
+		}
+
+		if c != nil {
+			return &Match{
+				Decision:   MatchByRef,
+				Customer:   c,
+				States:     states,
+				Candidates: []string{c.Id},
+			}, nil
+		}
+	}
+
+	var (
+		candidates = make(map[string]*customerv1.CustomerResponse)
+		decision   MatchDecision
+	)
+
+	add := func(d MatchDecision, results []*customerv1.CustomerResponse) error {
+		for _, r := range results {
+			if _, ok := candidates[r.Customer.Id]; ok {
+				continue
+			}
+
+			excluded, err := store.IsMatchExcluded(ctx, r.Customer.Id, importer, ref)
+			if err != nil {
+				return err
+			}
+
+			if excluded {
+				continue
+			}
+
+			candidates[r.Customer.Id] = r
+
+			if decision == "" {
+				decision = d
+			}
+		}
+
+		return nil
+	}
+
+	if strategy.Phone {
+		for _, phone := range customer.PhoneNumbers {
+			res, _, err := store.LookupCustomerByPhone(ctx, phone, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := add(MatchByPhone, res); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if strategy.Email {
+		for _, mail := range customer.EmailAddresses {
+			res, _, err := store.LookupCustomerByMail(ctx, mail, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := add(MatchByEmail, res); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if strategy.NameAddress && customer.LastName != "" && len(customer.Addresses) > 0 {
+		res, _, err := store.LookupCustomerByName(ctx, customer.LastName, nil)
+		if err != nil && !errors.Is(err, repo.ErrCustomerNotFound) {
+			return nil, err
+		}
+
+		var filtered []*customerv1.CustomerResponse
+		for _, r := range res {
+			if sameNameAndAddress(r.Customer, customer) {
+				filtered = append(filtered, r)
+			}
+		}
+
+		if err := add(MatchByNameAddress, filtered); err != nil {
+			return nil, err
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return &Match{
+			Decision: MatchNew,
+		}, nil
+
+	case 1:
+		for _, c := range candidates {
+			return &Match{
+				Decision:   decision,
+				Customer:   c.Customer,
+				States:     c.States,
+				Candidates: []string{c.Customer.Id},
+			}, nil
+		}
+	}
+
+	match := &Match{
+		Decision: MatchAmbiguous,
+	}
+
+	for id := range candidates {
+		match.Candidates = append(match.Candidates, id)
+	}
+	sort.Strings(match.Candidates)
+
+	return match, nil
+}
+
+func sameNameAndAddress(a, b *customerv1.Customer) bool {
+	if !strings.EqualFold(a.LastName, b.LastName) || !strings.EqualFold(a.FirstName, b.FirstName) {
+		return false
+	}
+
+	for _, x := range a.Addresses {
+		for _, y := range b.Addresses {
+			if proto.Equal(x, y) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+func storeCustomer(t *testing.T, store repo.Repo, importer, ref string, customer *customerv1.Customer) string {
+	p := NewPatcher(importer, ref, new(resolver), nil, nil)
+	require.NoError(t, p.Apply(customer))
+	_, err := store.StoreCustomer(context.Background(), p.Result, p.States, 0)
+	require.NoError(t, err)
+
+	return p.Result.Id
+}
+
+func TestMatchStrategyFind(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	first := storeCustomer(t, store, "test", "1", &customerv1.Customer{
+		LastName:     "first",
+		PhoneNumbers: []string{"1234"},
+	})
+	second := storeCustomer(t, store, "test", "2", &customerv1.Customer{
+		LastName:       "second",
+		PhoneNumbers:   []string{"5678"},
+		EmailAddresses: []string{"foo@example.com"},
+	})
+
+	// matched by internal reference
+	match, err := DefaultMatchStrategy.Find(ctx, store, "test", "1", &customerv1.Customer{})
+	require.NoError(t, err)
+	require.Equal(t, MatchByRef, match.Decision)
+	require.Equal(t, first, match.Customer.Id)
+
+	// the second phone number must be considered as well
+	match, err = DefaultMatchStrategy.Find(ctx, store, "other", "1", &customerv1.Customer{
+		PhoneNumbers: []string{"0000", "5678"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MatchByPhone, match.Decision)
+	require.Equal(t, second, match.Customer.Id)
+
+	// matched by e-mail
+	match, err = DefaultMatchStrategy.Find(ctx, store, "other", "1", &customerv1.Customer{
+		EmailAddresses: []string{"foo@example.com"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MatchByEmail, match.Decision)
+
+	// matching multiple customers is ambiguous
+	match, err = DefaultMatchStrategy.Find(ctx, store, "other", "1", &customerv1.Customer{
+		PhoneNumbers: []string{"1234", "5678"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MatchAmbiguous, match.Decision)
+	require.ElementsMatch(t, []string{first, second}, match.Candidates)
+
+	// excluded customers are ignored
+	require.NoError(t, store.AddMatchExclusion(ctx, first, "other", "1"))
+	match, err = DefaultMatchStrategy.Find(ctx, store, "other", "1", &customerv1.Customer{
+		PhoneNumbers: []string{"1234", "5678"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MatchByPhone, match.Decision)
+	require.Equal(t, second, match.Customer.Id)
+
+	// nothing matched
+	match, err = DefaultMatchStrategy.Find(ctx, store, "other", "1", &customerv1.Customer{
+		PhoneNumbers: []string{"0000"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, MatchNew, match.Decision)
+}
+
+func TestParseMatchStrategy(t *testing.T) {
+	strategy, err := ParseMatchStrategy("phone, name-address")
+	require.NoError(t, err)
+	require.Equal(t, MatchStrategy{Phone: true, NameAddress: true}, strategy)
+
+	_, err = ParseMatchStrategy("phone,unknown")
+	require.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
 	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type PriorityResolver interface {
@@ -22,8 +23,13 @@ type Patcher struct {
 
 	resolver PriorityResolver
 
-	States       []*customerv1.ImportState
-	currentState *customerv1.ImportState
+	States         []*customerv1.ImportState
+	currentState   *customerv1.ImportState
+	existingStates []*customerv1.ImportState
+
+	// PrunedAttributes counts the attributes owned by the importer that have
+	// been removed by Apply because they are not present anymore.
+	PrunedAttributes int
 }
 
 func NewPatcher(importer, ref string, resolver PriorityResolver, existing *customerv1.Customer, states []*customerv1.ImportState) *Patcher {
@@ -39,21 +45,48 @@ func NewPatcher(importer, ref string, resolver PriorityResolver, existing *custo
 	}
 
 	// now, find the importer state (or create a new one)
-	statesCopy, currentState := findImporterState(importer, ref, states)
+	statesCopy, currentState := findImporterState(importer, ref, statesCopy)
 
 	p := &Patcher{
-		Existing:     existing,
-		Result:       result,
-		States:       statesCopy,
-		Importer:     importer,
-		Ref:          ref,
-		currentState: currentState,
-		resolver:     resolver,
+		Existing:       existing,
+		Result:         result,
+		States:         statesCopy,
+		Importer:       importer,
+		Ref:            ref,
+		currentState:   currentState,
+		existingStates: states,
+		resolver:       resolver,
 	}
 
 	return p
 }
 
+// Pristine reports whether Apply did neither modify the customer nor any
+// of the import states.
+func (p *Patcher) Pristine() bool {
+	if !proto.Equal(p.Existing, p.Result) || len(p.existingStates) != len(p.States) {
+		return false
+	}
+
+	for idx := range p.States {
+		if !proto.Equal(p.existingStates[idx], p.States[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetExtraData replaces the importer specific extra data of the import state.
+// Empty extra data removes it.
+func (p *Patcher) SetExtraData(extra *structpb.Struct) {
+	if len(extra.GetFields()) == 0 {
+		extra = nil
+	}
+
+	p.currentState.ExtraData = extra
+}
+
 func (p *Patcher) canSet(owners []string) bool {
 	return p.resolver.IsAllowed(p.Importer, owners)
 }
@@ -246,6 +279,7 @@ func (p *Patcher) pruneAttributes(importedCustomer *customerv1.Customer) error {
 			newList = append(newList, existingOwnedAttr)
 		} else {
 			slog.Info("pruning attribute", slog.String("importer", p.Importer), slog.Any("attribute", existingOwnedAttr))
+			p.PrunedAttributes++
 		}
 	}
 
@@ -2,15 +2,20 @@ package session
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
+	"net/http"
+	"strconv"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	"github.com/bufbuild/connect-go"
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
 	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
 )
 
 type ImportStream = connect.BidiStream[customerv1.ImportSessionRequest, customerv1.ImportSessionResponse]
@@ -21,20 +26,84 @@ type ImportSession struct {
 	wg       sync.WaitGroup
 	importer string
 	resolver PriorityResolver
+	strategy MatchStrategy
+	workers  int
+	limiter  *Limiter
+	dryRun   bool
+
+	// run is the history record of the session. checkpoint tracks the
+	// number of upserts processed so the session can be resumed.
+	runL       sync.Mutex
+	run        *repo.ImportRun
+	checkpoint *checkpoint
+
+	// snapshot is set for full snapshot sessions. touched holds all
+	// references upserted during the session and unsaved those of snapshot
+	// sessions that have not been stored with a checkpoint yet.
+	snapshot  bool
+	maxRemove float64
+	touchedL  sync.Mutex
+	touched   map[string]struct{}
+	unsaved   []string
 
 	sendQueue chan *customerv1.ImportSessionResponse
 
-	upserts          atomic.Uint64
-	attributeUpdates atomic.Uint64
-	lookups          atomic.Uint64
+	stats sessionStats
 }
 
-func NewImportSession(stream *ImportStream, store repo.Repo, resolver PriorityResolver) *ImportSession {
+// DefaultWorkers is the number of workers used per import session if not
+// configured otherwise.
+const DefaultWorkers = 8
+
+// DefaultSnapshotMaxRemove is the default fraction of import states that a
+// full snapshot session may remove.
+const DefaultSnapshotMaxRemove = 0.1
+
+// Options configures import sessions.
+type Options struct {
+	Strategy MatchStrategy
+
+	// Workers is the number of messages processed concurrently per session.
+	Workers int
+
+	// Limiter limits the number of messages processed concurrently across
+	// all sessions and may be nil.
+	Limiter *Limiter
+
+	// Batcher collects the customer writes of all sessions and may be nil.
+	// It must write to the store of the sessions.
+	Batcher *WriteBatcher
+
+	// SnapshotMaxRemove is the maximum fraction of the importer's states that
+	// a full snapshot session may remove. Importers may override it using
+	// the importer.SnapshotMaxRemoveHeader.
+	SnapshotMaxRemove float64
+}
+
+func NewImportSession(stream *ImportStream, store repo.Repo, resolver PriorityResolver, opts Options) *ImportSession {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	if opts.SnapshotMaxRemove <= 0 {
+		opts.SnapshotMaxRemove = DefaultSnapshotMaxRemove
+	}
+
+	if opts.Batcher != nil {
+		store = &batchedStore{Repo: store, batcher: opts.Batcher}
+	}
+
 	return &ImportSession{
-		resolver:  resolver,
-		stream:    stream,
-		store:     store,
-		sendQueue: make(chan *customerv1.ImportSessionResponse, 100),
+		resolver:   resolver,
+		strategy:   opts.Strategy,
+		workers:    opts.Workers,
+		limiter:    opts.Limiter,
+		maxRemove:  opts.SnapshotMaxRemove,
+		touched:    make(map[string]struct{}),
+		checkpoint: newCheckpoint(0),
+		stream:     stream,
+		store:      store,
+		sendQueue:  make(chan *customerv1.ImportSessionResponse, 100),
 	}
 }
 
@@ -58,6 +127,57 @@ func (session *ImportSession) Handle(ctx context.Context) error {
 		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid importer field in start_session request"))
 	}
 
+	ctx = repo.WithLockOwner(ctx, "import:"+session.importer)
+
+	header := session.stream.RequestHeader()
+
+	id := header.Get(importer.ResumeSessionHeader)
+	resuming := id != ""
+	if !resuming {
+		id = importer.GenerateCorrelationId(32)
+	}
+
+	// the run is locked while the session is active so a resumed session
+	// waits until the interrupted one has been cleaned up.
+	unlock, err := session.store.LockCustomer(ctx, "import-run:"+id)
+	if err != nil {
+		return fmt.Errorf("failed to lock import run: %w", err)
+	}
+	defer unlock()
+
+	if resuming {
+		session.run, err = session.resume(ctx, id, header.Get("X-Remote-User"))
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := session.parseOptions(header); err != nil {
+			return err
+		}
+
+		session.stats.summary.Importer = session.importer
+		session.stats.summary.RunID = id
+		session.stats.summary.StartedAt = time.Now()
+		session.stats.summary.DryRun = session.dryRun
+
+		session.run = &repo.ImportRun{
+			ID:                id,
+			Importer:          session.importer,
+			Caller:            header.Get("X-Remote-User"),
+			State:             repo.ImportRunRunning,
+			StartedAt:         session.stats.summary.StartedAt,
+			Snapshot:          session.snapshot,
+			SnapshotMaxRemove: session.maxRemove,
+		}
+	}
+
+	if err := session.store.StoreImportRun(ctx, session.run); err != nil {
+		slog.ErrorContext(ctx, "failed to store import run", slog.Any("error", err.Error()))
+	}
+
+	session.stream.ResponseHeader().Set(importer.SessionIdHeader, session.run.ID)
+	session.stream.ResponseHeader().Set(importer.CheckpointHeader, strconv.FormatUint(session.run.Checkpoint, 10))
+
 	if err := session.stream.Send(&customerv1.ImportSessionResponse{
 		CorrelationId: msg.CorrelationId,
 		Message:       &customerv1.ImportSessionResponse_StartSession{},
@@ -68,6 +188,30 @@ func (session *ImportSession) Handle(ctx context.Context) error {
 	session.wg.Add(1)
 	go session.sendLoop(ctx)
 
+	// queues are unbuffered so we stop receiving while workers are busy.
+	// This pushes back to the importer using HTTP/2 flow control.
+	//
+	// Messages that refer to an internal reference are always dispatched to
+	// the same worker so they are processed in order. All other messages
+	// are handled by the next free worker.
+	var (
+		shared  = make(chan queuedMessage)
+		queues  = make([]chan queuedMessage, session.workers)
+		workers sync.WaitGroup
+	)
+
+	for i := range queues {
+		queues[i] = make(chan queuedMessage)
+
+		workers.Add(1)
+		go session.worker(ctx, queues[i], shared, &workers)
+	}
+
+	// abortErr is set if the import session ended without a complete
+	// message.
+	var abortErr error
+
+L:
 	for {
 		msg, err := session.stream.Receive()
 		if err != nil {
@@ -76,6 +220,7 @@ func (session *ImportSession) Handle(ctx context.Context) error {
 				Value: slog.StringValue(err.Error()),
 			})
 
+			abortErr = err
 			break
 		}
 
@@ -84,27 +229,175 @@ func (session *ImportSession) Handle(ctx context.Context) error {
 			break
 		}
 
-		session.wg.Add(1)
-		go session.handleMessage(ctx, msg)
+		queued := queuedMessage{msg: msg}
+		if _, ok := msg.Message.(*customerv1.ImportSessionRequest_UpsertCustomer); ok {
+			queued.seq = session.checkpoint.assign()
+		}
+
+		queue := shared
+		if ref := session.messageRef(msg); ref != "" {
+			h := fnv.New32a()
+			h.Write([]byte(ref))
+
+			queue = queues[h.Sum32()%uint32(len(queues))]
+		}
+
+		select {
+		case queue <- queued:
+		case <-ctx.Done():
+			abortErr = ctx.Err()
+			break L
+		}
+	}
+
+	// all workers must be finished before closing the send queue.
+	close(shared)
+	for _, q := range queues {
+		close(q)
 	}
+	workers.Wait()
 
 	close(session.sendQueue)
 	session.wg.Wait()
 
-	slog.Info("import session complete", "identifier", session.importer, "upserts", session.upserts.Load(), "lookups", session.lookups.Load(), "attribute-updates", session.attributeUpdates.Load())
+	// only complete sessions may remove orphaned states, otherwise we
+	// would remove everything that has not been sent yet.
+	if session.snapshot && abortErr == nil {
+		if err := session.removeOrphans(ctx, session.maxRemove); err != nil {
+			slog.ErrorContext(ctx, "failed to remove orphaned import states", slog.Any("error", err.Error()))
+
+			// an aborted snapshot is reported using SnapshotAborted
+			if !errors.Is(err, ErrTooManyOrphans) {
+				session.stats.failed(err)
+			}
+		}
+	}
+
+	session.runL.Lock()
+	run := session.run
+	run.FinishedAt = time.Now()
+	session.stats.record(run)
+	summary := run.Summary
+	run.Checkpoint = session.checkpoint.current()
+	run.State = repo.ImportRunCompleted
+	run.Touched = nil
+	if abortErr != nil {
+		run.State = repo.ImportRunAborted
+		run.Error = abortErr.Error()
+
+		// only snapshot runs need the touched references when resumed.
+		if session.snapshot {
+			run.Touched = session.touchedRefs()
+		}
+	}
+
+	// the request context is likely cancelled if the session was aborted
+	// but we still want to record that.
+	if err := session.store.StoreImportRun(context.WithoutCancel(ctx), run); err != nil {
+		slog.ErrorContext(ctx, "failed to store import run", slog.Any("error", err.Error()))
+	}
+	session.runL.Unlock()
+
+	slog.Info("import session complete", "identifier", session.importer, "created", summary.Created, "updated", summary.Updated, "pristine", summary.Pristine, "failed", summary.Failed, "lookups", summary.Lookups, "attribute-updates", summary.AttributeUpdates, "pruned-attributes", summary.PrunedAttributes, "duration", summary.Duration)
+
+	// the summary cannot be sent as a message since there's no response
+	// type for it so we return it as a trailer instead.
+	if blob, err := json.Marshal(summary); err == nil {
+		session.stream.ResponseTrailer().Set(importer.SummaryTrailer, string(blob))
+	} else {
+		slog.ErrorContext(ctx, "failed to encode session summary", slog.Any("error", err.Error()))
+	}
 
 	return nil
 }
 
-func (session *ImportSession) handleMessage(ctx context.Context, msg *customerv1.ImportSessionRequest) {
-	defer session.wg.Done()
+// parseOptions configures the session from the request headers sent by the
+// importer.
+func (session *ImportSession) parseOptions(header http.Header) error {
+	session.dryRun, _ = strconv.ParseBool(header.Get(importer.DryRunHeader))
+	session.snapshot, _ = strconv.ParseBool(header.Get(importer.SnapshotHeader))
+
+	if value := header.Get(importer.SnapshotMaxRemoveHeader); value != "" {
+		maxRemove, err := strconv.ParseFloat(value, 64)
+		if err != nil || maxRemove < 0 || maxRemove > 1 {
+			return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("invalid value for %s: %q", importer.SnapshotMaxRemoveHeader, value))
+		}
+
+		session.maxRemove = maxRemove
+	}
+
+	return nil
+}
+
+// queuedMessage is a received message waiting to be processed by a worker.
+// Upserts carry their sequence number used for checkpointing.
+type queuedMessage struct {
+	msg *customerv1.ImportSessionRequest
+	seq uint64
+}
+
+func (session *ImportSession) worker(ctx context.Context, own, shared <-chan queuedMessage, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for own != nil || shared != nil {
+		var (
+			msg queuedMessage
+			ok  bool
+		)
+
+		select {
+		case msg, ok = <-own:
+			if !ok {
+				own = nil
+				continue
+			}
+		case msg, ok = <-shared:
+			if !ok {
+				shared = nil
+				continue
+			}
+		}
+
+		if err := session.limiter.Acquire(ctx); err != nil {
+			return
+		}
+
+		session.handleMessage(ctx, msg.msg)
+
+		session.limiter.Release()
+
+		if msg.seq > 0 && session.checkpoint.ack(msg.seq) {
+			session.saveCheckpoint(ctx)
+		}
+	}
+}
+
+// messageRef returns the internal reference msg refers to or an empty
+// string.
+func (session *ImportSession) messageRef(msg *customerv1.ImportSessionRequest) string {
+	switch v := msg.Message.(type) {
+	case *customerv1.ImportSessionRequest_UpsertCustomer:
+		return v.UpsertCustomer.GetInternalReference()
+
+	case *customerv1.ImportSessionRequest_LookupCustomer:
+		if ref := v.LookupCustomer.GetQuery().GetInternalReference(); ref != nil {
+			if ref.Importer == "" || ref.Importer == session.importer {
+				return ref.Ref
+			}
+		}
+	}
+
+	return ""
+}
 
+func (session *ImportSession) handleMessage(ctx context.Context, msg *customerv1.ImportSessionRequest) {
 	switch v := msg.Message.(type) {
 	case *customerv1.ImportSessionRequest_LookupCustomer:
 		session.handleCustomerLookup(ctx, msg.CorrelationId, v)
 
 	case *customerv1.ImportSessionRequest_UpsertCustomer:
 		if err := session.handleUpsert(ctx, msg.CorrelationId, v); err != nil {
+			session.stats.failed(err)
 			session.sendError(ctx, msg.CorrelationId, err)
 		}
 
@@ -117,12 +410,20 @@ func (session *ImportSession) handleMessage(ctx context.Context, msg *customerv1
 }
 
 func (session *ImportSession) sendError(ctx context.Context, id string, err error) {
+	payload := []string{err.Error()}
+
+	// importers need the candidates to tell parked upserts from failed ones.
+	var review *importer.NeedsReviewError
+	if errors.As(err, &review) {
+		payload = review.Payload()
+	}
+
 	select {
 	case session.sendQueue <- &customerv1.ImportSessionResponse{
 		CorrelationId: id,
 		Message: &customerv1.ImportSessionResponse_Error{
 			Error: &customerv1.Error{
-				Error: []string{err.Error()},
+				Error: payload,
 			},
 		},
 	}:
@@ -131,7 +432,7 @@ func (session *ImportSession) sendError(ctx context.Context, id string, err erro
 }
 
 func (session *ImportSession) handleCustomerLookup(ctx context.Context, correlationId string, msg *customerv1.ImportSessionRequest_LookupCustomer) {
-	session.lookups.Add(1)
+	session.stats.lookup()
 
 	if v := msg.LookupCustomer.GetQuery().GetInternalReference(); v != nil && v.Importer == "" {
 		v.Importer = session.importer
@@ -167,68 +468,197 @@ func (session *ImportSession) handleCustomerLookup(ctx context.Context, correlat
 }
 
 func (session *ImportSession) handleUpsert(ctx context.Context, correlationId string, msg *customerv1.ImportSessionRequest_UpsertCustomer) error {
-	var (
-		customer *customerv1.Customer
-		states   []*customerv1.ImportState
-		err      error
-	)
+	// failed upserts count as touched as well so we never remove states just
+	// because the upsert failed.
+	session.touch(msg.UpsertCustomer.InternalReference)
 
-	if msg.UpsertCustomer.InternalReference != "" {
-		customer, states, err = session.store.LookupCustomerByRef(ctx, session.importer, msg.UpsertCustomer.InternalReference)
-		if err != nil && !errors.Is(err, repo.ErrCustomerNotFound) {
-			return err
+	result, err := session.upsert(ctx, msg.UpsertCustomer)
+	if err != nil {
+		return err
+	}
+
+	session.stats.upserted(result)
+	if session.dryRun {
+		session.stats.diff(msg.UpsertCustomer.InternalReference, result)
+	}
+
+	// the response can only carry the customer id. The match decision is
+	// reported with the summary and the dry-run diffs.
+	select {
+	case session.sendQueue <- &customerv1.ImportSessionResponse{
+		CorrelationId: correlationId,
+		Message: &customerv1.ImportSessionResponse_UpsertSuccess{
+			UpsertSuccess: &customerv1.UpsertCustomerSuccess{
+				Id: result.Customer.Id,
+			},
+		},
+	}:
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// upsert matches upsert to an existing customer record and applies it.
+// Creates of new customers are serialised using the create locks.
+func (session *ImportSession) upsert(ctx context.Context, upsert *customerv1.UpsertCustomerRequest) (*UpsertResult, error) {
+	ref := upsert.InternalReference
+
+	match, err := session.strategy.Find(ctx, session.store, session.importer, ref, upsert.GetCustomer())
+	if err != nil {
+		return nil, err
+	}
+
+	if match.Decision == MatchNew {
+		unlock, err := lockCreate(ctx, session.store, session.importer, ref, upsert.GetCustomer())
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		// a concurrent upsert might have created the customer while we were
+		// waiting for the lock.
+		match, err = session.strategy.Find(ctx, session.store, session.importer, ref, upsert.GetCustomer())
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// try to find by phone number
-	if customer == nil {
-		for _, phone := range msg.UpsertCustomer.Customer.PhoneNumbers {
-			res, _, err := session.store.LookupCustomerByPhone(ctx, phone, nil)
-			if err != nil {
-				return err
-			}
+	slog.InfoContext(ctx, "matched upserted customer", "importer", session.importer, "ref", ref, "decision", match.Decision, "candidates", match.Candidates)
 
-			if len(res) == 1 {
-				customer = res[0].Customer
-				states = res[0].States
-			}
+	if match.Decision == MatchAmbiguous && session.dryRun {
+		return nil, &importer.NeedsReviewError{Candidates: match.Candidates}
+	}
 
-			break
+	if match.Decision == MatchAmbiguous {
+		if err := session.store.StorePendingUpsert(ctx, &repo.PendingUpsert{
+			ID:         repo.PendingUpsertID(session.importer, ref),
+			Importer:   session.importer,
+			Upsert:     upsert,
+			Candidates: match.Candidates,
+			CreatedAt:  time.Now(),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to park upsert for review: %w", err)
 		}
+
+		return nil, &importer.NeedsReviewError{Candidates: match.Candidates}
+	}
+
+	var id string
+	if match.Customer != nil {
+		id = match.Customer.Id
 	}
 
-	if customer != nil && customer.Id != "" {
-		unlock, err := session.store.LockCustomer(ctx, customer.Id)
+	if session.dryRun {
+		result, err := PreviewUpsert(ctx, session.store, session.resolver, session.importer, id, upsert)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		result.Decision, result.Candidates = match.Decision, match.Candidates
+
+		return result, nil
+	}
+
+	result, err := ApplyUpsert(ctx, session.store, session.resolver, session.importer, id, upsert)
+	if errors.Is(err, repo.ErrDuplicateImportState) && id == "" {
+		// we lost the race against a concurrent create for the same reference
+		// so apply the upsert to the winner instead.
+		winner, _, _, lookupErr := session.store.LookupCustomerByRef(ctx, session.importer, ref)
+		if lookupErr == nil {
+			slog.InfoContext(ctx, "customer created concurrently, applying upsert to existing record", "importer", session.importer, "ref", ref, "id", winner.Id)
+
+			match = &Match{Decision: MatchByRef, Candidates: []string{winner.Id}}
+			result, err = ApplyUpsert(ctx, session.store, session.resolver, session.importer, winner.Id, upsert)
 		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.Decision, result.Candidates = match.Decision, match.Candidates
+
+	return result, nil
+}
+
+// maxStoreAttempts limits how often an upsert is re-applied if the customer
+// record has been modified concurrently.
+const maxStoreAttempts = 5
 
+// ApplyUpsert applies upsert on behalf of importer to the customer with the
+// given id. If id is empty a new customer is created. If the customer is
+// modified concurrently the upsert is re-applied to the updated record.
+func ApplyUpsert(ctx context.Context, store repo.Repo, resolver PriorityResolver, importer, id string, upsert *customerv1.UpsertCustomerRequest) (*UpsertResult, error) {
+	if id != "" {
+		unlock, err := store.LockCustomer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
 		defer unlock()
 	}
 
-	p := NewPatcher(session.importer, msg.UpsertCustomer.InternalReference, session.resolver, customer, states)
+	for attempt := 1; ; attempt++ {
+		p, revision, err := patchUpsert(ctx, store, resolver, importer, id, upsert)
+		if err != nil {
+			return nil, err
+		}
+
+		// there's no need to rewrite the whole document if nothing changed.
+		if id != "" && p.Pristine() {
+			return newUpsertResult(p, false), nil
+		}
+
+		_, err = store.StoreCustomer(ctx, p.Result, p.States, revision)
+		if err == nil {
+			return newUpsertResult(p, id == ""), nil
+		}
+
+		if !errors.Is(err, repo.ErrRevisionConflict) || attempt >= maxStoreAttempts {
+			return nil, fmt.Errorf("failed to store customer: %w", err)
+		}
 
-	if err := p.Apply(msg.UpsertCustomer.GetCustomer()); err != nil {
-		return fmt.Errorf("failed to apply updates: %w", err)
+		slog.WarnContext(ctx, "customer modified concurrently, re-applying upsert", "id", id, "importer", importer, "attempt", attempt)
 	}
+}
 
-	if err := session.store.StoreCustomer(ctx, p.Result, p.States); err != nil {
-		return fmt.Errorf("failed to store customer: %w", err)
+// PreviewUpsert is like ApplyUpsert but does not store the result.
+func PreviewUpsert(ctx context.Context, store repo.Repo, resolver PriorityResolver, importer, id string, upsert *customerv1.UpsertCustomerRequest) (*UpsertResult, error) {
+	p, _, err := patchUpsert(ctx, store, resolver, importer, id, upsert)
+	if err != nil {
+		return nil, err
 	}
 
-	select {
-	case session.sendQueue <- &customerv1.ImportSessionResponse{
-		CorrelationId: correlationId,
-		Message: &customerv1.ImportSessionResponse_UpsertSuccess{
-			UpsertSuccess: &customerv1.UpsertCustomerSuccess{
-				Id: p.Result.Id,
-			},
-		},
-	}:
-	case <-ctx.Done():
+	return newUpsertResult(p, id == ""), nil
+}
+
+// patchUpsert loads the customer with the given id, if any, and applies
+// upsert. It returns the patcher and the revision of the loaded customer.
+func patchUpsert(ctx context.Context, store repo.Repo, resolver PriorityResolver, importer, id string, upsert *customerv1.UpsertCustomerRequest) (*Patcher, uint64, error) {
+	var (
+		customer *customerv1.Customer
+		states   []*customerv1.ImportState
+		revision uint64
+	)
+
+	if id != "" {
+		var err error
+
+		customer, states, revision, err = store.LookupCustomerById(ctx, id)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 
-	return nil
+	p := NewPatcher(importer, upsert.InternalReference, resolver, customer, states)
+
+	if err := p.Apply(upsert.GetCustomer()); err != nil {
+		return nil, 0, fmt.Errorf("failed to apply updates: %w", err)
+	}
+
+	p.SetExtraData(upsert.ExtraData)
+
+	return p, revision, nil
 }
 
 func (session *ImportSession) findImporterState(states []*customerv1.ImportState) *customerv1.ImportState {
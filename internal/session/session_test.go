@@ -0,0 +1,280 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1/customerv1connect"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+func TestMessageRef(t *testing.T) {
+	session := &ImportSession{importer: "test"}
+
+	lookup := func(importer, ref string) *customerv1.ImportSessionRequest {
+		return &customerv1.ImportSessionRequest{
+			Message: &customerv1.ImportSessionRequest_LookupCustomer{
+				LookupCustomer: &customerv1.LookupCustomerRequest{
+					Query: &customerv1.CustomerQuery{
+						Query: &customerv1.CustomerQuery_InternalReference{
+							InternalReference: &customerv1.InternalReferenceQuery{
+								Importer: importer,
+								Ref:      ref,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	require.Equal(t, "1", session.messageRef(&customerv1.ImportSessionRequest{
+		Message: &customerv1.ImportSessionRequest_UpsertCustomer{
+			UpsertCustomer: &customerv1.UpsertCustomerRequest{
+				InternalReference: "1",
+			},
+		},
+	}))
+
+	require.Equal(t, "2", session.messageRef(lookup("", "2")))
+	require.Equal(t, "2", session.messageRef(lookup("test", "2")))
+
+	// lookups for other importers are unrelated
+	require.Equal(t, "", session.messageRef(lookup("other", "2")))
+}
+
+func TestDryRunUpsert(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	session := &ImportSession{
+		store:    store,
+		importer: "test",
+		resolver: new(resolver),
+		strategy: DefaultMatchStrategy,
+		dryRun:   true,
+	}
+
+	result, err := session.upsert(ctx, &customerv1.UpsertCustomerRequest{
+		InternalReference: "1",
+		Customer: &customerv1.Customer{
+			LastName:     "Doe",
+			PhoneNumbers: []string{"1234"},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, result.Created)
+	require.Len(t, result.Changes, 2)
+
+	customers, _, err := store.ListCustomers(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, customers)
+}
+
+func TestUpsertDecision(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	session := &ImportSession{
+		store:    store,
+		importer: "test",
+		resolver: new(resolver),
+		strategy: DefaultMatchStrategy,
+	}
+
+	upsert := func(ref string, phones ...string) (*UpsertResult, error) {
+		result, err := session.upsert(ctx, &customerv1.UpsertCustomerRequest{
+			InternalReference: ref,
+			Customer: &customerv1.Customer{
+				LastName:     "Doe",
+				PhoneNumbers: phones,
+			},
+		})
+		if err != nil {
+			session.stats.failed(err)
+		} else {
+			session.stats.upserted(result)
+		}
+
+		return result, err
+	}
+
+	first, err := upsert("1", "1234")
+	require.NoError(t, err)
+	require.Equal(t, MatchNew, first.Decision)
+
+	second, err := upsert("2", "5678")
+	require.NoError(t, err)
+	require.Equal(t, MatchNew, second.Decision)
+
+	result, err := upsert("1", "1234")
+	require.NoError(t, err)
+	require.Equal(t, MatchByRef, result.Decision)
+	require.Equal(t, []string{first.Customer.Id}, result.Candidates)
+
+	result, err = upsert("3", "1234")
+	require.NoError(t, err)
+	require.Equal(t, MatchByPhone, result.Decision)
+
+	// matches both customers and is parked
+	_, err = upsert("4", "1234", "5678")
+	require.ErrorIs(t, err, ErrNeedsReview)
+
+	var review *importer.NeedsReviewError
+	require.ErrorAs(t, err, &review)
+	require.ElementsMatch(t, []string{first.Customer.Id, second.Customer.Id}, review.Candidates)
+
+	summary := session.stats.finish()
+	require.Equal(t, map[string]int{"new": 2, "ref": 1, "phone": 1}, summary.Matches)
+	require.Equal(t, 1, summary.NeedsReview)
+	require.Zero(t, summary.Failed)
+	require.Equal(t, 5, summary.Upserts())
+}
+
+// blockingStore holds back the first write of ref "a" until a customer of
+// ref "b" has been stored.
+type blockingStore struct {
+	repo.Repo
+
+	once    sync.Once
+	release chan struct{}
+}
+
+func (s *blockingStore) StoreCustomer(ctx context.Context, customer *customerv1.Customer, states []*customerv1.ImportState, revision uint64) (uint64, error) {
+	switch customer.LastName {
+	case "a-0":
+		select {
+		case <-s.release:
+		case <-time.After(5 * time.Second):
+			return 0, fmt.Errorf("upserts of different references are not processed concurrently")
+		}
+
+	case "b-0":
+		defer s.once.Do(func() { close(s.release) })
+	}
+
+	return s.Repo.StoreCustomer(ctx, customer, states, revision)
+}
+
+type testImportService struct {
+	store repo.Repo
+
+	customerv1connect.UnimplementedCustomerImportServiceHandler
+}
+
+func (svc *testImportService) ImportSession(ctx context.Context, stream *ImportStream) error {
+	return NewImportSession(stream, svc.store, new(resolver), Options{
+		Strategy: DefaultMatchStrategy,
+		Workers:  4,
+	}).Handle(ctx)
+}
+
+func TestSessionOrdering(t *testing.T) {
+	ctx := context.Background()
+	store := &blockingStore{
+		Repo:    repo.New(inmem.New()),
+		release: make(chan struct{}),
+	}
+
+	bucket := func(ref string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(ref))
+
+		return h.Sum32() % 4
+	}
+	require.NotEqual(t, bucket("a"), bucket("b"), "the references must be handled by different workers")
+
+	_, handler := customerv1connect.NewCustomerImportServiceHandler(&testImportService{store: store})
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	stream := customerv1connect.NewCustomerImportServiceClient(srv.Client(), srv.URL).ImportSession(ctx)
+
+	require.NoError(t, stream.Send(&customerv1.ImportSessionRequest{
+		CorrelationId: "start",
+		Message: &customerv1.ImportSessionRequest_StartSession{
+			StartSession: &customerv1.StartSessionRequest{Importer: "test"},
+		},
+	}))
+
+	res, err := stream.Receive()
+	require.NoError(t, err)
+	require.NotNil(t, res.GetStartSession())
+
+	// upserts of both references are interleaved and the values of each
+	// reference change with every upsert.
+	const count = 5
+
+	for idx := 0; idx < count; idx++ {
+		for _, ref := range []string{"a", "b"} {
+			id := fmt.Sprintf("%s-%d", ref, idx)
+
+			require.NoError(t, stream.Send(&customerv1.ImportSessionRequest{
+				CorrelationId: id,
+				Message: &customerv1.ImportSessionRequest_UpsertCustomer{
+					UpsertCustomer: &customerv1.UpsertCustomerRequest{
+						InternalReference: ref,
+						Customer: &customerv1.Customer{
+							LastName: id,
+						},
+					},
+				},
+			}))
+		}
+	}
+
+	require.NoError(t, stream.Send(&customerv1.ImportSessionRequest{
+		Message: &customerv1.ImportSessionRequest_Complete{},
+	}))
+	require.NoError(t, stream.CloseRequest())
+
+	var (
+		order    []string
+		received = make(map[string][]string)
+	)
+
+	for {
+		res, err := stream.Receive()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		require.NotNil(t, res.GetUpsertSuccess(), "upsert %s failed: %v", res.CorrelationId, res.Message)
+
+		ref, _, _ := strings.Cut(res.CorrelationId, "-")
+		received[ref] = append(received[ref], res.CorrelationId)
+		order = append(order, res.CorrelationId)
+	}
+	require.NoError(t, stream.CloseResponse())
+
+	// responses of the same reference are sent in order while b-0 has
+	// been answered first since it was processed while a-0 waited for it.
+	require.Equal(t, []string{"a-0", "a-1", "a-2", "a-3", "a-4"}, received["a"])
+	require.Equal(t, []string{"b-0", "b-1", "b-2", "b-3", "b-4"}, received["b"])
+	require.Less(t, slices.Index(order, "b-0"), slices.Index(order, "a-0"))
+
+	customers, _, err := store.ListCustomers(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, customers, 2)
+
+	for _, c := range customers {
+		require.Len(t, c.States, 1)
+		require.Equal(t, c.States[0].InternalReference+"-4", c.Customer.LastName)
+	}
+}
@@ -0,0 +1,157 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+)
+
+// ErrTooManyOrphans is returned if a full snapshot session would remove more
+// import states than allowed.
+var ErrTooManyOrphans = errors.New("too many orphaned import states")
+
+// orphan is an import state that has not been touched during a full
+// snapshot session.
+type orphan struct {
+	customerId string
+	ref        string
+}
+
+func (session *ImportSession) touch(ref string) {
+	session.touchedL.Lock()
+	defer session.touchedL.Unlock()
+
+	if _, ok := session.touched[ref]; ok {
+		return
+	}
+
+	session.touched[ref] = struct{}{}
+
+	if session.snapshot {
+		session.unsaved = append(session.unsaved, ref)
+	}
+}
+
+// findOrphans returns all import states of the session importer that have
+// not been touched and the total number of import states of the importer.
+func (session *ImportSession) findOrphans(ctx context.Context) ([]orphan, int, error) {
+	customers, _, err := session.store.ListCustomers(ctx, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list customers: %w", err)
+	}
+
+	session.touchedL.Lock()
+	defer session.touchedL.Unlock()
+
+	var (
+		orphans []orphan
+		total   int
+	)
+
+	for _, c := range customers {
+		for _, s := range c.States {
+			if s.Importer != session.importer {
+				continue
+			}
+
+			total++
+
+			if _, ok := session.touched[s.InternalReference]; !ok {
+				orphans = append(orphans, orphan{
+					customerId: c.Customer.Id,
+					ref:        s.InternalReference,
+				})
+			}
+		}
+	}
+
+	return orphans, total, nil
+}
+
+// removeOrphans removes all import states of the session importer that have
+// not been touched during the session. Nothing is removed if more than
+// maxRemove of the importer's states would be removed.
+func (session *ImportSession) removeOrphans(ctx context.Context, maxRemove float64) error {
+	orphans, total, err := session.findOrphans(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	if float64(len(orphans)) > maxRemove*float64(total) {
+		session.stats.snapshotAborted()
+
+		return fmt.Errorf("%w: %d of %d states would be removed, at most %.0f%% are allowed", ErrTooManyOrphans, len(orphans), total, maxRemove*100)
+	}
+
+	for _, o := range orphans {
+		if session.dryRun {
+			session.stats.removed(false, 0)
+			continue
+		}
+
+		deleted, pruned, err := RemoveImportState(ctx, session.store, session.resolver, session.importer, o.ref, o.customerId)
+		if err != nil {
+			session.stats.failed(fmt.Errorf("failed to remove orphaned state %q from customer %q: %w", o.ref, o.customerId, err))
+			continue
+		}
+
+		session.stats.removed(deleted, pruned)
+	}
+
+	slog.InfoContext(ctx, "removed orphaned import states", "importer", session.importer, "count", len(orphans), "dry-run", session.dryRun)
+
+	return nil
+}
+
+// RemoveImportState removes the import state identified by importer and ref
+// from the customer with the given id. All attributes only owned by that
+// state are pruned. If no other state is left the customer is deleted. It
+// returns whether the customer has been deleted and the number of pruned
+// attributes.
+func RemoveImportState(ctx context.Context, store repo.Repo, resolver PriorityResolver, importer, ref, id string) (bool, int, error) {
+	unlock, err := store.LockCustomer(ctx, id)
+	if err != nil {
+		return false, 0, err
+	}
+	defer unlock()
+
+	customer, states, revision, err := store.LookupCustomerById(ctx, id)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// applying an empty customer prunes all attributes owned by the state
+	p := NewPatcher(importer, ref, resolver, customer, states)
+	if err := p.Apply(&customerv1.Customer{}); err != nil {
+		return false, 0, fmt.Errorf("failed to prune attributes: %w", err)
+	}
+
+	var remaining []*customerv1.ImportState
+	for _, s := range p.States {
+		if s.Importer != importer || s.InternalReference != ref {
+			remaining = append(remaining, s)
+		}
+	}
+
+	if len(remaining) == 0 {
+		if err := store.DeleteCustomer(ctx, id); err != nil {
+			return false, 0, err
+		}
+
+		return true, p.PrunedAttributes, nil
+	}
+
+	if _, err := store.StoreCustomer(ctx, p.Result, remaining, revision); err != nil {
+		return false, 0, fmt.Errorf("failed to store customer: %w", err)
+	}
+
+	return false, p.PrunedAttributes, nil
+}
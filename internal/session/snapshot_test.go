@@ -0,0 +1,70 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+)
+
+func TestRemoveOrphans(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	var ids []string
+	for i := 1; i <= 4; i++ {
+		ids = append(ids, storeCustomer(t, store, "test", fmt.Sprint(i), &customerv1.Customer{
+			LastName:     fmt.Sprintf("customer-%d", i),
+			PhoneNumbers: []string{fmt.Sprint(i)},
+		}))
+	}
+
+	// the third customer is also known by another importer
+	_, err := ApplyUpsert(ctx, store, new(resolver), "other", ids[2], &customerv1.UpsertCustomerRequest{
+		InternalReference: "x",
+		Customer: &customerv1.Customer{
+			EmailAddresses: []string{"third@example.com"},
+		},
+	})
+	require.NoError(t, err)
+
+	session := &ImportSession{
+		store:    store,
+		importer: "test",
+		resolver: new(resolver),
+		touched:  make(map[string]struct{}),
+	}
+	session.touch("1")
+
+	// removing 3 out of 4 states exceeds the threshold
+	err = session.removeOrphans(ctx, 0.5)
+	require.ErrorIs(t, err, ErrTooManyOrphans)
+	require.True(t, session.stats.summary.SnapshotAborted)
+
+	customers, _, err := store.ListCustomers(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, customers, 4)
+
+	session.touch("2")
+	require.NoError(t, session.removeOrphans(ctx, 0.5))
+
+	require.Equal(t, 2, session.stats.summary.RemovedStates)
+	require.Equal(t, 1, session.stats.summary.DeletedCustomers)
+
+	_, _, _, err = store.LookupCustomerById(ctx, ids[3])
+	require.ErrorIs(t, err, repo.ErrCustomerNotFound)
+
+	// the attributes owned by the removed state must be pruned while the
+	// other importer's ones are kept.
+	third, states, _, err := store.LookupCustomerById(ctx, ids[2])
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.Equal(t, "other", states[0].Importer)
+	require.Empty(t, third.PhoneNumbers)
+	require.Empty(t, third.LastName)
+	require.Equal(t, []string{"third@example.com"}, third.EmailAddresses)
+}
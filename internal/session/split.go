@@ -0,0 +1,169 @@
+package session
+
+import (
+	"fmt"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"google.golang.org/protobuf/proto"
+)
+
+// SplitImportState detaches the import state identified by importer and ref from
+// customer. It returns the remaining customer (keeping the ID of customer) and
+// the detached customer (without an ID) together with their import states.
+//
+// The attributes of both customers are re-computed from the owned attributes
+// of their import states using Rebuild.
+func SplitImportState(importer, ref string, resolver PriorityResolver, customer *customerv1.Customer, states []*customerv1.ImportState) (*customerv1.CustomerResponse, *customerv1.CustomerResponse, error) {
+	var (
+		remainingStates []*customerv1.ImportState
+		detachedStates  []*customerv1.ImportState
+	)
+
+	for _, s := range states {
+		if s.Importer == importer && s.InternalReference == ref {
+			detachedStates = append(detachedStates, s)
+		} else {
+			remainingStates = append(remainingStates, s)
+		}
+	}
+
+	if len(detachedStates) == 0 {
+		return nil, nil, fmt.Errorf("customer %q does not have an import state for %s/%s", customer.Id, importer, ref)
+	}
+
+	if len(remainingStates) == 0 {
+		return nil, nil, fmt.Errorf("customer %q is only owned by %s/%s", customer.Id, importer, ref)
+	}
+
+	remaining, remainingStates, err := Rebuild(customer.Id, resolver, remainingStates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("remaining customer: %w", err)
+	}
+	remaining.RecordCreatedAt = customer.RecordCreatedAt
+
+	detached, detachedStates, err := Rebuild("", resolver, detachedStates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("detached customer: %w", err)
+	}
+
+	return &customerv1.CustomerResponse{
+		Customer: remaining,
+		States:   remainingStates,
+	}, &customerv1.CustomerResponse{
+		Customer: detached,
+		States:   detachedStates,
+	}, nil
+}
+
+// Rebuild re-computes a customer record from scratch by replaying the owned
+// attributes of each import state, in order, using a Patcher. States with
+// the same importer and reference are combined first since replaying the
+// second one would prune the attributes owned by the first one.
+func Rebuild(id string, resolver PriorityResolver, states []*customerv1.ImportState) (*customerv1.Customer, []*customerv1.ImportState, error) {
+	var (
+		result       = &customerv1.Customer{Id: id}
+		resultStates []*customerv1.ImportState
+	)
+
+	for _, s := range combineStates(states) {
+		p := NewPatcher(s.Importer, s.InternalReference, resolver, result, resultStates)
+
+		if err := p.Apply(customerFromState(s)); err != nil {
+			return nil, nil, fmt.Errorf("%s/%s: %w", s.Importer, s.InternalReference, err)
+		}
+
+		// keep the importer specific meta-data
+		p.currentState.LastSeen = s.LastSeen
+		p.currentState.ExtraData = s.ExtraData
+
+		result, resultStates = p.Result, p.States
+	}
+
+	return result, resultStates, nil
+}
+
+// combineStates returns states with all states of the same importer and
+// reference combined into one that owns the attributes of all of them.
+func combineStates(states []*customerv1.ImportState) []*customerv1.ImportState {
+	var (
+		result []*customerv1.ImportState
+		index  = make(map[string]*customerv1.ImportState, len(states))
+	)
+
+	for _, s := range states {
+		key := s.Importer + "/" + s.InternalReference
+
+		existing, ok := index[key]
+		if !ok {
+			existing = repo.Clone(s)
+			index[key] = existing
+			result = append(result, existing)
+
+			continue
+		}
+
+	L:
+		for _, attr := range s.OwnedAttributes {
+			for _, owned := range existing.OwnedAttributes {
+				if proto.Equal(owned, attr) {
+					continue L
+				}
+			}
+
+			existing.OwnedAttributes = append(existing.OwnedAttributes, repo.Clone(attr))
+		}
+
+		if s.LastSeen.AsTime().After(existing.LastSeen.AsTime()) {
+			existing.LastSeen = s.LastSeen
+		}
+
+		if existing.ExtraData == nil {
+			existing.ExtraData = s.ExtraData
+		}
+	}
+
+	return result
+}
+
+// customerFromState returns a customer record that only contains the
+// attributes owned by state.
+func customerFromState(state *customerv1.ImportState) *customerv1.Customer {
+	c := new(customerv1.Customer)
+
+	for _, attr := range state.OwnedAttributes {
+		switch v := attr.Kind.(type) {
+		case *customerv1.OwnedAttribute_FirstName:
+			c.FirstName = v.FirstName
+		case *customerv1.OwnedAttribute_LastName:
+			c.LastName = v.LastName
+		case *customerv1.OwnedAttribute_EmailAddress:
+			c.EmailAddresses = append(c.EmailAddresses, v.EmailAddress)
+		case *customerv1.OwnedAttribute_PhoneNumber:
+			c.PhoneNumbers = append(c.PhoneNumbers, v.PhoneNumber)
+		case *customerv1.OwnedAttribute_Address:
+			c.Addresses = append(c.Addresses, repo.Clone(v.Address))
+		}
+	}
+
+	return c
+}
+
+// MergeImportStates merges the import states of source into target. The
+// attributes of the merged customer are re-computed using Rebuild.
+func MergeImportStates(resolver PriorityResolver, target *customerv1.Customer, targetStates []*customerv1.ImportState, sourceStates []*customerv1.ImportState) (*customerv1.CustomerResponse, error) {
+	states := make([]*customerv1.ImportState, 0, len(targetStates)+len(sourceStates))
+	states = append(states, targetStates...)
+	states = append(states, sourceStates...)
+
+	merged, mergedStates, err := Rebuild(target.Id, resolver, states)
+	if err != nil {
+		return nil, err
+	}
+	merged.RecordCreatedAt = target.RecordCreatedAt
+
+	return &customerv1.CustomerResponse{
+		Customer: merged,
+		States:   mergedStates,
+	}, nil
+}
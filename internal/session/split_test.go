@@ -0,0 +1,122 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+func TestSplitImportState(t *testing.T) {
+	existing, states := getCustomer(t, "test", "first", "last", []string{"1234"}, []string{"foo@example.com"}, nil)
+	existing.Id = "customer-id"
+
+	other := &customerv1.Customer{
+		FirstName:    "other-first",
+		LastName:     "other-last",
+		PhoneNumbers: []string{"1234", "5678"},
+	}
+
+	p := NewPatcher("foo", "other-ref", new(resolver), existing, states)
+	require.NoError(t, p.Apply(other))
+
+	remaining, detached, err := SplitImportState("foo", "other-ref", new(resolver), p.Result, p.States)
+	require.NoError(t, err)
+
+	require.Equal(t, "customer-id", remaining.Customer.Id)
+	require.Equal(t, "first", remaining.Customer.FirstName)
+	require.Equal(t, "last", remaining.Customer.LastName)
+	require.Equal(t, []string{"1234"}, remaining.Customer.PhoneNumbers)
+	require.Equal(t, []string{"foo@example.com"}, remaining.Customer.EmailAddresses)
+	require.Len(t, remaining.States, 1)
+
+	require.Empty(t, detached.Customer.Id)
+	require.Equal(t, "other-first", detached.Customer.FirstName)
+	require.Equal(t, "other-last", detached.Customer.LastName)
+	require.Equal(t, []string{"1234", "5678"}, detached.Customer.PhoneNumbers)
+	require.Empty(t, detached.Customer.EmailAddresses)
+	require.Len(t, detached.States, 1)
+	require.Equal(t, "other-ref", detached.States[0].InternalReference)
+}
+
+func TestSplitImportStateErrors(t *testing.T) {
+	existing, states := getCustomer(t, "test", "first", "last", []string{"1234"}, nil, nil)
+
+	_, _, err := SplitImportState("test", "ref", new(resolver), existing, states)
+	require.Error(t, err, "splitting the only import state should fail")
+
+	_, _, err = SplitImportState("test", "unknown-ref", new(resolver), existing, states)
+	require.Error(t, err, "splitting an unknown import state should fail")
+}
+
+func TestMergeImportStatesSameImporter(t *testing.T) {
+	for _, importer := range []string{"vetinf", "test"} {
+		t.Run(importer, func(t *testing.T) {
+			target := NewPatcher(importer, "1", new(resolver), &customerv1.Customer{Id: "target"}, nil)
+			require.NoError(t, target.Apply(&customerv1.Customer{
+				FirstName:    "Jane",
+				LastName:     "Doe",
+				PhoneNumbers: []string{"+43 1 111111"},
+				Addresses:    []*customerv1.Address{makeAddr("1010", "Wien", "Hauptstraße 1")},
+			}))
+
+			source := NewPatcher(importer, "2", new(resolver), &customerv1.Customer{Id: "source"}, nil)
+			require.NoError(t, source.Apply(&customerv1.Customer{
+				FirstName:      "Jane",
+				LastName:       "Doe-Smith",
+				PhoneNumbers:   []string{"+43 1 222222"},
+				EmailAddresses: []string{"jane@example.com"},
+				Addresses:      []*customerv1.Address{makeAddr("4020", "Linz", "Weg 2")},
+			}))
+
+			merged, err := MergeImportStates(new(resolver), target.Result, target.States, source.States)
+			require.NoError(t, err)
+
+			require.Equal(t, "target", merged.Customer.Id)
+			require.Equal(t, "Jane", merged.Customer.FirstName)
+			require.Contains(t, []string{"Doe", "Doe-Smith"}, merged.Customer.LastName)
+			require.ElementsMatch(t, []string{"+43 1 111111", "+43 1 222222"}, merged.Customer.PhoneNumbers)
+			require.Equal(t, []string{"jane@example.com"}, merged.Customer.EmailAddresses)
+			require.Len(t, merged.Customer.Addresses, 2)
+
+			// both import states keep all attributes they own
+			require.Len(t, merged.States, 2)
+			for _, s := range merged.States {
+				require.Equal(t, importer, s.Importer)
+
+				switch s.InternalReference {
+				case "1":
+					require.Len(t, s.OwnedAttributes, 4)
+				case "2":
+					require.Len(t, s.OwnedAttributes, 5)
+				default:
+					t.Fatalf("unexpected import state %s", s.InternalReference)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeImportStatesSameReference(t *testing.T) {
+	target := NewPatcher("vetinf", "1", new(resolver), &customerv1.Customer{Id: "target"}, nil)
+	require.NoError(t, target.Apply(&customerv1.Customer{
+		LastName:     "Doe",
+		PhoneNumbers: []string{"+43 1 111111"},
+	}))
+
+	source := NewPatcher("vetinf", "1", new(resolver), &customerv1.Customer{Id: "source"}, nil)
+	require.NoError(t, source.Apply(&customerv1.Customer{
+		LastName:       "Doe",
+		EmailAddresses: []string{"jane@example.com"},
+	}))
+
+	merged, err := MergeImportStates(new(resolver), target.Result, target.States, source.States)
+	require.NoError(t, err)
+
+	require.Equal(t, "Doe", merged.Customer.LastName)
+	require.Equal(t, []string{"+43 1 111111"}, merged.Customer.PhoneNumbers)
+	require.Equal(t, []string{"jane@example.com"}, merged.Customer.EmailAddresses)
+
+	require.Len(t, merged.States, 1)
+	require.Len(t, merged.States[0].OwnedAttributes, 3)
+}
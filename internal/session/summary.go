@@ -0,0 +1,272 @@
+package session
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxRunErrors limits the number of error messages recorded with the
+// import run.
+const maxRunErrors = 100
+
+// maxRunDiffs limits the number of record diffs recorded with the import
+// run of dry-run sessions.
+const maxRunDiffs = 1000
+
+// UpsertResult describes the outcome of ApplyUpsert.
+type UpsertResult struct {
+	Customer *customerv1.Customer
+
+	// Created is set if a new customer record has been created.
+	Created bool
+
+	// Pristine is set if neither the customer nor any import state has
+	// been modified. Pristine records are not written to the database.
+	Pristine bool
+
+	// Changes holds all attribute values that have been added or removed.
+	Changes []importer.AttributeChange
+
+	// PrunedAttributes is the number of attributes that have been pruned
+	// from the importer state.
+	PrunedAttributes int
+
+	// Decision describes how the upsert has been matched to the customer
+	// and Candidates holds the IDs of all matching customers. Both are only
+	// set for upserts applied by an import session.
+	Decision   MatchDecision
+	Candidates []string
+}
+
+func newUpsertResult(p *Patcher, created bool) *UpsertResult {
+	return &UpsertResult{
+		Customer:         p.Result,
+		Created:          created,
+		Pristine:         !created && p.Pristine(),
+		Changes:          diffAttributes(p.Existing, p.Result),
+		PrunedAttributes: p.PrunedAttributes,
+	}
+}
+
+// diffAttributes returns all attribute values that differ between a and b.
+func diffAttributes(a, b *customerv1.Customer) []importer.AttributeChange {
+	var changes []importer.AttributeChange
+
+	if a.GetFirstName() != b.GetFirstName() {
+		changes = append(changes, importer.AttributeChange{
+			Attribute: "firstName",
+			Removed:   a.GetFirstName(),
+			Added:     b.GetFirstName(),
+		})
+	}
+
+	if a.GetLastName() != b.GetLastName() {
+		changes = append(changes, importer.AttributeChange{
+			Attribute: "lastName",
+			Removed:   a.GetLastName(),
+			Added:     b.GetLastName(),
+		})
+	}
+
+	changes = append(changes, diffList("emailAddresses", a.GetEmailAddresses(), b.GetEmailAddresses(), func(x, y string) bool { return x == y }, identity)...)
+	changes = append(changes, diffList("phoneNumbers", a.GetPhoneNumbers(), b.GetPhoneNumbers(), func(x, y string) bool { return x == y }, identity)...)
+	changes = append(changes, diffList("addresses", a.GetAddresses(), b.GetAddresses(), func(x, y *customerv1.Address) bool { return proto.Equal(x, y) }, formatAddress)...)
+
+	return changes
+}
+
+func diffList[T any](attribute string, a, b []T, equal func(x, y T) bool, format func(T) string) []importer.AttributeChange {
+	contains := func(list []T, value T) bool {
+		for _, v := range list {
+			if equal(v, value) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var changes []importer.AttributeChange
+	for _, v := range a {
+		if !contains(b, v) {
+			changes = append(changes, importer.AttributeChange{
+				Attribute: attribute,
+				Removed:   format(v),
+			})
+		}
+	}
+
+	for _, v := range b {
+		if !contains(a, v) {
+			changes = append(changes, importer.AttributeChange{
+				Attribute: attribute,
+				Added:     format(v),
+			})
+		}
+	}
+
+	return changes
+}
+
+func identity(s string) string {
+	return s
+}
+
+func formatAddress(addr *customerv1.Address) string {
+	var parts []string
+
+	for _, p := range []string{addr.Street, addr.Extra, strings.TrimSpace(addr.PostalCode + " " + addr.City)} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// sessionStats collects the statistics of an import session. The error
+// messages and diffs are recorded with the import run and not part of the
+// summary sent to the importer.
+type sessionStats struct {
+	l       sync.Mutex
+	summary importer.SessionSummary
+
+	errors         []string
+	diffs          []importer.RecordDiff
+	diffsTruncated bool
+}
+
+func (stats *sessionStats) lookup() {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	stats.summary.Lookups++
+}
+
+func (stats *sessionStats) upserted(result *UpsertResult) {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	switch {
+	case result.Created:
+		stats.summary.Created++
+	case result.Pristine:
+		stats.summary.Pristine++
+	default:
+		stats.summary.Updated++
+	}
+
+	stats.summary.AttributeUpdates += len(result.Changes)
+	stats.summary.PrunedAttributes += result.PrunedAttributes
+
+	if result.Decision != "" {
+		if stats.summary.Matches == nil {
+			stats.summary.Matches = make(map[string]int)
+		}
+
+		stats.summary.Matches[string(result.Decision)]++
+	}
+}
+
+// diff records the changes of a dry-run upsert.
+func (stats *sessionStats) diff(ref string, result *UpsertResult) {
+	if !result.Created && len(result.Changes) == 0 {
+		return
+	}
+
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	if len(stats.diffs) >= maxRunDiffs {
+		stats.diffsTruncated = true
+		return
+	}
+
+	stats.diffs = append(stats.diffs, importer.RecordDiff{
+		Ref:        ref,
+		CustomerID: result.Customer.GetId(),
+		Created:    result.Created,
+		Decision:   string(result.Decision),
+		Changes:    result.Changes,
+	})
+}
+
+func (stats *sessionStats) removed(deleted bool, pruned int) {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	stats.summary.RemovedStates++
+	stats.summary.PrunedAttributes += pruned
+
+	if deleted {
+		stats.summary.DeletedCustomers++
+	}
+}
+
+func (stats *sessionStats) snapshotAborted() {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	stats.summary.SnapshotAborted = true
+}
+
+func (stats *sessionStats) failed(err error) {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	// parked upserts are not failures, they are applied once the match has
+	// been reviewed.
+	if errors.Is(err, ErrNeedsReview) {
+		stats.summary.NeedsReview++
+		return
+	}
+
+	stats.summary.Failed++
+
+	if len(stats.errors) < maxRunErrors {
+		stats.errors = append(stats.errors, err.Error())
+	}
+}
+
+// finish returns a copy of the summary with the duration set.
+func (stats *sessionStats) finish() importer.SessionSummary {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	summary := stats.summary
+	summary.Duration = time.Since(summary.StartedAt)
+	summary.Matches = maps.Clone(summary.Matches)
+
+	return summary
+}
+
+// record stores the summary, error messages and diffs in run.
+func (stats *sessionStats) record(run *repo.ImportRun) {
+	run.Summary = stats.finish()
+
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	run.Errors = append([]string(nil), stats.errors...)
+	run.Diffs = append([]importer.RecordDiff(nil), stats.diffs...)
+	run.DiffsTruncated = stats.diffsTruncated
+}
+
+// restore continues the statistics recorded in run.
+func (stats *sessionStats) restore(run *repo.ImportRun) {
+	stats.l.Lock()
+	defer stats.l.Unlock()
+
+	stats.summary = run.Summary
+	stats.errors = append([]string(nil), run.Errors...)
+	stats.diffs = append([]importer.RecordDiff(nil), run.Diffs...)
+	stats.diffsTruncated = run.DiffsTruncated
+}
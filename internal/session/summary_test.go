@@ -0,0 +1,106 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo"
+	"github.com/tierklinik-dobersberg/customer-service/internal/repo/inmem"
+	"github.com/tierklinik-dobersberg/customer-service/pkg/importer"
+)
+
+func TestDiffAttributes(t *testing.T) {
+	a := &customerv1.Customer{
+		FirstName:    "John",
+		LastName:     "Doe",
+		PhoneNumbers: []string{"1", "2"},
+	}
+
+	b := &customerv1.Customer{
+		FirstName:      "John",
+		LastName:       "Dough",
+		PhoneNumbers:   []string{"2", "3"},
+		EmailAddresses: []string{"john@example.com"},
+	}
+
+	require.Empty(t, diffAttributes(a, a))
+	require.Equal(t, []importer.AttributeChange{
+		{Attribute: "lastName", Removed: "Doe", Added: "Dough"},
+		{Attribute: "emailAddresses", Added: "john@example.com"},
+		{Attribute: "phoneNumbers", Removed: "1"},
+		{Attribute: "phoneNumbers", Added: "3"},
+	}, diffAttributes(a, b))
+	require.Len(t, diffAttributes(nil, &customerv1.Customer{FirstName: "John", LastName: "Doe"}), 2)
+}
+
+func TestUpsertResult(t *testing.T) {
+	ctx := context.Background()
+	store := repo.New(inmem.New())
+
+	result, err := ApplyUpsert(ctx, store, new(resolver), "test", "", &customerv1.UpsertCustomerRequest{
+		InternalReference: "1",
+		Customer:          &customerv1.Customer{LastName: "Doe", PhoneNumbers: []string{"1"}},
+	})
+	require.NoError(t, err)
+	require.True(t, result.Created)
+
+	id := result.Customer.Id
+
+	result, err = ApplyUpsert(ctx, store, new(resolver), "test", id, &customerv1.UpsertCustomerRequest{
+		InternalReference: "1",
+		Customer:          &customerv1.Customer{LastName: "Doe", PhoneNumbers: []string{"1"}},
+	})
+	require.NoError(t, err)
+	require.False(t, result.Created)
+	require.True(t, result.Pristine)
+
+	// pristine records must not be written
+	_, _, revision, err := store.LookupCustomerById(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), revision)
+
+	result, err = ApplyUpsert(ctx, store, new(resolver), "test", id, &customerv1.UpsertCustomerRequest{
+		InternalReference: "1",
+		Customer:          &customerv1.Customer{LastName: "Doe"},
+	})
+	require.NoError(t, err)
+	require.False(t, result.Pristine)
+	require.Len(t, result.Changes, 1)
+	require.Equal(t, 1, result.PrunedAttributes)
+}
+
+func TestStatsRecord(t *testing.T) {
+	stats := &sessionStats{}
+
+	stats.failed(errors.New("invalid phone number"))
+	stats.diff("1", &UpsertResult{
+		Customer: &customerv1.Customer{Id: "id"},
+		Decision: MatchByPhone,
+		Changes:  []importer.AttributeChange{{Attribute: "lastName", Added: "Doe"}},
+	})
+
+	// the summary sent to the importer only holds the counts
+	blob, err := json.Marshal(stats.finish())
+	require.NoError(t, err)
+	require.NotContains(t, string(blob), "invalid phone number")
+	require.NotContains(t, string(blob), "Doe")
+
+	run := &repo.ImportRun{}
+	stats.record(run)
+	require.Equal(t, 1, run.Summary.Failed)
+	require.Equal(t, []string{"invalid phone number"}, run.Errors)
+	require.Len(t, run.Diffs, 1)
+	require.Equal(t, "phone", run.Diffs[0].Decision)
+
+	// a resumed session continues the recorded lists
+	resumed := &sessionStats{}
+	resumed.restore(run)
+	resumed.failed(errors.New("missing name"))
+	resumed.record(run)
+	require.Equal(t, 2, run.Summary.Failed)
+	require.Equal(t, []string{"invalid phone number", "missing name"}, run.Errors)
+}
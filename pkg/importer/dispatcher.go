@@ -6,25 +6,54 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
 )
 
+var (
+	// ErrDispatcherStopped is returned for requests sent after the import
+	// session has been completed.
+	ErrDispatcherStopped = errors.New("import dispatcher stopped")
+
+	// ErrRequestTimeout is returned if no response has been received
+	// within the configured request timeout.
+	ErrRequestTimeout = errors.New("import request timed out")
+)
+
+// StreamError is returned for all in-flight and subsequent requests once
+// the import stream failed.
+type StreamError struct {
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return "import stream failed: " + e.Err.Error()
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
 type (
 	ImportStream interface {
 		Receive() (*customerv1.ImportSessionResponse, error)
 		Send(*customerv1.ImportSessionRequest) error
 		CloseRequest() error
 		CloseResponse() error
+		RequestHeader() http.Header
+		ResponseHeader() http.Header
+		ResponseTrailer() http.Header
 	}
 
 	Dispatcher struct {
 		ctx       context.Context
 		importer  string
 		stream    ImportStream
-		wg        sync.WaitGroup
+		opts      Options
 		sendQueue chan *customerv1.ImportSessionRequest
 
 		closed atomic.Bool
@@ -32,24 +61,32 @@ type (
 		cancelSendLoop    func()
 		cancelReceiveLoop func()
 
+		// done is closed once the dispatcher failed or has been stopped.
+		// err holds the reason and must only be read after done is closed.
+		done     chan struct{}
+		doneOnce sync.Once
+		err      error
+
 		l           sync.Mutex
 		responseMap map[string]chan<- *customerv1.ImportSessionResponse
 	}
 )
 
-func NewDispatcher(ctx context.Context, importer string, stream ImportStream) *Dispatcher {
+func NewDispatcher(ctx context.Context, importer string, stream ImportStream, opts Options) *Dispatcher {
+	opts.setDefaults()
+
 	return &Dispatcher{
 		ctx:         ctx,
 		importer:    importer,
 		stream:      stream,
+		opts:        opts,
 		sendQueue:   make(chan *customerv1.ImportSessionRequest, 100),
+		done:        make(chan struct{}),
 		responseMap: make(map[string]chan<- *customerv1.ImportSessionResponse, 100),
 	}
 }
 
 func (mng *Dispatcher) Start() {
-	mng.wg.Add(2)
-
 	var (
 		sendCtx    context.Context
 		receiveCtx context.Context
@@ -62,44 +99,165 @@ func (mng *Dispatcher) Start() {
 	go mng.sendLoop(sendCtx)
 }
 
-func (mng *Dispatcher) Stop() {
-	mng.closed.Store(true)
+// Stop completes the import session and waits until the server answered
+// all pending requests and closed the stream. It returns the error that
+// caused the dispatcher to fail, if any. Stop may be called multiple times
+// and after the dispatcher failed.
+func (mng *Dispatcher) Stop() error {
+	if mng.closed.CompareAndSwap(false, true) && mng.Err() == nil {
+		select {
+		case mng.sendQueue <- &customerv1.ImportSessionRequest{
+			Message: &customerv1.ImportSessionRequest_Complete{},
+		}:
+		case <-mng.done:
+		}
+	}
+
+	timer := time.NewTimer(mng.opts.RequestTimeout)
+	defer timer.Stop()
 
-	mng.sendQueue <- &customerv1.ImportSessionRequest{
-		Message: &customerv1.ImportSessionRequest_Complete{},
+	// the receive loop finishes once the server closed the stream which
+	// happens after all pending requests have been answered.
+	select {
+	case <-mng.done:
+	case <-timer.C:
+		mng.fail(fmt.Errorf("%w: session has not been completed", ErrRequestTimeout))
 	}
 
+	mng.cancelSendLoop()
 	mng.cancelReceiveLoop()
 
-	mng.wg.Wait()
+	if errors.Is(mng.err, ErrDispatcherStopped) {
+		return nil
+	}
+
+	return mng.err
+}
+
+// Err returns the error that caused the dispatcher to stop or nil if it is
+// still running.
+func (mng *Dispatcher) Err() error {
+	select {
+	case <-mng.done:
+		return mng.err
+	default:
+		return nil
+	}
+}
+
+// fail stops the dispatcher with err. All in-flight and subsequent requests
+// fail with err. Only the first call has an effect.
+func (mng *Dispatcher) fail(err error) {
+	mng.doneOnce.Do(func() {
+		mng.err = err
+		close(mng.done)
+	})
+}
+
+// Call is a request that has been dispatched and waits for its response.
+type Call struct {
+	d       *Dispatcher
+	id      string
+	ch      chan *customerv1.ImportSessionResponse
+	started time.Time
 }
 
-func (mng *Dispatcher) Send(req *customerv1.ImportSessionRequest) <-chan *customerv1.ImportSessionResponse {
-	ch := make(chan *customerv1.ImportSessionResponse, 1)
+// Dispatch queues req for sending and returns a call to wait for the
+// response. Requests are sent in the order they are dispatched.
+func (mng *Dispatcher) Dispatch(ctx context.Context, req *customerv1.ImportSessionRequest) (*Call, error) {
+	if err := mng.Err(); err != nil {
+		return nil, err
+	}
 
-	id := GenerateCorrelationId(32)
+	call := &Call{
+		d:       mng,
+		id:      GenerateCorrelationId(32),
+		ch:      make(chan *customerv1.ImportSessionResponse, 1),
+		started: time.Now(),
+	}
 
-	req.CorrelationId = id
+	req.CorrelationId = call.id
 
 	mng.l.Lock()
-	mng.responseMap[id] = ch
+	mng.responseMap[call.id] = call.ch
 	mng.l.Unlock()
 
+	timer := time.NewTimer(mng.opts.RequestTimeout)
+	defer timer.Stop()
+
+	var err error
 	select {
 	case mng.sendQueue <- req:
-	case <-mng.ctx.Done():
-		return nil
+		return call, nil
+	case <-mng.done:
+		err = mng.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = fmt.Errorf("%w: %s", ErrRequestTimeout, call.id)
 	}
 
-	return ch
+	call.release()
+
+	return nil, err
 }
 
-func (mng *Dispatcher) sendLoop(ctx context.Context) {
-	defer mng.wg.Done()
+// Wait waits for the response of the call. It fails if ctx is cancelled,
+// the request times out or the import stream failed.
+func (call *Call) Wait(ctx context.Context) (*customerv1.ImportSessionResponse, error) {
+	defer call.release()
+
+	mng := call.d
+
+	timer := time.NewTimer(mng.opts.RequestTimeout - time.Since(call.started))
+	defer timer.Stop()
+
+	select {
+	case res := <-call.ch:
+		return res, nil
+
+	case <-mng.done:
+		// the response might have been received right before the stream
+		// has been closed.
+		select {
+		case res := <-call.ch:
+			return res, nil
+		default:
+			return nil, mng.err
+		}
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s", ErrRequestTimeout, call.id)
+	}
+}
+
+func (call *Call) release() {
+	call.d.l.Lock()
+	delete(call.d.responseMap, call.id)
+	call.d.l.Unlock()
+}
+
+// Send sends req and waits for the response.
+func (mng *Dispatcher) Send(ctx context.Context, req *customerv1.ImportSessionRequest) (*customerv1.ImportSessionResponse, error) {
+	call, err := mng.Dispatch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return call.Wait(ctx)
+}
 
+func (mng *Dispatcher) sendLoop(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			mng.fail(ctx.Err())
+			return
+
+		case <-mng.done:
 			return
 
 		case msg := <-mng.sendQueue:
@@ -110,6 +268,7 @@ func (mng *Dispatcher) sendLoop(ctx context.Context) {
 					Value: slog.StringValue(err.Error()),
 				})
 
+				mng.fail(&StreamError{Err: err})
 				return
 			}
 
@@ -128,16 +287,16 @@ func (mng *Dispatcher) sendLoop(ctx context.Context) {
 }
 
 func (mng *Dispatcher) receiveLoop(ctx context.Context) {
-	defer mng.wg.Done()
-
 	for {
-		if ctx.Err() != nil {
-			break
+		if err := ctx.Err(); err != nil {
+			mng.fail(err)
+			return
 		}
 
 		res, err := mng.stream.Receive()
 		if err != nil {
 			if mng.closed.Load() && errors.Is(err, io.EOF) {
+				mng.fail(ErrDispatcherStopped)
 				return
 			}
 
@@ -145,7 +304,9 @@ func (mng *Dispatcher) receiveLoop(ctx context.Context) {
 				Key:   "error",
 				Value: slog.StringValue(err.Error()),
 			})
-			break
+
+			mng.fail(&StreamError{Err: err})
+			return
 		}
 
 		switch v := res.Message.(type) {
@@ -163,22 +324,15 @@ func (mng *Dispatcher) receiveLoop(ctx context.Context) {
 			})
 		}
 
-		mng.wg.Add(1)
-		go func() {
-			defer mng.wg.Done()
+		mng.l.Lock()
+		ch, ok := mng.responseMap[res.CorrelationId]
+		delete(mng.responseMap, res.CorrelationId)
+		mng.l.Unlock()
 
-			mng.l.Lock()
-			ch, ok := mng.responseMap[res.CorrelationId]
-			delete(mng.responseMap, res.CorrelationId)
-			mng.l.Unlock()
-
-			if ok {
-				select {
-				case ch <- res:
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
+		// response channels are buffered and receive at most one response
+		// so this never blocks.
+		if ok {
+			ch <- res
+		}
 	}
 }
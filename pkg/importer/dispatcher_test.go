@@ -0,0 +1,133 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+// fakeStream is an in-memory ImportStream. Requests sent by the dispatcher
+// are published on requests, responses and errors to be received are read
+// from responses and errs.
+type fakeStream struct {
+	requests  chan *customerv1.ImportSessionRequest
+	responses chan *customerv1.ImportSessionResponse
+	errs      chan error
+
+	requestHeader  http.Header
+	responseHeader http.Header
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{
+		requests:       make(chan *customerv1.ImportSessionRequest, 10),
+		responses:      make(chan *customerv1.ImportSessionResponse, 10),
+		errs:           make(chan error, 1),
+		requestHeader:  http.Header{},
+		responseHeader: http.Header{},
+	}
+}
+
+func (s *fakeStream) Receive() (*customerv1.ImportSessionResponse, error) {
+	select {
+	case res := <-s.responses:
+		return res, nil
+	case err := <-s.errs:
+		return nil, err
+	}
+}
+
+func (s *fakeStream) Send(req *customerv1.ImportSessionRequest) error {
+	s.requests <- req
+	return nil
+}
+
+func (s *fakeStream) CloseRequest() error          { return nil }
+func (s *fakeStream) CloseResponse() error         { return nil }
+func (s *fakeStream) RequestHeader() http.Header   { return s.requestHeader }
+func (s *fakeStream) ResponseHeader() http.Header  { return s.responseHeader }
+func (s *fakeStream) ResponseTrailer() http.Header { return http.Header{} }
+
+func upsertRequest(ref string) *customerv1.ImportSessionRequest {
+	return &customerv1.ImportSessionRequest{
+		Message: &customerv1.ImportSessionRequest_UpsertCustomer{
+			UpsertCustomer: &customerv1.UpsertCustomerRequest{
+				InternalReference: ref,
+			},
+		},
+	}
+}
+
+func TestDispatcherStreamFailure(t *testing.T) {
+	stream := newFakeStream()
+
+	d := NewDispatcher(context.Background(), "test", stream, Options{})
+	d.Start()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := d.Send(context.Background(), upsertRequest("1"))
+		result <- err
+	}()
+
+	// wait for the request to be sent before breaking the stream
+	<-stream.requests
+	stream.errs <- errors.New("connection reset")
+
+	var streamErr *StreamError
+	require.ErrorAs(t, <-result, &streamErr)
+
+	// subsequent requests fail immediately
+	_, err := d.Send(context.Background(), upsertRequest("2"))
+	require.ErrorAs(t, err, &streamErr)
+
+	// Stop must not block and report the failure
+	require.ErrorAs(t, d.Stop(), &streamErr)
+	require.ErrorAs(t, d.Stop(), &streamErr)
+}
+
+func TestDispatcherRequestTimeout(t *testing.T) {
+	stream := newFakeStream()
+
+	d := NewDispatcher(context.Background(), "test", stream, Options{
+		RequestTimeout: 20 * time.Millisecond,
+	})
+	d.Start()
+
+	_, err := d.Send(context.Background(), upsertRequest("1"))
+	require.ErrorIs(t, err, ErrRequestTimeout)
+
+	// drop the request that timed out
+	<-stream.requests
+
+	// the dispatcher is still usable after a timeout
+	go func() {
+		req := <-stream.requests
+		stream.responses <- &customerv1.ImportSessionResponse{
+			CorrelationId: req.CorrelationId,
+			Message: &customerv1.ImportSessionResponse_UpsertSuccess{
+				UpsertSuccess: &customerv1.UpsertCustomerSuccess{Id: "id"},
+			},
+		}
+	}()
+
+	res, err := d.Send(context.Background(), upsertRequest("2"))
+	require.NoError(t, err)
+	require.Equal(t, "id", res.GetUpsertSuccess().GetId())
+
+	go func() {
+		<-stream.requests
+		stream.errs <- io.EOF
+	}()
+
+	require.NoError(t, d.Stop())
+
+	_, err = d.Send(context.Background(), upsertRequest("3"))
+	require.ErrorIs(t, err, ErrDispatcherStopped)
+}
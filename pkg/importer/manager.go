@@ -4,86 +4,803 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
+var (
+	// ErrReplayBufferExceeded is returned if an import stream cannot be
+	// resumed because upserts after the server checkpoint are not buffered
+	// anymore.
+	ErrReplayBufferExceeded = errors.New("import replay buffer exceeded")
+
+	// ErrSessionCompleted is returned for requests sent after the server
+	// reported that the session has already been completed while
+	// reconnecting.
+	ErrSessionCompleted = errors.New("import session has already been completed")
+)
+
+// DefaultRequestTimeout is the time to wait for the response of a single
+// request if not configured otherwise.
+const DefaultRequestTimeout = 5 * time.Minute
+
+// Options configures the import dispatcher and manager.
+type Options struct {
+	// RequestTimeout is the maximum time to wait for the response of a
+	// single request. It is also used to wait for the server to complete
+	// the session when stopping the dispatcher.
+	RequestTimeout time.Duration
+
+	// MaxReconnects is the number of consecutive attempts the Manager makes
+	// to reconnect a failed import stream. A negative value disables
+	// reconnecting.
+	MaxReconnects int
+
+	// ReconnectBackoff is the delay before the first reconnect attempt. It
+	// is doubled for every failed attempt up to MaxReconnectBackoff.
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// ReplayBuffer is the number of sent upserts kept by the Manager so they
+	// can be replayed after reconnecting.
+	ReplayBuffer int
+
+	// MaxInFlight limits the number of asynchronous upserts waiting for a
+	// response. UpsertAsync blocks once the limit is reached.
+	MaxInFlight int
+
+	// BatchSize enables batching of upserts if greater than one. Upserts
+	// are held back until BatchSize upserts are waiting or the first one
+	// waited for BatchLatency and are then sent back-to-back. This only
+	// groups the send timing: each upsert is still a message of its own
+	// but they reach customerd at the same time, so its write batcher can
+	// coalesce the writes of upserts processed concurrently. BatchSize
+	// should not exceed MaxInFlight.
+	BatchSize    int
+	BatchLatency time.Duration
+
+	// OnProgress is called whenever an upsert has been completed. Calls are
+	// serialised.
+	OnProgress func(Progress)
+}
+
+// Progress describes the progress of an import session.
+type Progress struct {
+	// Sent is the number of upserts sent, including those skipped when
+	// resuming a session, and Completed the number of upserts answered.
+	Sent      int
+	Completed int
+	Failed    int
+}
+
+const (
+	DefaultMaxReconnects       = 10
+	DefaultReconnectBackoff    = time.Second
+	DefaultMaxReconnectBackoff = time.Minute
+	DefaultReplayBuffer        = 1000
+	DefaultMaxInFlight         = 16
+	DefaultBatchLatency        = 10 * time.Millisecond
+)
+
+func (opts *Options) setDefaults() {
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+
+	if opts.MaxReconnects == 0 {
+		opts.MaxReconnects = DefaultMaxReconnects
+	}
+
+	if opts.ReconnectBackoff <= 0 {
+		opts.ReconnectBackoff = DefaultReconnectBackoff
+	}
+
+	if opts.MaxReconnectBackoff <= 0 {
+		opts.MaxReconnectBackoff = DefaultMaxReconnectBackoff
+	}
+
+	if opts.ReplayBuffer <= 0 {
+		opts.ReplayBuffer = DefaultReplayBuffer
+	}
+
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = DefaultMaxInFlight
+	}
+
+	if opts.BatchLatency <= 0 {
+		opts.BatchLatency = DefaultBatchLatency
+	}
+}
+
+// StreamFactory opens a new import stream. It is called for the initial
+// connection and whenever the Manager reconnects. Request headers set by
+// the factory are sent on every connection.
+type StreamFactory func(ctx context.Context) ImportStream
+
+// request is an upsert or lookup sent by the Manager. It is sent again if
+// the import stream has to be reconnected before the response has been
+// received.
+type request struct {
+	// seq is the position of an upsert in the session and zero for other
+	// requests.
+	seq uint64
+	msg *customerv1.ImportSessionRequest
+
+	once sync.Once
+	done chan struct{}
+	res  *customerv1.ImportSessionResponse
+	err  error
+}
+
+func (r *request) resolve(res *customerv1.ImportSessionResponse, err error) {
+	r.once.Do(func() {
+		r.res = res
+		r.err = err
+		close(r.done)
+	})
+}
+
 type Manager struct {
+	ctx      context.Context
+	importer string
+	factory  StreamFactory
+	opts     Options
+
+	l          sync.Mutex
 	dispatcher *Dispatcher
+
+	// reconnecting is set while the failed dispatcher is replaced and
+	// closed once done. Requests are not dispatched in the meantime but
+	// replayed once reconnected.
+	reconnecting chan struct{}
+
+	// err is set if the stream failed and could not be reconnected.
+	err error
+
+	// completed holds the summary of the session if the server reported
+	// that it has already been completed while reconnecting.
+	completed *SessionSummary
+
+	// sessionID is the id assigned by customerd. skip is the number of
+	// upserts that still need to be skipped when resuming a session.
+	sessionID  string
+	checkpoint uint64
+	skip       uint64
+
+	// seq is the position of the last upsert sent. buffer holds the most
+	// recent upserts for replaying them and pending all requests that have
+	// not been answered yet.
+	seq     uint64
+	buffer  []*request
+	pending map[*request]struct{}
+
+	// batch holds the upserts that have not been dispatched yet if
+	// batching is enabled. batchTimer dispatches them once the batch
+	// latency passed.
+	batch      []*request
+	batchTimer *time.Timer
+
+	// inFlight limits the number of asynchronous upserts.
+	inFlight chan struct{}
+
+	progressL sync.Mutex
+	progress  Progress
 }
 
-func NewManager(ctx context.Context, importer string, stream ImportStream) (*Manager, error) {
-	dipatcher := NewDispatcher(ctx, importer, stream)
+func NewManager(ctx context.Context, importer string, factory StreamFactory, opts Options) (*Manager, error) {
+	opts.setDefaults()
 
 	mng := &Manager{
-		dispatcher: dipatcher,
+		ctx:      ctx,
+		importer: importer,
+		factory:  factory,
+		opts:     opts,
+		pending:  make(map[*request]struct{}),
+		inFlight: make(chan struct{}, opts.MaxInFlight),
 	}
 
-	mng.dispatcher.Start()
+	dispatcher, sessionID, checkpoint, err := mng.connect("")
+	if err != nil {
+		return nil, err
+	}
+
+	mng.dispatcher = dispatcher
+	mng.sessionID = sessionID
+	mng.checkpoint = checkpoint
+	mng.skip = checkpoint
+	mng.seq = checkpoint
+
+	return mng, nil
+}
+
+// connect opens a new import stream and starts or resumes the session. It
+// returns the dispatcher of the stream and the session id and checkpoint
+// reported by the server.
+func (mng *Manager) connect(resume string) (*Dispatcher, string, uint64, error) {
+	stream := mng.factory(mng.ctx)
+	if resume != "" {
+		stream.RequestHeader().Set(ResumeSessionHeader, resume)
+	}
 
-	res := mng.dispatcher.Send(&customerv1.ImportSessionRequest{
+	dispatcher := NewDispatcher(mng.ctx, mng.importer, stream, mng.opts)
+	dispatcher.Start()
+
+	msg, err := dispatcher.Send(mng.ctx, &customerv1.ImportSessionRequest{
 		Message: &customerv1.ImportSessionRequest_StartSession{
 			StartSession: &customerv1.StartSessionRequest{
-				Importer: importer,
+				Importer: mng.importer,
 			},
 		},
 	})
+	if err != nil {
+		dispatcher.fail(err)
+		dispatcher.Stop()
+
+		return nil, "", 0, fmt.Errorf("failed to start import session: %w", err)
+	}
+
+	if msg.GetStartSession() == nil {
+		err := fmt.Errorf("invalid response for start-session request")
+
+		dispatcher.fail(err)
+		dispatcher.Stop()
+
+		return nil, "", 0, err
+	}
+
+	header := stream.ResponseHeader()
+
+	var checkpoint uint64
+	if value := header.Get(CheckpointHeader); value != "" {
+		checkpoint, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			dispatcher.fail(err)
+			dispatcher.Stop()
+
+			return nil, "", 0, fmt.Errorf("invalid session checkpoint %q: %w", value, err)
+		}
+	}
+
+	return dispatcher, header.Get(SessionIdHeader), checkpoint, nil
+}
+
+// SessionID returns the id of the import session. It can be passed using
+// the ResumeSessionHeader to resume the session if it gets interrupted.
+func (mng *Manager) SessionID() string {
+	mng.l.Lock()
+	defer mng.l.Unlock()
+
+	return mng.sessionID
+}
+
+// Checkpoint returns the number of upserts that had already been processed
+// when the session has been resumed.
+func (mng *Manager) Checkpoint() uint64 {
+	return mng.checkpoint
+}
+
+// submit sends msg without waiting for the response. If the import stream
+// fails the request is replayed after reconnecting.
+func (mng *Manager) submit(msg *customerv1.ImportSessionRequest) *request {
+	r := &request{
+		msg:  msg,
+		done: make(chan struct{}),
+	}
+
+	mng.l.Lock()
+	defer mng.l.Unlock()
+
+	if mng.err != nil {
+		r.resolve(nil, mng.err)
+		return r
+	}
+
+	if _, ok := msg.Message.(*customerv1.ImportSessionRequest_UpsertCustomer); ok {
+		mng.seq++
+		r.seq = mng.seq
+
+		mng.buffer = append(mng.buffer, r)
+		if len(mng.buffer) > mng.opts.ReplayBuffer {
+			mng.buffer = mng.buffer[1:]
+		}
+	}
+
+	mng.pending[r] = struct{}{}
+
+	if r.seq == 0 || mng.opts.BatchSize <= 1 {
+		// lookups must see all upserts sent before.
+		mng.flushBatchLocked()
+		mng.dispatch(r)
+
+		return r
+	}
+
+	mng.batch = append(mng.batch, r)
+
+	switch {
+	case len(mng.batch) >= mng.opts.BatchSize:
+		mng.flushBatchLocked()
+
+	case len(mng.batch) == 1:
+		mng.batchTimer = time.AfterFunc(mng.opts.BatchLatency, mng.flushBatch)
+	}
+
+	return r
+}
+
+// flushBatch dispatches all batched upserts.
+func (mng *Manager) flushBatch() {
+	mng.l.Lock()
+	defer mng.l.Unlock()
+
+	mng.flushBatchLocked()
+}
+
+// flushBatchLocked dispatches all batched upserts. mng.l must be held.
+func (mng *Manager) flushBatchLocked() {
+	batch := mng.dropBatchLocked()
+
+	for _, r := range batch {
+		mng.dispatch(r)
+	}
+}
 
-	if res == nil {
-		return nil, fmt.Errorf("stream already closed")
+// dropBatchLocked stops the batch timer and returns the batched upserts.
+// mng.l must be held.
+func (mng *Manager) dropBatchLocked() []*request {
+	if mng.batchTimer != nil {
+		mng.batchTimer.Stop()
+		mng.batchTimer = nil
 	}
 
+	batch := mng.batch
+	mng.batch = nil
+
+	return batch
+}
+
+// wait waits for the response of r.
+func (mng *Manager) wait(r *request) (*customerv1.ImportSessionResponse, error) {
 	select {
-	case msg := <-res:
-		if msg.GetStartSession() == nil {
-			return nil, fmt.Errorf("invalid response for start-session request")
+	case <-r.done:
+		return r.res, r.err
+	case <-mng.ctx.Done():
+		return nil, mng.ctx.Err()
+	}
+}
+
+// dispatch sends r using the current dispatcher. mng.l must be held.
+func (mng *Manager) dispatch(r *request) {
+	// r is pending and replayed once the stream has been reconnected.
+	if mng.reconnecting != nil {
+		return
+	}
+
+	dispatcher := mng.dispatcher
+
+	// the dispatcher sets the correlation id so never share the message
+	// between streams.
+	call, err := dispatcher.Dispatch(mng.ctx, proto.Clone(r.msg).(*customerv1.ImportSessionRequest))
+	if err != nil {
+		if isStreamError(err) {
+			go mng.reconnect(dispatcher)
+		} else {
+			mng.resolveLocked(r, nil, err)
 		}
 
-	case <-ctx.Done():
-		return nil, ctx.Err()
+		return
 	}
 
-	return mng, nil
+	go func() {
+		res, err := call.Wait(mng.ctx)
+		if isStreamError(err) {
+			// the request is replayed once the stream has been reconnected.
+			mng.reconnect(dispatcher)
+			return
+		}
+
+		mng.l.Lock()
+		defer mng.l.Unlock()
+
+		mng.resolveLocked(r, res, err)
+	}()
+}
+
+func (mng *Manager) resolveLocked(r *request, res *customerv1.ImportSessionResponse, err error) {
+	delete(mng.pending, r)
+	r.resolve(res, err)
 }
 
-func (mng *Manager) upsertCustomer(ref string, customer *customerv1.Customer, extraData *structpb.Struct) error {
+func isStreamError(err error) bool {
+	var streamErr *StreamError
+
+	return errors.As(err, &streamErr)
+}
+
+// reconnect replaces the failed dispatcher by resuming the session on a new
+// import stream. Unanswered requests are replayed. If the session cannot be
+// resumed all pending requests fail. mng.l is released while waiting for
+// the next attempt. If the stream is already being reconnected, reconnect
+// waits until that is done.
+func (mng *Manager) reconnect(failed *Dispatcher) {
+	mng.l.Lock()
+
+	if done := mng.reconnecting; done != nil {
+		mng.l.Unlock()
+		<-done
+
+		return
+	}
+
+	defer mng.l.Unlock()
+
+	// the stream has already been reconnected by another request.
+	if mng.dispatcher != failed || mng.err != nil {
+		return
+	}
+
+	mng.reconnecting = make(chan struct{})
+	defer mng.reconnectedLocked()
+
+	lastErr := failed.Stop()
+
+	if mng.sessionID == "" || mng.opts.MaxReconnects < 0 {
+		mng.abortLocked(lastErr)
+		return
+	}
+
+	var (
+		sessionID = mng.sessionID
+		backoff   = mng.opts.ReconnectBackoff
+	)
+
+	for attempt := 1; attempt <= mng.opts.MaxReconnects; attempt++ {
+		slog.WarnContext(mng.ctx, "import stream failed, reconnecting", "session", sessionID, "attempt", attempt, "backoff", backoff, "error", lastErr.Error())
+
+		mng.l.Unlock()
+
+		var (
+			dispatcher *Dispatcher
+			checkpoint uint64
+			err        error
+		)
+
+		select {
+		case <-time.After(backoff):
+			dispatcher, _, checkpoint, err = mng.connect(sessionID)
+		case <-mng.ctx.Done():
+			err = mng.ctx.Err()
+		}
+
+		mng.l.Lock()
+
+		if mng.ctx.Err() != nil {
+			if dispatcher != nil {
+				dispatcher.fail(mng.ctx.Err())
+				dispatcher.Stop()
+			}
+
+			mng.abortLocked(mng.ctx.Err())
+			return
+		}
+
+		// the server completed the session but the response to the
+		// complete request got lost.
+		if summary := completedSummary(err); summary != nil {
+			slog.InfoContext(mng.ctx, "import session has already been completed", "session", sessionID)
+
+			mng.completed = summary
+			mng.abortLocked(ErrSessionCompleted)
+			return
+		}
+
+		backoff = min(2*backoff, mng.opts.MaxReconnectBackoff)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		mng.dispatcher = dispatcher
+		mng.reconnectedLocked()
+
+		if err := mng.replayLocked(checkpoint); err != nil {
+			mng.dispatcher.fail(err)
+			mng.dispatcher.Stop()
+
+			mng.abortLocked(err)
+			return
+		}
+
+		slog.InfoContext(mng.ctx, "import stream reconnected", "session", sessionID, "checkpoint", checkpoint)
+
+		return
+	}
+
+	mng.abortLocked(fmt.Errorf("failed to reconnect import stream: %w", lastErr))
+}
+
+// reconnectedLocked marks the end of reconnecting so requests are
+// dispatched again and waiting callers of reconnect return.
+func (mng *Manager) reconnectedLocked() {
+	if mng.reconnecting != nil {
+		close(mng.reconnecting)
+		mng.reconnecting = nil
+	}
+}
+
+// replayLocked re-sends all requests the server did not process before the
+// checkpoint. Upserts are always replayed in their original order.
+func (mng *Manager) replayLocked(checkpoint uint64) error {
+	if checkpoint < mng.seq && (len(mng.buffer) == 0 || mng.buffer[0].seq > checkpoint+1) {
+		return fmt.Errorf("%w: server checkpoint is %d", ErrReplayBufferExceeded, checkpoint)
+	}
+
+	// batched upserts are replayed below.
+	mng.dropBatchLocked()
+
+	for r := range mng.pending {
+		// upserts up to the checkpoint have been processed but the response
+		// got lost.
+		if r.seq != 0 && r.seq <= checkpoint {
+			mng.resolveLocked(r, nil, nil)
+		}
+	}
+
+	// upserts after the checkpoint must be replayed even if they have been
+	// answered already so the server assigns the same positions.
+	for _, r := range mng.buffer {
+		if r.seq > checkpoint {
+			mng.dispatch(r)
+		}
+	}
+
+	for r := range mng.pending {
+		if r.seq == 0 {
+			mng.dispatch(r)
+		}
+	}
+
+	return nil
+}
+
+// abortLocked fails all pending and subsequent requests with err.
+func (mng *Manager) abortLocked(err error) {
+	mng.err = err
+	mng.dropBatchLocked()
+
+	for r := range mng.pending {
+		mng.resolveLocked(r, nil, err)
+	}
+}
+
+// UpsertFuture is the result of an asynchronous upsert.
+//
+// It only carries the id of the customer since UpsertCustomerSuccess has no
+// room for the match decision and the import stream has no per-message
+// headers. Decisions are counted in SessionSummary.Matches and recorded per
+// record with the diffs of a dry-run, see PrintRunDiffs. Upserts parked for
+// review fail with a NeedsReviewError holding the candidates.
+type UpsertFuture struct {
+	done chan struct{}
+	id   string
+	err  error
+}
+
+func (f *UpsertFuture) resolve(id string, err error) *UpsertFuture {
+	f.id = id
+	f.err = err
+	close(f.done)
+
+	return f
+}
+
+// Done returns a channel that is closed once the upsert has been completed.
+func (f *UpsertFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the upsert to complete and returns the id of the upserted
+// customer. The id is empty for upserts skipped when resuming a session and
+// for upserts whose response got lost while reconnecting.
+func (f *UpsertFuture) Wait() (string, error) {
+	<-f.done
+
+	return f.id, f.err
+}
+
+// UpsertAsync sends an upsert for the customer with the given internal
+// reference without waiting for the response. It blocks if MaxInFlight
+// upserts are already waiting for their response.
+func (mng *Manager) UpsertAsync(internalReference string, customer *customerv1.Customer, extra map[string]interface{}) *UpsertFuture {
+	future := &UpsertFuture{
+		done: make(chan struct{}),
+	}
+
+	extraPb, err := structpb.NewStruct(extra)
+	if err != nil {
+		return future.resolve("", fmt.Errorf("invalid extra data: %w", err))
+	}
+
+	// upserts before the checkpoint of a resumed session have already been
+	// processed.
+	mng.l.Lock()
+	if mng.skip > 0 {
+		mng.skip--
+		mng.l.Unlock()
+
+		mng.reportProgress(1, 1, 0)
+
+		return future.resolve("", nil)
+	}
+	mng.l.Unlock()
+
+	select {
+	case mng.inFlight <- struct{}{}:
+	case <-mng.ctx.Done():
+		return future.resolve("", mng.ctx.Err())
+	}
+
 	// send an upsert request
-	upsertResult := <-mng.dispatcher.Send(&customerv1.ImportSessionRequest{
+	r := mng.submit(&customerv1.ImportSessionRequest{
 		Message: &customerv1.ImportSessionRequest_UpsertCustomer{
 			UpsertCustomer: &customerv1.UpsertCustomerRequest{
-				InternalReference: ref,
+				InternalReference: internalReference,
 				Customer:          customer,
-				ExtraData:         extraData,
+				ExtraData:         extraPb,
 			},
 		},
 	})
 
-	if upsertError := upsertResult.GetError(); upsertError != nil {
-		err := &multierror.Error{}
+	mng.reportProgress(1, 0, 0)
+
+	go func() {
+		defer func() { <-mng.inFlight }()
 
-		for _, e := range upsertError.Error {
-			err.Errors = append(err.Errors, errors.New(e))
+		res, err := mng.wait(r)
+		if err == nil {
+			err = responseError(res)
 		}
 
-		return fmt.Errorf("failed to upsert customer: %w", err)
-	}
+		if err != nil {
+			mng.reportProgress(0, 1, 1)
+			future.resolve("", fmt.Errorf("failed to upsert customer: %w", err))
 
-	return nil
+			return
+		}
+
+		mng.reportProgress(0, 1, 0)
+		future.resolve(res.GetUpsertSuccess().GetId(), nil)
+	}()
+
+	return future
 }
 
 func (mng *Manager) UpsertCustomerByRef(interalReference string, customer *customerv1.Customer, extra map[string]interface{}) error {
-	extraPb, err := structpb.NewStruct(extra)
+	_, err := mng.UpsertAsync(interalReference, customer, extra).Wait()
+
+	return err
+}
+
+// Lookup searches for customers matching query. Internal reference queries
+// without an importer refer to the importer of the session.
+func (mng *Manager) Lookup(query *customerv1.CustomerQuery) ([]*customerv1.ImportedCustomer, error) {
+	res, err := mng.wait(mng.submit(&customerv1.ImportSessionRequest{
+		Message: &customerv1.ImportSessionRequest_LookupCustomer{
+			LookupCustomer: &customerv1.LookupCustomerRequest{
+				Query: query,
+			},
+		},
+	}))
+	if err == nil {
+		err = responseError(res)
+	}
+
 	if err != nil {
-		return fmt.Errorf("invalid extra data: %w", err)
+		return nil, fmt.Errorf("failed to lookup customer: %w", err)
 	}
 
-	return mng.upsertCustomer(interalReference, customer, extraPb)
+	return res.GetLookupCustomer().GetMatchedCustomers(), nil
 }
 
-func (mng *Manager) Stop() error {
-	mng.dispatcher.Stop()
+// responseError returns the error reported by the server in res, if any.
+func responseError(res *customerv1.ImportSessionResponse) error {
+	responseErr := res.GetError()
+	if responseErr == nil {
+		return nil
+	}
 
-	return nil
+	if review := parseNeedsReview(responseErr.Error); review != nil {
+		return review
+	}
+
+	err := &multierror.Error{}
+
+	for _, e := range responseErr.Error {
+		err.Errors = append(err.Errors, errors.New(e))
+	}
+
+	return err
+}
+
+func (mng *Manager) reportProgress(sent, completed, failed int) {
+	mng.progressL.Lock()
+	defer mng.progressL.Unlock()
+
+	mng.progress.Sent += sent
+	mng.progress.Completed += completed
+	mng.progress.Failed += failed
+
+	if completed > 0 && mng.opts.OnProgress != nil {
+		mng.opts.OnProgress(mng.progress)
+	}
+}
+
+// Progress returns the current progress of the import session.
+func (mng *Manager) Progress() Progress {
+	mng.progressL.Lock()
+	defer mng.progressL.Unlock()
+
+	return mng.progress
+}
+
+// Stop waits for all asynchronous upserts, completes the import session and
+// returns the session summary reported by the server. The summary is nil if
+// the server did not send one. If the stream fails while completing the
+// session it is reconnected and Stop is retried. If the server already
+// completed the session the summary of the import run is returned. Stop may
+// be called after a failure.
+func (mng *Manager) Stop() (*SessionSummary, error) {
+	// there is nothing left to wait for.
+	mng.flushBatch()
+
+	// acquiring all slots waits until every asynchronous upsert has been
+	// completed.
+	var acquired int
+	defer func() {
+		for ; acquired > 0; acquired-- {
+			<-mng.inFlight
+		}
+	}()
+
+	for acquired < cap(mng.inFlight) {
+		select {
+		case mng.inFlight <- struct{}{}:
+			acquired++
+		case <-mng.ctx.Done():
+			return nil, mng.ctx.Err()
+		}
+	}
+
+	for {
+		mng.l.Lock()
+		dispatcher, err, completed := mng.dispatcher, mng.err, mng.completed
+		mng.l.Unlock()
+
+		if completed != nil {
+			return completed, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dispatcher.Stop(); err != nil {
+			if isStreamError(err) {
+				mng.reconnect(dispatcher)
+				continue
+			}
+
+			return nil, err
+		}
+
+		return SummaryFromTrailer(dispatcher.stream.ResponseTrailer())
+	}
 }
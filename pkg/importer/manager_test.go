@@ -0,0 +1,414 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	connect "github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+	customerv1 "github.com/tierklinik-dobersberg/apis/gen/go/tkd/customer/v1"
+)
+
+// fakeServer serves import streams. The first stream breaks when receiving
+// the upsert with position breakAt, all following streams resume the
+// session from the number of upserts processed so far. If breakOnComplete
+// is set the first stream breaks after completing the session.
+type fakeServer struct {
+	breakAt         int
+	breakOnComplete bool
+
+	l         sync.Mutex
+	streams   int
+	resumed   []string
+	received  []string
+	completed bool
+}
+
+func (srv *fakeServer) newStream(ctx context.Context) ImportStream {
+	srv.l.Lock()
+	srv.streams++
+	first := srv.streams == 1
+	srv.l.Unlock()
+
+	stream := newFakeStream()
+	go srv.serve(stream, first)
+
+	return stream
+}
+
+func (srv *fakeServer) serve(stream *fakeStream, first bool) {
+	for req := range stream.requests {
+		switch v := req.Message.(type) {
+		case *customerv1.ImportSessionRequest_StartSession:
+			srv.l.Lock()
+			if ref := stream.requestHeader.Get(ResumeSessionHeader); ref != "" {
+				srv.resumed = append(srv.resumed, ref)
+
+				if srv.completed {
+					srv.l.Unlock()
+
+					err := connect.NewError(connect.CodeFailedPrecondition, errors.New("import run has already been completed"))
+					err.Meta().Set(SummaryTrailer, fmt.Sprintf(`{"importer": "test", "created": %d}`, len(srv.received)))
+
+					stream.errs <- err
+					return
+				}
+			}
+			stream.responseHeader.Set(SessionIdHeader, "session")
+			stream.responseHeader.Set(CheckpointHeader, strconv.Itoa(len(srv.received)))
+			srv.l.Unlock()
+
+			stream.responses <- &customerv1.ImportSessionResponse{
+				CorrelationId: req.CorrelationId,
+				Message: &customerv1.ImportSessionResponse_StartSession{
+					StartSession: &customerv1.StartSessionResponse{},
+				},
+			}
+
+		case *customerv1.ImportSessionRequest_UpsertCustomer:
+			srv.l.Lock()
+			broken := first && len(srv.received)+1 == srv.breakAt
+			if !broken {
+				srv.received = append(srv.received, v.UpsertCustomer.InternalReference)
+			}
+			srv.l.Unlock()
+
+			if broken {
+				stream.errs <- errors.New("connection reset")
+				return
+			}
+
+			stream.responses <- &customerv1.ImportSessionResponse{
+				CorrelationId: req.CorrelationId,
+				Message: &customerv1.ImportSessionResponse_UpsertSuccess{
+					UpsertSuccess: &customerv1.UpsertCustomerSuccess{
+						Id: "id-" + v.UpsertCustomer.InternalReference,
+					},
+				},
+			}
+
+		case *customerv1.ImportSessionRequest_LookupCustomer:
+			ref := v.LookupCustomer.GetQuery().GetInternalReference().GetRef()
+
+			stream.responses <- &customerv1.ImportSessionResponse{
+				CorrelationId: req.CorrelationId,
+				Message: &customerv1.ImportSessionResponse_LookupCustomer{
+					LookupCustomer: &customerv1.LookupCustomerResponse{
+						MatchedCustomers: []*customerv1.ImportedCustomer{
+							{Customer: &customerv1.Customer{Id: "id-" + ref}},
+						},
+					},
+				},
+			}
+
+		case *customerv1.ImportSessionRequest_Complete:
+			srv.l.Lock()
+			srv.completed = true
+			srv.l.Unlock()
+
+			if first && srv.breakOnComplete {
+				stream.errs <- errors.New("connection reset")
+				return
+			}
+
+			stream.errs <- io.EOF
+			return
+		}
+	}
+}
+
+func TestManagerReconnect(t *testing.T) {
+	srv := &fakeServer{breakAt: 6}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "session", mng.SessionID())
+
+	var expected []string
+	for i := 1; i <= 10; i++ {
+		ref := fmt.Sprint(i)
+		expected = append(expected, ref)
+
+		require.NoError(t, mng.UpsertCustomerByRef(ref, &customerv1.Customer{}, nil))
+	}
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	require.Equal(t, 2, srv.streams)
+	require.Equal(t, []string{"session"}, srv.resumed)
+	require.Equal(t, expected, srv.received)
+}
+
+func TestManagerReconnectReleasesLock(t *testing.T) {
+	srv := &fakeServer{breakAt: 1}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	first := mng.UpsertAsync("1", &customerv1.Customer{}, nil)
+
+	// the condition needs the lock so it is not held while backing off
+	require.Eventually(t, func() bool {
+		mng.l.Lock()
+		defer mng.l.Unlock()
+
+		return mng.reconnecting != nil
+	}, 100*time.Millisecond, time.Millisecond)
+
+	// requests submitted while reconnecting are replayed
+	second := mng.UpsertAsync("2", &customerv1.Customer{}, nil)
+
+	id, err := first.Wait()
+	require.NoError(t, err)
+	require.Equal(t, "id-1", id)
+
+	id, err = second.Wait()
+	require.NoError(t, err)
+	require.Equal(t, "id-2", id)
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"1", "2"}, srv.received)
+}
+
+func TestManagerStopCompleted(t *testing.T) {
+	srv := &fakeServer{breakOnComplete: true}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, mng.UpsertCustomerByRef("1", &customerv1.Customer{}, nil))
+
+	// the session has been completed but the stream broke before the
+	// summary has been received.
+	summary, err := mng.Stop()
+	require.NoError(t, err)
+	require.NotNil(t, summary)
+	require.Equal(t, 1, summary.Created)
+	require.Equal(t, []string{"session"}, srv.resumed)
+
+	require.ErrorIs(t, mng.UpsertCustomerByRef("2", &customerv1.Customer{}, nil), ErrSessionCompleted)
+}
+
+func TestManagerReplayBufferExceeded(t *testing.T) {
+	srv := &fakeServer{breakAt: 3}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: time.Millisecond,
+		ReplayBuffer:     1,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, mng.UpsertCustomerByRef("1", &customerv1.Customer{}, nil))
+	require.NoError(t, mng.UpsertCustomerByRef("2", &customerv1.Customer{}, nil))
+
+	// the server checkpoint (2) is still covered by the buffer
+	require.NoError(t, mng.UpsertCustomerByRef("3", &customerv1.Customer{}, nil))
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	// make the server lose its progress so the replay buffer does not
+	// cover the checkpoint anymore.
+	srv = &fakeServer{}
+
+	mng, err = NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: time.Millisecond,
+		ReplayBuffer:     1,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, mng.UpsertCustomerByRef("1", &customerv1.Customer{}, nil))
+
+	srv.l.Lock()
+	srv.received = nil
+	srv.breakAt = 1
+	srv.l.Unlock()
+
+	err = mng.UpsertCustomerByRef("2", &customerv1.Customer{}, nil)
+	require.ErrorIs(t, err, ErrReplayBufferExceeded)
+
+	_, err = mng.Stop()
+	require.ErrorIs(t, err, ErrReplayBufferExceeded)
+}
+
+func TestManagerAsync(t *testing.T) {
+	srv := &fakeServer{}
+
+	var last Progress
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		MaxInFlight: 2,
+		OnProgress: func(p Progress) {
+			last = p
+		},
+	})
+	require.NoError(t, err)
+
+	var futures []*UpsertFuture
+	for i := 1; i <= 10; i++ {
+		futures = append(futures, mng.UpsertAsync(fmt.Sprint(i), &customerv1.Customer{}, nil))
+	}
+
+	for idx, f := range futures {
+		id, err := f.Wait()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("id-%d", idx+1), id)
+	}
+
+	matches, err := mng.Lookup(&customerv1.CustomerQuery{
+		Query: &customerv1.CustomerQuery_InternalReference{
+			InternalReference: &customerv1.InternalReferenceQuery{
+				Ref: "3",
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, "id-3", matches[0].Customer.Id)
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	require.Equal(t, Progress{Sent: 10, Completed: 10}, last)
+	require.Equal(t, last, mng.Progress())
+}
+
+func (srv *fakeServer) receivedRefs() []string {
+	srv.l.Lock()
+	defer srv.l.Unlock()
+
+	return append([]string(nil), srv.received...)
+}
+
+func TestManagerBatch(t *testing.T) {
+	srv := &fakeServer{}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		MaxInFlight:  8,
+		BatchSize:    3,
+		BatchLatency: time.Hour,
+	})
+	require.NoError(t, err)
+
+	first := mng.UpsertAsync("1", &customerv1.Customer{}, nil)
+	mng.UpsertAsync("2", &customerv1.Customer{}, nil)
+
+	// upserts are held back until the batch is full
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, srv.receivedRefs())
+
+	mng.UpsertAsync("3", &customerv1.Customer{}, nil)
+
+	id, err := first.Wait()
+	require.NoError(t, err)
+	require.Equal(t, "id-1", id)
+
+	// lookups are sent after all batched upserts
+	mng.UpsertAsync("4", &customerv1.Customer{}, nil)
+
+	_, err = mng.Lookup(&customerv1.CustomerQuery{
+		Query: &customerv1.CustomerQuery_InternalReference{
+			InternalReference: &customerv1.InternalReferenceQuery{Ref: "4"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3", "4"}, srv.receivedRefs())
+
+	// stop sends the remaining upserts
+	last := mng.UpsertAsync("5", &customerv1.Customer{}, nil)
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	_, err = last.Wait()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3", "4", "5"}, srv.receivedRefs())
+}
+
+func TestManagerBatchLatency(t *testing.T) {
+	srv := &fakeServer{}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		BatchSize:    10,
+		BatchLatency: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// a single upsert is sent once the latency passed
+	require.NoError(t, mng.UpsertCustomerByRef("1", &customerv1.Customer{}, nil))
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+}
+
+func TestManagerBatchReconnect(t *testing.T) {
+	srv := &fakeServer{breakAt: 5}
+
+	mng, err := NewManager(context.Background(), "test", srv.newStream, Options{
+		ReconnectBackoff: time.Millisecond,
+		MaxInFlight:      4,
+		BatchSize:        4,
+		BatchLatency:     time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	var (
+		expected []string
+		futures  []*UpsertFuture
+	)
+
+	for i := 1; i <= 10; i++ {
+		ref := fmt.Sprint(i)
+		expected = append(expected, ref)
+
+		futures = append(futures, mng.UpsertAsync(ref, &customerv1.Customer{}, nil))
+	}
+
+	for _, f := range futures {
+		_, err := f.Wait()
+		require.NoError(t, err)
+	}
+
+	_, err = mng.Stop()
+	require.NoError(t, err)
+
+	require.Equal(t, 2, srv.streams)
+	require.Equal(t, expected, srv.receivedRefs())
+}
+
+func TestResponseErrorNeedsReview(t *testing.T) {
+	payload := (&NeedsReviewError{Candidates: []string{"a", "b"}}).Payload()
+
+	err := responseError(&customerv1.ImportSessionResponse{
+		Message: &customerv1.ImportSessionResponse_Error{
+			Error: &customerv1.Error{Error: payload},
+		},
+	})
+	require.ErrorIs(t, err, ErrNeedsReview)
+
+	var review *NeedsReviewError
+	require.ErrorAs(t, err, &review)
+	require.Equal(t, []string{"a", "b"}, review.Candidates)
+
+	err = responseError(&customerv1.ImportSessionResponse{
+		Message: &customerv1.ImportSessionResponse_Error{
+			Error: &customerv1.Error{Error: []string{"failed"}},
+		},
+	})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNeedsReview)
+}
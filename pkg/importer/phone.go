@@ -0,0 +1,25 @@
+package importer
+
+import (
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// NormalizePhoneNumber parses number using the default country and returns
+// it in international format. Numbers that neither start with "+" nor "0"
+// are prefixed with prefix, if set.
+func NormalizePhoneNumber(number, country, prefix string) (string, error) {
+	number = strings.TrimSpace(number)
+
+	if !strings.HasPrefix(number, "+") && !strings.HasPrefix(number, "0") && prefix != "" {
+		number = prefix + number
+	}
+
+	p, err := phonenumbers.Parse(number, country)
+	if err != nil {
+		return "", err
+	}
+
+	return phonenumbers.Format(p, phonenumbers.INTERNATIONAL), nil
+}
@@ -0,0 +1,27 @@
+package importer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	cases := []struct {
+		number, prefix, expected string
+	}{
+		{"+43 664 1234567", "", "+43 664 1234567"},
+		{" 0664 1234567 ", "", "+43 664 1234567"},
+		{"1234567", "03174", "+43 3174 1234567"},
+		{"+43 1 234567", "03174", "+43 1 234567"},
+	}
+
+	for _, c := range cases {
+		result, err := NormalizePhoneNumber(c.number, "AT", c.prefix)
+		require.NoError(t, err, c.number)
+		require.Equal(t, c.expected, result, c.number)
+	}
+
+	_, err := NormalizePhoneNumber("not a number", "AT", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,59 @@
+package importer
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNeedsReview is reported for upserts that matched more than one
+// existing customer. The upsert has been parked for manual review and is
+// applied once an administrator picked the matching customer.
+var ErrNeedsReview = errors.New("customer matches multiple existing records and needs review")
+
+// reviewCandidatePrefix marks the candidate IDs in the error payload of
+// upserts that need review.
+const reviewCandidatePrefix = "candidate:"
+
+// NeedsReviewError is returned for upserts that need review. It wraps
+// ErrNeedsReview and holds the IDs of all matching customers.
+type NeedsReviewError struct {
+	Candidates []string
+}
+
+func (e *NeedsReviewError) Error() string {
+	return ErrNeedsReview.Error() + ": " + strings.Join(e.Candidates, ", ")
+}
+
+func (e *NeedsReviewError) Unwrap() error {
+	return ErrNeedsReview
+}
+
+// Payload returns the error messages sent to the importer. The first
+// message is the text of ErrNeedsReview, followed by one message per
+// candidate.
+func (e *NeedsReviewError) Payload() []string {
+	payload := []string{ErrNeedsReview.Error()}
+	for _, id := range e.Candidates {
+		payload = append(payload, reviewCandidatePrefix+id)
+	}
+
+	return payload
+}
+
+// parseNeedsReview decodes an error payload created by
+// NeedsReviewError.Payload. It returns nil if payload does not report an
+// upsert that needs review.
+func parseNeedsReview(payload []string) *NeedsReviewError {
+	if len(payload) == 0 || payload[0] != ErrNeedsReview.Error() {
+		return nil
+	}
+
+	e := &NeedsReviewError{}
+	for _, p := range payload[1:] {
+		if id, ok := strings.CutPrefix(p, reviewCandidatePrefix); ok {
+			e.Candidates = append(e.Candidates, id)
+		}
+	}
+
+	return e
+}
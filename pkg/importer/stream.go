@@ -0,0 +1,105 @@
+package importer
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// StreamOptions configures an import session using the request headers of
+// the import stream.
+type StreamOptions struct {
+	// DryRun validates all upserts without storing them.
+	DryRun bool
+
+	// Snapshot marks the session as full snapshot so customers of the
+	// importer that have not been upserted are removed when it completes.
+	Snapshot bool
+
+	// MaxRemove is the fraction of customers a snapshot may remove. Zero
+	// uses the server default.
+	MaxRemove float64
+
+	// Resume is the id of an interrupted session that should be resumed.
+	Resume string
+}
+
+// Apply sets the request headers for opts on stream and returns it.
+func (opts StreamOptions) Apply(stream ImportStream) ImportStream {
+	header := stream.RequestHeader()
+
+	if opts.DryRun {
+		header.Set(DryRunHeader, "true")
+	}
+
+	if opts.Snapshot {
+		header.Set(SnapshotHeader, "true")
+
+		if opts.MaxRemove > 0 {
+			header.Set(SnapshotMaxRemoveHeader, strconv.FormatFloat(opts.MaxRemove, 'f', -1, 64))
+		}
+	}
+
+	if opts.Resume != "" {
+		header.Set(ResumeSessionHeader, opts.Resume)
+	}
+
+	return stream
+}
+
+// Collector waits for the results of asynchronous upserts.
+type Collector struct {
+	// OnError is called for each upsert that failed for a reason other
+	// than a failed import stream.
+	OnError func(ref string, err error)
+
+	wg        sync.WaitGroup
+	l         sync.Mutex
+	streamErr error
+}
+
+// Add waits for future in the background.
+func (c *Collector) Add(ref string, future *UpsertFuture) {
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		_, err := future.Wait()
+		if err == nil {
+			return
+		}
+
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			c.l.Lock()
+			if c.streamErr == nil {
+				c.streamErr = err
+			}
+			c.l.Unlock()
+
+			return
+		}
+
+		if c.OnError != nil {
+			c.OnError(ref, err)
+		}
+	}()
+}
+
+// Err returns the first StreamError reported by an upsert, if any. Once the
+// stream failed all further upserts fail as well.
+func (c *Collector) Err() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.streamErr
+}
+
+// Wait waits for all added upserts and returns the first StreamError, if
+// any.
+func (c *Collector) Wait() error {
+	c.wg.Wait()
+
+	return c.Err()
+}
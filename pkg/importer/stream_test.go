@@ -0,0 +1,69 @@
+package importer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamOptionsApply(t *testing.T) {
+	stream := StreamOptions{}.Apply(newFakeStream())
+	require.Empty(t, stream.RequestHeader())
+
+	stream = StreamOptions{
+		DryRun:    true,
+		Snapshot:  true,
+		MaxRemove: 0.25,
+		Resume:    "run",
+	}.Apply(newFakeStream())
+
+	require.Equal(t, "true", stream.RequestHeader().Get(DryRunHeader))
+	require.Equal(t, "true", stream.RequestHeader().Get(SnapshotHeader))
+	require.Equal(t, "0.25", stream.RequestHeader().Get(SnapshotMaxRemoveHeader))
+	require.Equal(t, "run", stream.RequestHeader().Get(ResumeSessionHeader))
+
+	// the removal limit is only sent for snapshots
+	stream = StreamOptions{MaxRemove: 0.25}.Apply(newFakeStream())
+	require.Empty(t, stream.RequestHeader().Get(SnapshotMaxRemoveHeader))
+}
+
+func TestCollector(t *testing.T) {
+	var (
+		l      sync.Mutex
+		failed []string
+	)
+
+	c := &Collector{
+		OnError: func(ref string, err error) {
+			l.Lock()
+			defer l.Unlock()
+
+			failed = append(failed, ref)
+		},
+	}
+
+	newFuture := func() *UpsertFuture {
+		return &UpsertFuture{done: make(chan struct{})}
+	}
+
+	ok, invalid, broken := newFuture(), newFuture(), newFuture()
+
+	c.Add("1", ok)
+	c.Add("2", invalid)
+	c.Add("3", broken)
+
+	ok.resolve("id", nil)
+	invalid.resolve("", errors.New("missing name"))
+	require.NoError(t, c.Err())
+
+	streamErr := &StreamError{Err: errors.New("connection reset")}
+	broken.resolve("", streamErr)
+
+	require.ErrorIs(t, c.Wait(), streamErr)
+	require.ErrorIs(t, c.Err(), streamErr)
+
+	// stream errors are not reported per upsert
+	require.Equal(t, []string{"2"}, failed)
+}
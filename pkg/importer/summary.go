@@ -0,0 +1,259 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	connect "github.com/bufbuild/connect-go"
+)
+
+const (
+	// SummaryTrailer is the response trailer used by customerd to return the
+	// JSON encoded SessionSummary when an import session is completed. The
+	// summary only holds counts, error messages and dry-run changes are
+	// recorded with the import run.
+	SummaryTrailer = "Import-Session-Summary"
+
+	// DryRunHeader may be set to "true" on the ImportSession request to
+	// start a dry-run session. Upserts are matched and patched as usual but
+	// never stored. The changes that would have been applied are recorded
+	// with the import run.
+	DryRunHeader = "Import-Dry-Run"
+
+	// SnapshotHeader may be set to "true" if the importer sends a complete
+	// snapshot of its data. When the session is completed, all states of
+	// the importer whose reference has not been upserted are removed.
+	SnapshotHeader = "Import-Full-Snapshot"
+
+	// SnapshotMaxRemoveHeader overwrites the maximum fraction (between 0 and
+	// 1) of the importer's states that a full snapshot session may remove.
+	// If more states would be removed nothing is removed at all.
+	SnapshotMaxRemoveHeader = "Import-Snapshot-Max-Remove"
+
+	// SessionIdHeader is the response header holding the id that customerd
+	// assigned to the import session.
+	SessionIdHeader = "Import-Session-Id"
+
+	// ResumeSessionHeader may be set to the id of an interrupted import
+	// session to resume it. The dry-run and snapshot settings of the
+	// original session are used.
+	ResumeSessionHeader = "Import-Resume-Session"
+
+	// CheckpointHeader is the response header holding the number of upserts
+	// of a resumed session that have already been processed. Importers must
+	// skip that many upserts and continue with the next one.
+	CheckpointHeader = "Import-Session-Checkpoint"
+)
+
+// AttributeChange describes a single attribute value that has been added or
+// removed.
+type AttributeChange struct {
+	Attribute string `json:"attribute"`
+	Removed   string `json:"removed,omitempty"`
+	Added     string `json:"added,omitempty"`
+}
+
+// RecordDiff describes the changes an upsert applied, or would have applied
+// in dry-run mode, to a customer record.
+type RecordDiff struct {
+	Ref string `json:"ref"`
+
+	// CustomerID is empty for new customers in dry-run mode.
+	CustomerID string `json:"customerId,omitempty"`
+	Created    bool   `json:"created,omitempty"`
+
+	// Decision describes how the record has been matched to the customer,
+	// see SessionSummary.Matches.
+	Decision string `json:"decision,omitempty"`
+
+	Changes []AttributeChange `json:"changes"`
+}
+
+// SessionSummary contains statistics about a completed import session.
+type SessionSummary struct {
+	Importer string `json:"importer"`
+
+	// RunID is the id of the import run that records the error messages
+	// and dry-run changes of the session.
+	RunID string `json:"runId,omitempty"`
+
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+	Pristine int `json:"pristine"`
+	Failed   int `json:"failed"`
+	Lookups  int `json:"lookups"`
+
+	// NeedsReview is the number of upserts that matched more than one
+	// existing customer and have been parked for manual review. They are
+	// not counted as failed.
+	NeedsReview int `json:"needsReview,omitempty"`
+
+	// Matches counts the applied upserts by their match decision: "ref",
+	// "phone", "email" or "name-address" for upserts matched to an existing
+	// customer and "new" for upserts that created a customer.
+	Matches map[string]int `json:"matches,omitempty"`
+
+	// AttributeUpdates is the number of customer attributes that have been
+	// added, changed or removed.
+	AttributeUpdates int `json:"attributeUpdates"`
+
+	// PrunedAttributes is the number of attributes that the importer owned
+	// but which have not been part of the upserted customer anymore.
+	PrunedAttributes int `json:"prunedAttributes"`
+
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+
+	// RemovedStates is the number of import states removed at the end of
+	// a full snapshot session and DeletedCustomers the number of customers
+	// that have been deleted because no other state was left.
+	RemovedStates    int `json:"removedStates,omitempty"`
+	DeletedCustomers int `json:"deletedCustomers,omitempty"`
+
+	// SnapshotAborted is set if removing the orphaned states of a full
+	// snapshot session has been aborted because of the safety threshold.
+	SnapshotAborted bool `json:"snapshotAborted,omitempty"`
+
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// Upserts returns the number of upserted records.
+func (s *SessionSummary) Upserts() int {
+	return s.Created + s.Updated + s.Pristine + s.Failed + s.NeedsReview
+}
+
+// Print writes a human readable report of the summary to w.
+func (s *SessionSummary) Print(w io.Writer) {
+	if s.DryRun {
+		fmt.Fprintf(w, "dry-run of import session %q, nothing has been stored\n", s.Importer)
+	}
+
+	fmt.Fprintf(w, "import session %q finished in %s\n", s.Importer, s.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "  created:           %d\n", s.Created)
+	fmt.Fprintf(w, "  updated:           %d\n", s.Updated)
+	fmt.Fprintf(w, "  pristine:          %d\n", s.Pristine)
+	fmt.Fprintf(w, "  failed:            %d\n", s.Failed)
+	fmt.Fprintf(w, "  needs review:      %d\n", s.NeedsReview)
+	fmt.Fprintf(w, "  lookups:           %d\n", s.Lookups)
+	fmt.Fprintf(w, "  attribute updates: %d\n", s.AttributeUpdates)
+	fmt.Fprintf(w, "  pruned attributes: %d\n", s.PrunedAttributes)
+	fmt.Fprintf(w, "  removed states:    %d\n", s.RemovedStates)
+	fmt.Fprintf(w, "  deleted customers: %d\n", s.DeletedCustomers)
+
+	decisions := make([]string, 0, len(s.Matches))
+	for d := range s.Matches {
+		decisions = append(decisions, d)
+	}
+	sort.Strings(decisions)
+
+	for _, d := range decisions {
+		fmt.Fprintf(w, "  %-18s %d\n", "match "+d+":", s.Matches[d])
+	}
+
+	if s.SnapshotAborted {
+		fmt.Fprintln(w, "  removing orphaned states has been aborted")
+	}
+
+	if s.RunID != "" && (s.DryRun || s.Failed > 0) {
+		fmt.Fprintf(w, "see import run %s for the changes and error messages\n", s.RunID)
+	}
+}
+
+// PrintDiffs writes a human readable report of the changes of a dry-run
+// session to w.
+func PrintDiffs(w io.Writer, diffs []RecordDiff, truncated bool) {
+	for _, d := range diffs {
+		if d.Created {
+			fmt.Fprintf(w, "ref %s: new customer\n", d.Ref)
+		} else if d.Decision != "" {
+			fmt.Fprintf(w, "ref %s: customer %s (matched by %s)\n", d.Ref, d.CustomerID, d.Decision)
+		} else {
+			fmt.Fprintf(w, "ref %s: customer %s\n", d.Ref, d.CustomerID)
+		}
+
+		for _, c := range d.Changes {
+			if c.Removed != "" {
+				fmt.Fprintf(w, "  - %s: %s\n", c.Attribute, c.Removed)
+			}
+			if c.Added != "" {
+				fmt.Fprintf(w, "  + %s: %s\n", c.Attribute, c.Added)
+			}
+		}
+	}
+
+	if truncated {
+		fmt.Fprintln(w, "(more changes have been omitted)")
+	}
+}
+
+// PrintRunDiffs loads the changes recorded with the import run runID from
+// the /imports/runs/show endpoint of customerd at baseURL and writes them to
+// w using PrintDiffs. cli must authenticate as an administrator.
+func PrintRunDiffs(ctx context.Context, w io.Writer, cli connect.HTTPClient, baseURL, runID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/imports/runs/show?id="+url.QueryEscape(runID), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var run struct {
+		Diffs          []RecordDiff `json:"diffs"`
+		DiffsTruncated bool         `json:"diffsTruncated"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&run); err != nil {
+		return fmt.Errorf("failed to decode import run: %w", err)
+	}
+
+	PrintDiffs(w, run.Diffs, run.DiffsTruncated)
+
+	return nil
+}
+
+// SummaryFromTrailer decodes the session summary from the response trailer.
+// It returns nil if the trailer is not set.
+func SummaryFromTrailer(trailer http.Header) (*SessionSummary, error) {
+	value := trailer.Get(SummaryTrailer)
+	if value == "" {
+		return nil, nil
+	}
+
+	var summary SessionSummary
+	if err := json.Unmarshal([]byte(value), &summary); err != nil {
+		return nil, fmt.Errorf("failed to decode session summary: %w", err)
+	}
+
+	return &summary, nil
+}
+
+// completedSummary returns the summary customerd attaches to the error
+// returned when resuming a session that has already been completed. It
+// returns nil for all other errors.
+func completedSummary(err error) *SessionSummary {
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) || connectErr.Code() != connect.CodeFailedPrecondition {
+		return nil
+	}
+
+	summary, _ := SummaryFromTrailer(connectErr.Meta())
+
+	return summary
+}
@@ -0,0 +1,43 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintRunDiffs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/imports/runs/show" || r.URL.Query().Get("id") != "run-1" {
+			http.Error(w, "import run not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": "run-1",
+			"diffs": []RecordDiff{
+				{Ref: "1", Created: true, Changes: []AttributeChange{{Attribute: "lastName", Added: "Doe"}}},
+				{Ref: "2", CustomerID: "c2", Decision: "phone", Changes: []AttributeChange{{Attribute: "city", Removed: "Wien", Added: "Linz"}}},
+			},
+			"diffsTruncated": true,
+		})
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, PrintRunDiffs(context.Background(), &buf, srv.Client(), srv.URL+"/", "run-1"))
+	require.Equal(t, "ref 1: new customer\n"+
+		"  + lastName: Doe\n"+
+		"ref 2: customer c2 (matched by phone)\n"+
+		"  - city: Wien\n"+
+		"  + city: Linz\n"+
+		"(more changes have been omitted)\n", buf.String())
+
+	err := PrintRunDiffs(context.Background(), &buf, srv.Client(), srv.URL, "unknown")
+	require.ErrorContains(t, err, "import run not found")
+}